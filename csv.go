@@ -0,0 +1,152 @@
+package jsqt
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// CSVOptions configures FromCSV.
+type CSVOptions struct {
+	Sep    rune     // Field separator. Defaults to a comma. Use '\t' for TSV.
+	Header []string // Column names. When nil the first record is the header.
+	Infer  bool     // Converts numbers and booleans. Otherwise every value is a string.
+}
+
+// FromCSV reads RFC 4180 CSV records into an array
+// of objects whose keys are the header columns.
+func FromCSV(r io.Reader, opts CSVOptions) (Json, error) {
+	cr := csv.NewReader(r)
+	if opts.Sep != 0 {
+		cr.Comma = opts.Sep
+	}
+	cols := opts.Header
+	if cols == nil {
+		h, err := cr.Read()
+		if err == io.EOF {
+			return JSON("[]"), nil
+		}
+		if err != nil {
+			return JSON(""), err
+		}
+		cols = h
+	}
+	cr.FieldsPerRecord = len(cols)
+	keys := make([]string, len(cols))
+	for i, c := range cols {
+		keys[i] = quoteJSON(c)
+	}
+	var o strings.Builder
+	o.WriteString("[")
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return JSON(""), err
+		}
+		if o.Len() > 1 {
+			o.WriteString(",")
+		}
+		o.WriteString("{")
+		for i, v := range rec {
+			if i > 0 {
+				o.WriteString(",")
+			}
+			o.WriteString(keys[i])
+			o.WriteString(":")
+			if opts.Infer && (v == "true" || v == "false" || isNumber(v)) {
+				o.WriteString(v)
+			} else {
+				o.WriteString(quoteJSON(v))
+			}
+		}
+		o.WriteString("}")
+	}
+	o.WriteString("]")
+	return JSON(o.String()), nil
+}
+
+func funcToCSV(q *Query, j Json) Json {
+	var cols []string
+	sep, union := ",", false
+	for q.MoreArg() {
+		if q.Match("-cols") {
+			for q.MoreArg() && !q.s.EqualByte('-') {
+				cols = append(cols, q.ParseFunOrRaw(j).Str())
+			}
+		} else if q.Match("-sep") {
+			sep = q.ParseFunOrRaw(j).Str()
+		} else if q.Match("-u") {
+			union = true
+		} else {
+			q.SkipArg()
+		}
+	}
+	comma, size := utf8.DecodeRuneInString(sep)
+	if !j.IsArray() || size != len(sep) || comma == '"' || comma == '\r' || comma == '\n' {
+		return JSON("")
+	}
+	if cols == nil {
+		cols = csvColumns(j, union)
+	}
+	var o strings.Builder
+	o.Grow(len(j.s))
+	w := csv.NewWriter(&o)
+	w.Comma, w.UseCRLF = comma, true
+	if len(cols) > 0 {
+		w.Write(cols)
+	}
+	j.ForEach(func(i, v Json) bool {
+		var row []string
+		if v.IsObject() {
+			row = make([]string, len(cols))
+			for c, col := range cols {
+				row[c] = csvValue(v.Get(col))
+			}
+		} else {
+			v.ForEach(func(i, v Json) bool {
+				row = append(row, csvValue(v))
+				return false
+			})
+		}
+		w.Write(row)
+		return false
+	})
+	w.Flush()
+	return JSON(o.String()).Stringify()
+}
+
+// csvColumns returns the keys of the first object of an array
+// or, when union is true, the keys of all objects in the order
+// they first appear.
+func csvColumns(j Json, union bool) []string {
+	var cols []string
+	seen := map[string]bool{}
+	j.ForEach(func(i, v Json) bool {
+		if !v.IsObject() {
+			return false
+		}
+		v.ForEachKeyVal(func(k, v Json) bool {
+			if key := k.Str(); !seen[key] {
+				seen[key] = true
+				cols = append(cols, key)
+			}
+			return false
+		})
+		return !union
+	})
+	return cols
+}
+
+// csvValue returns the text of a value in a CSV field.
+// Strings are decoded, null and missing values are empty,
+// and objects and arrays are written as JSON.
+func csvValue(v Json) string {
+	if v.IsNull() {
+		return ""
+	}
+	return v.Str()
+}
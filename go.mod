@@ -1,5 +1,5 @@
 module github.com/ofabricio/jsqt
 
-go 1.18
+go 1.21
 
 require github.com/ofabricio/scanner v0.0.0-20221007012848-26a090f8452b
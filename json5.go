@@ -0,0 +1,441 @@
+package jsqt
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// LenientOptions configures Lenient.
+type LenientOptions struct {
+	Comments bool // Keeps the comments. The result is then JSONC and needs (strict) to be queried.
+}
+
+// JSON5 converts JSON5 or JSONC to JSON. See Lenient.
+func JSON5(src string) (Json, error) {
+	return Lenient(src, LenientOptions{})
+}
+
+// Lenient converts JSON5 or JSONC to JSON. It removes comments and
+// trailing commas, quotes keys, converts single-quoted strings and
+// JSON5 escapes, and normalizes hexadecimal numbers, numbers with
+// a leading plus sign or a leading or trailing decimal point.
+// Infinity and NaN return an error since JSON doesn't have them.
+// The layout of the source, like its indentation, is kept.
+func Lenient(src string, opts LenientOptions) (Json, error) {
+	p := lenientParser{s: strings.TrimPrefix(src, "\ufeff"), opts: opts}
+	p.o = make([]byte, 0, len(src))
+	if err := p.space(); err != nil {
+		return JSON(""), err
+	}
+	if err := p.value(); err != nil {
+		return JSON(""), err
+	}
+	if err := p.space(); err != nil {
+		return JSON(""), err
+	}
+	if p.i < len(p.s) {
+		return JSON(""), p.errorf("unexpected %s", p.next())
+	}
+	return JSON(strings.TrimSpace(string(p.o))), nil
+}
+
+type lenientParser struct {
+	s    string
+	i    int
+	o    []byte
+	opts LenientOptions
+}
+
+func (p *lenientParser) errorf(format string, args ...any) error {
+	line := 1 + strings.Count(p.s[:p.i], "\n")
+	return fmt.Errorf("json5: line %d: "+format, append([]any{line}, args...)...)
+}
+
+// next returns the next character quoted, for error messages.
+func (p *lenientParser) next() string {
+	if p.i >= len(p.s) {
+		return "end of input"
+	}
+	r, _ := utf8.DecodeRuneInString(p.s[p.i:])
+	return strconv.QuoteRune(r)
+}
+
+// space copies white space and comments.
+func (p *lenientParser) space() error {
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			p.o = append(p.o, c)
+			p.i++
+			continue
+		}
+		if strings.HasPrefix(p.s[p.i:], "//") {
+			n := strings.IndexAny(p.s[p.i:], "\r\n")
+			if n < 0 {
+				n = len(p.s) - p.i
+			}
+			p.comment(p.s[p.i : p.i+n])
+			// Removes the line of a comment that is alone in it.
+			if !p.opts.Comments && (len(p.o) == 0 || p.o[len(p.o)-1] == '\n') {
+				if strings.HasPrefix(p.s[p.i:], "\r") {
+					p.i++
+				}
+				if strings.HasPrefix(p.s[p.i:], "\n") {
+					p.i++
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(p.s[p.i:], "/*") {
+			n := strings.Index(p.s[p.i+2:], "*/")
+			if n < 0 {
+				return p.errorf("unterminated comment")
+			}
+			p.comment(p.s[p.i : p.i+n+4])
+			continue
+		}
+		// JSON5 also accepts Unicode white space.
+		r, n := utf8.DecodeRuneInString(p.s[p.i:])
+		if r != '\ufeff' && !unicode.IsSpace(r) {
+			return nil
+		}
+		p.o = append(p.o, ' ')
+		p.i += n
+	}
+	return nil
+}
+
+func (p *lenientParser) comment(c string) {
+	p.i += len(c)
+	if p.opts.Comments {
+		p.o = append(p.o, c...)
+	} else {
+		p.o = bytes.TrimRight(p.o, " \t")
+	}
+}
+
+func (p *lenientParser) value() error {
+	if p.i >= len(p.s) {
+		return p.errorf("unexpected end of input")
+	}
+	switch c := p.s[p.i]; {
+	case c == '{':
+		return p.object()
+	case c == '[':
+		return p.array()
+	case c == '"' || c == '\'':
+		return p.str()
+	case c == '-' || c == '+' || c == '.' || c >= '0' && c <= '9':
+		return p.number()
+	}
+	switch w := p.ident(); w {
+	case "true", "false", "null":
+		p.o = append(p.o, w...)
+	case "Infinity", "NaN":
+		p.i -= len(w)
+		return p.errorf("%s is not supported by JSON", w)
+	case "":
+		return p.errorf("unexpected %s", p.next())
+	default:
+		p.i -= len(w)
+		return p.errorf("unexpected %s", w)
+	}
+	return nil
+}
+
+func (p *lenientParser) object() error {
+	p.o = append(p.o, '{')
+	p.i++
+	for {
+		if err := p.space(); err != nil {
+			return err
+		}
+		if p.i < len(p.s) && p.s[p.i] == '}' {
+			break
+		}
+		if p.i < len(p.s) && (p.s[p.i] == '"' || p.s[p.i] == '\'') {
+			if err := p.str(); err != nil {
+				return err
+			}
+		} else if k := p.ident(); k != "" {
+			p.o = append(p.o, quoteJSON(k)...)
+		} else {
+			return p.errorf("expected a key, got %s", p.next())
+		}
+		if err := p.space(); err != nil {
+			return err
+		}
+		if p.i >= len(p.s) || p.s[p.i] != ':' {
+			return p.errorf("expected :, got %s", p.next())
+		}
+		p.o = append(p.o, ':')
+		p.i++
+		if err := p.space(); err != nil {
+			return err
+		}
+		if err := p.value(); err != nil {
+			return err
+		}
+		if done, err := p.comma('}'); done || err != nil {
+			return err
+		}
+	}
+	p.o = append(p.o, '}')
+	p.i++
+	return nil
+}
+
+func (p *lenientParser) array() error {
+	p.o = append(p.o, '[')
+	p.i++
+	for {
+		if err := p.space(); err != nil {
+			return err
+		}
+		if p.i < len(p.s) && p.s[p.i] == ']' {
+			break
+		}
+		if err := p.value(); err != nil {
+			return err
+		}
+		if done, err := p.comma(']'); done || err != nil {
+			return err
+		}
+	}
+	p.o = append(p.o, ']')
+	p.i++
+	return nil
+}
+
+// comma matches the comma after a value or the closing
+// character, and removes the comma when it is a trailing
+// one. It reports if the closing character was matched.
+func (p *lenientParser) comma(end byte) (bool, error) {
+	if err := p.space(); err != nil {
+		return false, err
+	}
+	if p.i < len(p.s) && p.s[p.i] == end {
+		p.o = append(p.o, end)
+		p.i++
+		return true, nil
+	}
+	if p.i >= len(p.s) || p.s[p.i] != ',' {
+		return false, p.errorf("expected , or %c, got %s", end, p.next())
+	}
+	at := len(p.o)
+	p.o = append(p.o, ',')
+	p.i++
+	if err := p.space(); err != nil {
+		return false, err
+	}
+	if p.i < len(p.s) && p.s[p.i] == end {
+		p.o = append(p.o[:at], p.o[at+1:]...)
+	}
+	return false, nil
+}
+
+// ident matches an identifier, like an unquoted key.
+func (p *lenientParser) ident() string {
+	ini := p.i
+	for p.i < len(p.s) {
+		r, n := utf8.DecodeRuneInString(p.s[p.i:])
+		if !unicode.IsLetter(r) && r != '_' && r != '$' && (p.i == ini || !unicode.IsDigit(r)) {
+			break
+		}
+		p.i += n
+	}
+	return p.s[ini:p.i]
+}
+
+// number normalizes a JSON5 number to a JSON number.
+func (p *lenientParser) number() error {
+	ini := p.i
+	sign := ""
+	if c := p.s[p.i]; c == '-' || c == '+' {
+		if c == '-' {
+			sign = "-"
+		}
+		p.i++
+	}
+	for _, w := range []string{"Infinity", "NaN"} {
+		if strings.HasPrefix(p.s[p.i:], w) {
+			p.i = ini
+			return p.errorf("%s is not supported by JSON", p.s[ini:ini+len(w)+len(sign)])
+		}
+	}
+	digits := func() string {
+		at := p.i
+		for p.i < len(p.s) && p.s[p.i] >= '0' && p.s[p.i] <= '9' {
+			p.i++
+		}
+		return p.s[at:p.i]
+	}
+	if s := p.s[p.i:]; strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		p.i += 2
+		at := p.i
+		for p.i < len(p.s) && strings.IndexByte("0123456789abcdefABCDEF", p.s[p.i]) >= 0 {
+			p.i++
+		}
+		n, ok := new(big.Int).SetString(p.s[at:p.i], 16)
+		if !ok {
+			return p.errorf("invalid number %q", p.s[ini:p.i])
+		}
+		if sign == "-" && n.Sign() != 0 {
+			n.Neg(n)
+		}
+		p.o = append(p.o, n.String()...)
+		return nil
+	}
+	num := digits()
+	if len(num) > 1 && num[0] == '0' {
+		return p.errorf("invalid number %q", p.s[ini:p.i])
+	}
+	frac := ""
+	if p.i < len(p.s) && p.s[p.i] == '.' {
+		p.i++
+		frac = digits()
+	}
+	if num == "" && frac == "" {
+		return p.errorf("invalid number %q", p.s[ini:p.i])
+	}
+	if num == "" {
+		num = "0"
+	}
+	if frac != "" {
+		num += "." + frac
+	}
+	if p.i < len(p.s) && (p.s[p.i] == 'e' || p.s[p.i] == 'E') {
+		at := p.i
+		p.i++
+		if p.i < len(p.s) && (p.s[p.i] == '+' || p.s[p.i] == '-') {
+			p.i++
+		}
+		if digits() == "" {
+			return p.errorf("invalid number %q", p.s[ini:p.i])
+		}
+		num += p.s[at:p.i]
+	}
+	p.o = append(p.o, sign+num...)
+	return nil
+}
+
+// str converts a single or double-quoted string to a JSON string.
+// Strings that are valid JSON are kept as they are.
+func (p *lenientParser) str() error {
+	ini := p.i
+	quote := p.s[p.i]
+	strict := quote == '"'
+	var b strings.Builder
+	for p.i++; ; {
+		if p.i >= len(p.s) || p.s[p.i] == '\n' || p.s[p.i] == '\r' {
+			p.i = ini
+			return p.errorf("unterminated string")
+		}
+		c := p.s[p.i]
+		if c == quote {
+			p.i++
+			break
+		}
+		if c < ' ' {
+			strict = false
+		}
+		if c != '\\' {
+			r, n := utf8.DecodeRuneInString(p.s[p.i:])
+			b.WriteRune(r)
+			p.i += n
+			continue
+		}
+		p.i++
+		if p.i >= len(p.s) {
+			continue
+		}
+		switch e := p.s[p.i]; e {
+		case '"', '\\', '/':
+			b.WriteByte(e)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			r, ok := p.hex(4)
+			if !ok {
+				return p.errorf(`invalid escape \u`)
+			}
+			if utf16.IsSurrogate(r) && strings.HasPrefix(p.s[p.i+1:], `\u`) {
+				p.i += 2
+				if r2, ok := p.hex(4); ok && utf16.DecodeRune(r, r2) != utf8.RuneError {
+					r = utf16.DecodeRune(r, r2)
+				} else {
+					p.i -= 2 // A lone surrogate.
+				}
+			}
+			b.WriteRune(r)
+		default:
+			strict = false
+			switch e {
+			case 'v':
+				b.WriteByte('\v')
+			case '0':
+				if p.i+1 < len(p.s) && p.s[p.i+1] >= '0' && p.s[p.i+1] <= '9' {
+					return p.errorf(`invalid escape \0%c`, p.s[p.i+1])
+				}
+				b.WriteByte(0)
+			case 'x':
+				r, ok := p.hex(2)
+				if !ok {
+					return p.errorf(`invalid escape \x`)
+				}
+				b.WriteRune(r)
+			case '\r':
+				if p.i+1 < len(p.s) && p.s[p.i+1] == '\n' {
+					p.i++
+				}
+			case '\n':
+				// Line continuation.
+			default:
+				if e >= '1' && e <= '9' {
+					return p.errorf(`invalid escape \%c`, e)
+				}
+				r, n := utf8.DecodeRuneInString(p.s[p.i:])
+				if r != '\u2028' && r != '\u2029' { // Line continuation.
+					b.WriteRune(r)
+				}
+				p.i += n - 1
+			}
+		}
+		p.i++
+	}
+	if strict {
+		p.o = append(p.o, p.s[ini:p.i]...)
+	} else {
+		p.o = append(p.o, quoteJSON(b.String())...)
+	}
+	return nil
+}
+
+// hex decodes the n hexadecimal digits after the
+// current position and moves the position to the
+// last digit.
+func (p *lenientParser) hex(n int) (rune, bool) {
+	if p.i+n >= len(p.s) {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(p.s[p.i+1:p.i+1+n], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	p.i += n
+	return rune(v), true
+}
@@ -2,13 +2,38 @@
 package jsqt
 
 import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"html"
+	"io"
+	"log/slog"
 	"math"
+	"math/big"
+	"net/url"
 	"regexp"
+	"regexp/syntax"
+	"runtime/pprof"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
 
 	. "github.com/ofabricio/scanner" //lint:ignore ST1001 should not use dot imports
 )
@@ -21,10 +46,195 @@ func GetWith(jsn, qry string, args []any) Json {
 	return JSON(jsn).QueryWith(qry, args)
 }
 
+// GetE is like Get but also returns the error
+// that aborted the query, if any.
+func GetE(jsn, qry string) (Json, error) {
+	return JSON(jsn).QueryE(qry)
+}
+
+// GetContext is like Get but runs the query with
+// the opts, like Json.QueryContext.
+func GetContext(ctx context.Context, jsn, qry string, opts Options) (Json, error) {
+	return JSON(jsn).QueryContext(ctx, qry, opts)
+}
+
 func JSON(jsn string) Json {
 	return Json{Scanner(jsn)}
 }
 
+// GetMany is like calling Get with each query, but the queries
+// that are only a path, like `a b 0` or `(get a b 0)`, are all
+// answered in a single pass over the JSON. The other queries are
+// run one by one. Use an Extractor to run the same queries on
+// many JSON documents.
+func GetMany(jsn string, qrys ...string) []Json {
+	return newPathPlan(qrys).run(jsn)
+}
+
+// Extractor extracts named values from JSON documents.
+// See GetMany. It is safe for concurrent use.
+type Extractor struct {
+	names []string
+	plan  pathPlan
+}
+
+// NewExtractor makes an Extractor of the queries in fields,
+// which maps a name to its query.
+func NewExtractor(fields map[string]string) *Extractor {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	qrys := make([]string, len(names))
+	for i, name := range names {
+		qrys[i] = fields[name]
+	}
+	return &Extractor{names: names, plan: newPathPlan(qrys)}
+}
+
+// Extract returns the values of the queries by name.
+// Queries without a result are not in the map.
+func (e *Extractor) Extract(jsn string) map[string]Json {
+	vals := e.plan.run(jsn)
+	m := make(map[string]Json, len(vals))
+	for i, v := range vals {
+		if v.Exists() {
+			m[e.names[i]] = v
+		}
+	}
+	return m
+}
+
+// pathPlan answers many path queries in a single pass.
+type pathPlan struct {
+	qrys  []string
+	root  *pathNode
+	other []int // Queries that are not a path.
+}
+
+// pathNode is a key of a path. Paths with the
+// same prefix share their nodes.
+type pathNode struct {
+	keys []string
+	next []*pathNode
+	ends []int // Queries whose path ends here.
+}
+
+func newPathPlan(qrys []string) pathPlan {
+	p := pathPlan{qrys: qrys, root: &pathNode{}}
+	for i, qry := range qrys {
+		keys, ok := queryPath(qry)
+		if !ok {
+			p.other = append(p.other, i)
+			continue
+		}
+		n := p.root
+		for _, k := range keys {
+			if c := slices.Index(n.keys, k); c >= 0 {
+				n = n.next[c]
+			} else {
+				n.keys = append(n.keys, k)
+				n.next = append(n.next, &pathNode{})
+				n = n.next[len(n.next)-1]
+			}
+		}
+		n.ends = append(n.ends, i)
+	}
+	return p
+}
+
+func (p pathPlan) run(jsn string) []Json {
+	vals := make([]Json, len(p.qrys))
+	j := JSON(jsn)
+	j.s.WS()
+	p.root.walk(j, vals)
+	for _, i := range p.other {
+		vals[i] = j.Query(p.qrys[i])
+	}
+	return vals
+}
+
+// walk sets the values of the paths under n. Like Get,
+// only the first of duplicate keys is followed. It stops
+// scanning j once all keys of n were found.
+func (n *pathNode) walk(j Json, vals []Json) {
+	for _, i := range n.ends {
+		vals[i] = j
+	}
+	if len(n.next) == 0 {
+		return
+	}
+	found := 0
+	seen := make([]bool, len(n.next))
+	f := func(k, v Json) bool {
+		if c := slices.Index(n.keys, k.TrimQuote()); c >= 0 && !seen[c] {
+			seen[c] = true
+			n.next[c].walk(v, vals)
+			found++
+		}
+		return found == len(n.next)
+	}
+	if j.IsObject() {
+		j.ForEachKeyVal(f)
+	} else {
+		j.ForEach(f)
+	}
+}
+
+// queryPath returns the keys of a query that is only
+// a path, like `a b 0` or `(get a b 0)`.
+func queryPath(qry string) ([]string, bool) {
+	q := Query{qry: qry, s: Scanner(qry)}
+	q.s.WS()
+	keys, ok := q.parsePath(nil)
+	return keys, ok && q.IsEmpty()
+}
+
+func (q *Query) parsePath(keys []string) ([]string, bool) {
+	for q.MoreArg() {
+		if q.s.MatchByte('(') {
+			if q.ParseRaw().String() != "get" {
+				return nil, false
+			}
+			var ok bool
+			if keys, ok = q.parsePath(keys); !ok || !q.s.MatchByte(')') {
+				return nil, false
+			}
+			q.s.WS()
+			continue
+		}
+		if q.s.EqualByte('*') {
+			return nil, false
+		}
+		// Like ParseKey.
+		m := q.s.Mark()
+		if q.s.UtilMatchString('"') {
+			key := q.s.Token(m)
+			keys = append(keys, key[1:len(key)-1])
+		} else if q.MatchAnything() {
+			keys = append(keys, q.s.Token(m))
+		} else {
+			return nil, false
+		}
+		q.s.WS()
+	}
+	return keys, true
+}
+
+// GetBytes is like Get but takes the JSON as bytes, without a copy.
+// See JSONBytes.
+func GetBytes(jsn []byte, qry string) Json {
+	return JSONBytes(jsn).Query(qry)
+}
+
+// JSONBytes is like JSON but takes the JSON as bytes, without a copy.
+// The Json and the values taken from it share the memory of jsn,
+// so jsn must not be modified while they are in use.
+func JSONBytes(jsn []byte) Json {
+	return JSON(unsafe.String(unsafe.SliceData(jsn), len(jsn)))
+}
+
 func Valid(jsn string) bool {
 	return JSON(jsn).Valid()
 }
@@ -33,24 +243,586 @@ func Valid(jsn string) bool {
 
 // Query is the query language parser.
 type Query struct {
+	qry  string
+	base int // Offset of qry in the query text, when evaluating a part of it.
 	s    Scanner
 	Root Json
 	k, v Json
+	path []pathStep // Keys and indexes from Root to the context. See Fail.
 	save Json
 	savs map[string]Json
+	vars []variable
 	args []any
 	defs map[string]Scanner
+	err  error
+
+	ctx   context.Context
+	opts  Options
+	steps int
+	depth int
+}
+
+// Options configures a query run with QueryContext.
+// A zero limit means no limit.
+type Options struct {
+	Args      []any // Arguments for the (arg) function.
+	MaxSteps  int   // Maximum number of function calls and key lookups.
+	MaxOutput int   // Maximum size in bytes of a value returned by a function.
+	MaxDepth  int   // Maximum nesting of function calls, including (def) recursion.
+	MaxRegex  int   // Maximum number of instructions of a compiled regular expression.
+
+	Tracer func(TraceEvent) // Called after each function call.
+	Debug  io.Writer        // Output of (debug). Defaults to stdout.
+	Logger *slog.Logger     // Output of (debug) at debug level. Takes precedence over Debug.
+
+	// PprofLabels runs each function call with the pprof labels
+	// jsqt_func and jsqt_offset, so CPU profiles can be filtered
+	// by query function call site.
+	PprofLabels bool
+
+	Now func() time.Time // Clock of the (now) function. Defaults to time.Now.
+
+	// Index makes key and index lookups, (at), (slice), (size)
+	// and (keys) use the index of the document. See Json.Index.
+	Index *Index
+
+	// DupKeys is how objects with duplicate keys are handled.
+	// The document is resolved before the query runs, and so
+	// are the objects made by (raw), (arg), (objectify), (merge),
+	// (set), (upsert) and (pick), so every function sees the same
+	// keys. Keys are compared decoded. A policy other than DupKeep
+	// walks the whole document on each query, unless Index is an
+	// index of it, and walks each object those functions make,
+	// like the whole result of each (set). With DupError, the
+	// path of a key in such an object is relative to the object.
+	DupKeys DupPolicy
+}
+
+// DupPolicy is how objects with duplicate keys are handled.
+type DupPolicy int
+
+const (
+	DupKeep  DupPolicy = iota // Keeps the keys as they are. Lookups find the first one.
+	DupFirst                  // Keeps the first value of a key.
+	DupLast                   // Keeps the last value of a key, in the place of the first.
+	DupError                  // Aborts the query with a *DupKeyError.
+	DupMerge                  // Merges the values of a key into an array.
+)
+
+// TraceEvent describes a function call of a query.
+type TraceEvent struct {
+	Func     string        // Function name.
+	Offset   int           // Offset of the function in the query text.
+	Depth    int           // Nesting level of the function call, starting at 1.
+	Input    Json          // Context the function received.
+	Output   Json          // Value the function returned.
+	Duration time.Duration // Time spent in the function, including nested calls.
+}
+
+// Explain collects trace events and renders them as an
+// evaluation tree. Use its Trace method as Options.Tracer.
+type Explain struct {
+	nodes [][]explainNode // Pending nodes by depth.
+}
+
+type explainNode struct {
+	ev   TraceEvent
+	kids []explainNode
+}
+
+// Trace records a trace event.
+func (e *Explain) Trace(ev TraceEvent) {
+	for len(e.nodes) <= ev.Depth {
+		e.nodes = append(e.nodes, nil)
+	}
+	n := explainNode{ev: ev, kids: e.nodes[ev.Depth]}
+	e.nodes[ev.Depth] = nil
+	e.nodes[ev.Depth-1] = append(e.nodes[ev.Depth-1], n)
+}
+
+// String renders the evaluation tree, one function call per line:
+//
+//	(collect) 25µs [3,4] -> [6,8]
+//	    (expr) 3µs 3 -> 6
+func (e *Explain) String() string {
+	var o strings.Builder
+	var write func(n []explainNode, depth int)
+	write = func(n []explainNode, depth int) {
+		for _, n := range n {
+			for d := 0; d < depth; d++ {
+				o.WriteString("    ")
+			}
+			fmt.Fprintf(&o, "(%s) %s %s -> %s\n", n.ev.Func, n.ev.Duration, n.ev.Input, n.ev.Output)
+			write(n.kids, depth+1)
+		}
+	}
+	if len(e.nodes) > 0 {
+		write(e.nodes[0], 0)
+	}
+	return o.String()
+}
+
+// Profile aggregates trace events by function call site.
+// Use its Trace method as Options.Tracer.
+type Profile struct {
+	sites map[int]*ProfileSite
+}
+
+// ProfileSite holds the statistics of a function call site.
+type ProfileSite struct {
+	Func    string        // Function name.
+	Offset  int           // Offset of the function in the query text.
+	Calls   int           // Number of calls.
+	Time    time.Duration // Cumulative time, including nested calls.
+	Built   int           // Bytes of the outputs that are new values, not parts of the inputs.
+	Scanned int           // Bytes of the inputs.
+}
+
+// Trace records a trace event.
+func (p *Profile) Trace(ev TraceEvent) {
+	if p.sites == nil {
+		p.sites = make(map[int]*ProfileSite)
+	}
+	s := p.sites[ev.Offset]
+	if s == nil {
+		s = &ProfileSite{Func: ev.Func, Offset: ev.Offset}
+		p.sites[ev.Offset] = s
+	}
+	s.Calls++
+	s.Time += ev.Duration
+	s.Scanned += len(ev.Input.s)
+	if offsetOf(ev.Input.String(), ev.Output.String()) < 0 {
+		s.Built += len(ev.Output.s)
+	}
+}
+
+// Sites returns the call sites sorted by cumulative time,
+// slowest first.
+func (p *Profile) Sites() []ProfileSite {
+	sites := make([]ProfileSite, 0, len(p.sites))
+	for _, s := range p.sites {
+		sites = append(sites, *s)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].Time != sites[j].Time {
+			return sites[i].Time > sites[j].Time
+		}
+		return sites[i].Offset < sites[j].Offset
+	})
+	return sites
+}
+
+// String renders the call sites as a table sorted by cumulative time.
+func (p *Profile) String() string {
+	var o strings.Builder
+	w := tabwriter.NewWriter(&o, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tCALLS\tTIME\tBUILT\tSCANNED")
+	for _, s := range p.Sites() {
+		fmt.Fprintf(w, "(%s)@%d\t%d\t%s\t%d\t%d\n", s.Func, s.Offset, s.Calls, s.Time, s.Built, s.Scanned)
+	}
+	w.Flush()
+	return o.String()
+}
+
+// LimitError is the error returned by QueryContext
+// when a query exceeds one of the Options limits.
+type LimitError struct {
+	Limit string // One of "steps", "output", "depth" or "regex".
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("jsqt: %s limit of %d exceeded", e.Limit, e.Max)
+}
+
+// QueryError is the error raised by (assert) and (error).
+type QueryError struct {
+	Msg  string
+	Path string // Path of the context where the error was raised.
+}
+
+func (e *QueryError) Error() string {
+	if e.Path == "" {
+		return e.Msg
+	}
+	return e.Path + ": " + e.Msg
+}
+
+// DupKeyError is the error of the DupError policy.
+type DupKeyError struct {
+	Path string // Path of the duplicate key, like .a.b[0].c.
+	Func string // Function whose result has the key, if not the document. Path is relative to that result.
+}
+
+func (e *DupKeyError) Error() string {
+	if e.Func != "" {
+		return "jsqt: duplicate key " + e.Path + " in the result of (" + e.Func + ")"
+	}
+	return "jsqt: duplicate key " + e.Path
+}
+
+// writer is the output of functions that can write it as
+// they make it, to a strings.Builder or to a bufio.Writer.
+type writer interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// variable is a named value bound by (let) or (with).
+type variable struct {
+	name string
+	val  Json
 }
 
 func (q *Query) Parse(j Json) Json {
 	q.s.WS()
-	return funcGet(q, j)
+	if j = funcGet(q, j); q.err != nil {
+		return JSON("")
+	}
+	return j
+}
+
+// Err returns the error that aborted the query, if any.
+func (q *Query) Err() error {
+	return q.err
+}
+
+// Abort stops the query evaluation with an error.
+// Only the first error is kept.
+func (q *Query) Abort(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+	q.s = ""
+}
+
+// dedup resolves the duplicate keys of j, the result
+// of the function fname, with the DupKeys policy.
+func (q *Query) dedup(fname string, j Json) Json {
+	v, err := j.Dedup(q.opts.DupKeys)
+	if err != nil {
+		if e, ok := err.(*DupKeyError); ok {
+			e.Func = fname
+		}
+		q.Abort(err)
+		return JSON("")
+	}
+	return v
+}
+
+// getTo is funcGet for QueryTo. The last argument
+// writes its output to o as it makes it, if it can.
+func (q *Query) getTo(j Json, o *streamWriter) {
+	for q.MoreArg() {
+		if q.s.MatchByte('*') {
+			q.s.WS()
+			collectTo(q, j, o)
+			return
+		}
+		if q.s.EqualByte('(') && q.lastArg() && q.funTo(j, o) {
+			return
+		}
+		j = q.getArg(j)
+	}
+	if q.err == nil {
+		o.WriteString(j.String())
+	}
+}
+
+func (q *Query) lastArg() bool {
+	m := q.s.Mark()
+	q.SkipArg()
+	last := !q.MoreArg()
+	q.s.Back(m)
+	return last
+}
+
+// funTo is ParseFun for the functions that can write their
+// output to o as they make it. It reports false, and parses
+// nothing, for the other functions.
+func (q *Query) funTo(j Json, o *streamWriter) bool {
+	m := q.s.Mark()
+	q.s.MatchByte('(')
+	off := q.offset() - 1
+	fname := q.ParseRaw().String()
+	var f func()
+	switch fname {
+	case "get":
+		f = func() { q.getTo(j, o) }
+	case "collect":
+		f = func() { collectTo(q, j, o) }
+	case "obj":
+		f = func() { objTo(q, j, o) }
+	case "set":
+		if q.opts.DupKeys == DupKeep {
+			f = func() { setValueTo(q, j, q.Match("-i"), o, func() {}) }
+		}
+	case "pretty":
+		f = func() { j.prettifyTo(o) }
+	case "ugly":
+		f = func() { j.uglifyTo(o) }
+	}
+	if f == nil {
+		q.s.Back(m)
+		return false
+	}
+	q.call(fname, off, j, func() Json { f(); return JSON("") })
+	return true
+}
+
+// streamWriter is the output of QueryTo and QueryAppend.
+// It aborts the query on a write error or when the output
+// exceeds the output limit.
+type streamWriter struct {
+	flushWriter
+	q *Query
+	n int
+}
+
+// flushWriter is a writer that buffers its output,
+// like a bufio.Writer.
+type flushWriter interface {
+	writer
+	Flush() error
+}
+
+// appendWriter is a flushWriter that appends to a slice.
+type appendWriter struct {
+	b []byte
+}
+
+func (w *appendWriter) Write(b []byte) (int, error) {
+	w.b = append(w.b, b...)
+	return len(b), nil
+}
+
+func (w *appendWriter) WriteString(s string) (int, error) {
+	w.b = append(w.b, s...)
+	return len(s), nil
+}
+
+func (w *appendWriter) WriteByte(c byte) error {
+	w.b = append(w.b, c)
+	return nil
+}
+
+func (w *appendWriter) Flush() error {
+	return nil
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if !w.grow(len(b)) {
+		return 0, w.q.err
+	}
+	n, err := w.flushWriter.Write(b)
+	w.check(err)
+	return n, err
+}
+
+func (w *streamWriter) WriteString(s string) (int, error) {
+	if !w.grow(len(s)) {
+		return 0, w.q.err
+	}
+	n, err := w.flushWriter.WriteString(s)
+	w.check(err)
+	return n, err
+}
+
+func (w *streamWriter) WriteByte(c byte) error {
+	if !w.grow(1) {
+		return w.q.err
+	}
+	err := w.flushWriter.WriteByte(c)
+	w.check(err)
+	return err
+}
+
+func (w *streamWriter) grow(n int) bool {
+	w.n += n
+	if max := w.q.opts.MaxOutput; max > 0 && w.n > max {
+		w.q.Abort(&LimitError{Limit: "output", Max: max})
+	}
+	return w.q.err == nil
+}
+
+func (w *streamWriter) check(err error) {
+	if err != nil {
+		w.q.Abort(err)
+	}
+}
+
+// Eval evaluates a query text against j in the
+// same scope of q, so variables and limits apply.
+func (q *Query) Eval(qry string, j Json) Json {
+	off := q.offset() // Not in the query text; uses the current offset.
+	if i := offsetOf(q.qry, qry); i >= 0 {
+		off = q.base + i
+	}
+	return q.evalAt(qry, off, j)
+}
+
+// evalAt is Eval of a query text at the offset off of
+// the query text, so trace events report its functions
+// where they are.
+func (q *Query) evalAt(qry string, off int, j Json) Json {
+	m, text, base := q.s, q.qry, q.base
+	q.qry, q.base, q.s = qry, off, Scanner(qry)
+	q.s.WS()
+	j = funcGet(q, j)
+	q.qry, q.base = text, base
+	if q.err == nil {
+		q.s = m
+	}
+	return j
+}
+
+// offset returns the offset of the scanner in the query text.
+func (q *Query) offset() int {
+	return q.base + len(q.qry) - len(q.s)
+}
+
+// Step counts an evaluation step and checks the step limit
+// and the context cancellation. It returns false if the
+// query was aborted.
+func (q *Query) Step() bool {
+	if q.err != nil {
+		return false
+	}
+	if q.ctx != nil && q.steps&63 == 0 {
+		if err := q.ctx.Err(); err != nil {
+			q.Abort(err)
+			return false
+		}
+	}
+	q.steps++
+	if max := q.opts.MaxSteps; max > 0 && q.steps > max {
+		q.Abort(&LimitError{Limit: "steps", Max: max})
+		return false
+	}
+	return true
+}
+
+func (q *Query) enter() bool {
+	q.depth++
+	if max := q.opts.MaxDepth; max > 0 && q.depth > max {
+		q.depth--
+		q.Abort(&LimitError{Limit: "depth", Max: max})
+		return false
+	}
+	return true
+}
+
+// fits reports if a value of n bytes fits in the output limit.
+// Functions use it to abort before they make a large value.
+func (q *Query) fits(n int) bool {
+	if max := q.opts.MaxOutput; max > 0 && n > max {
+		q.Abort(&LimitError{Limit: "output", Max: max})
+		return false
+	}
+	return true
+}
+
+// Regex compiles a regular expression and checks it against
+// the regex limit. It returns nil if the pattern is invalid
+// or the query was aborted.
+func (q *Query) Regex(pattern string) *regexp.Regexp {
+	re, size := compileRegex(pattern, q.opts.MaxRegex)
+	if max := q.opts.MaxRegex; max > 0 && size > max {
+		q.Abort(&LimitError{Limit: "regex", Max: max})
+		return nil
+	}
+	return re
+}
+
+// regexCache holds compiled regular expressions
+// shared across queries.
+var regexCache struct {
+	sync.Mutex
+	m map[string]*regexEntry
+}
+
+// regexEntry is a cached regular expression.
+type regexEntry struct {
+	re   *regexp.Regexp // Nil until a query allows its size.
+	expr string         // Pattern it was made from, owned by the cache.
+	size int            // Number of instructions of its program; -1 if invalid.
+}
+
+// compileRegex compiles a regular expression using a cache and
+// returns it with the number of instructions of its program.
+// It is not compiled if it has more than max instructions (max > 0).
+// It returns nil and -1 if the pattern is invalid.
+func compileRegex(pattern string, max int) (*regexp.Regexp, int) {
+	regexCache.Lock()
+	defer regexCache.Unlock()
+	e := regexCache.m[pattern]
+	if e == nil {
+		if regexCache.m == nil || len(regexCache.m) >= 512 {
+			regexCache.m = make(map[string]*regexEntry, 64)
+		}
+		// The pattern may be part of a query or of a JSON from
+		// JSONBytes, whose memory the cache must not hold.
+		e = &regexEntry{expr: strings.Clone(pattern), size: -1}
+		if r, err := syntax.Parse(pattern, syntax.Perl); err == nil {
+			if prog, err := syntax.Compile(r.Simplify()); err == nil {
+				e.size = len(prog.Inst)
+			}
+		}
+		regexCache.m[e.expr] = e
+	}
+	if e.re == nil && e.size >= 0 && (max <= 0 || e.size <= max) {
+		if re, err := regexp.Compile(e.expr); err == nil {
+			e.re = re
+		} else {
+			e.size = -1
+		}
+	}
+	return e.re, e.size
+}
+
+// Fail aborts the query with a QueryError
+// raised at the context j.
+func (q *Query) Fail(j Json, msg string) {
+	q.Abort(&QueryError{Msg: msg, Path: q.pathOf(j)})
+}
+
+// pathOf returns the path of the context j, like .a.b[2], from the
+// keys and indexes the query descended into. It returns an empty
+// string when j is not a value of the document, like the output of
+// a function, or the query reached it in a way it doesn't record.
+func (q *Query) pathOf(j Json) string {
+	var o strings.Builder
+	parent := q.Root
+	for _, p := range q.path {
+		if p.made || parent.Get(p.key).s != p.v.s {
+			return ""
+		}
+		parent = p.v
+		if p.index {
+			o.WriteString("[" + p.key + "]")
+		} else if isIdent(p.key) {
+			o.WriteString("." + p.key)
+		} else {
+			o.WriteString(`["` + p.key + `"]`)
+		}
+	}
+	if parent.s != j.s {
+		return ""
+	}
+	if o.Len() == 0 {
+		return "."
+	}
+	return o.String()
 }
 
 func (q *Query) ParseFunOrKey(j Json) Json {
 	if q.s.EqualByte('(') {
 		return q.ParseFun(j)
 	}
+	if v, ok := q.ParseVar(); ok {
+		return v
+	}
 	return q.ParseKey(j)
 }
 
@@ -65,23 +837,101 @@ func (q *Query) ParseFunOrRaw(j Json) Json {
 	if q.s.EqualByte('(') {
 		return q.ParseFun(j)
 	}
+	if v, ok := q.ParseVar(); ok {
+		return v
+	}
 	return q.ParseRaw()
 }
 
+// ParseVar parses a $name variable reference.
+// It only matches names bound in the current scope,
+// so keys starting with $ keep working as keys.
+func (q *Query) ParseVar() (Json, bool) {
+	if len(q.vars) == 0 || !q.s.EqualByte('$') {
+		return Json{}, false
+	}
+	m := q.s.Mark()
+	q.s.Next()
+	ini := q.s.Mark()
+	q.s.MatchUntilLTEOr4(' ', ')', '}', ',', 0)
+	if v, ok := q.Var(q.s.Token(ini)); ok {
+		q.s.WS()
+		return v, true
+	}
+	q.s.Back(m)
+	return Json{}, false
+}
+
+// Var returns the value of the innermost variable with the given name.
+func (q *Query) Var(name string) (Json, bool) {
+	for i := len(q.vars) - 1; i >= 0; i-- {
+		if q.vars[i].name == name {
+			return q.vars[i].val, true
+		}
+	}
+	return Json{}, false
+}
+
 func (q *Query) ParseFun(j Json) Json {
-	if q.s.MatchByte('(') {
-		qk, qv := q.k, q.v
+	if q.err == nil && q.s.MatchByte('(') {
+		off := q.offset() - 1
 		fname := q.ParseRaw().String()
-		j = q.CallFun(fname, j)
-		q.SkipArgs()
-		q.s.MatchByte(')')
-		q.s.WS()
-		q.k, q.v = qk, qv
+		j = q.call(fname, off, j, func() Json { return q.CallFun(fname, j) })
+		if max := q.opts.MaxOutput; max > 0 && len(j.s) > max {
+			q.Abort(&LimitError{Limit: "output", Max: max})
+		}
 	}
 	return j
 }
 
+// call runs f, the function fname at the offset off, and parses
+// the rest of its arguments. It does the bookkeeping of function
+// calls: the step and depth limits, the pprof labels, the trace
+// and the restore of the (key) and (val) of the caller.
+func (q *Query) call(fname string, off int, in Json, f func() Json) Json {
+	if !q.Step() || !q.enter() {
+		return JSON("")
+	}
+	qk, qv, n := q.k, q.v, len(q.path)
+	var ini time.Time
+	if q.opts.Tracer != nil {
+		ini = time.Now()
+	}
+	var out Json
+	if q.opts.PprofLabels && q.ctx != nil {
+		labels := pprof.Labels("jsqt_func", fname, "jsqt_offset", strconv.Itoa(off))
+		pprof.Do(q.ctx, labels, func(ctx context.Context) {
+			// Nested calls add their labels to these and
+			// restore these when they return.
+			parent := q.ctx
+			q.ctx = ctx
+			out = f()
+			q.ctx = parent
+		})
+	} else {
+		out = f()
+	}
+	if q.opts.Tracer != nil {
+		q.opts.Tracer(TraceEvent{Func: fname, Offset: off, Depth: q.depth, Input: in, Output: out, Duration: time.Since(ini)})
+	}
+	q.depth--
+	q.SkipArgs()
+	q.s.MatchByte(')')
+	q.s.WS()
+	q.k, q.v, q.path = qk, qv, q.path[:n]
+	return out
+}
+
 func (q *Query) ParseKey(j Json) Json {
+	v, _ := q.parseKey(j)
+	return v
+}
+
+// parseKey is ParseKey that also returns the key.
+func (q *Query) parseKey(j Json) (Json, string) {
+	if !q.Step() {
+		return JSON(""), ""
+	}
 	key := ""
 	if m := q.s.Mark(); q.s.UtilMatchString('"') {
 		key = q.s.Token(m)
@@ -90,7 +940,7 @@ func (q *Query) ParseKey(j Json) Json {
 		key = q.s.Token(m)
 	}
 	q.s.WS()
-	return j.Get(key)
+	return q.opts.Index.Get(j, key), key
 }
 
 func (q *Query) ParseRaw() Json {
@@ -126,7 +976,7 @@ func (q *Query) IsEmpty() bool {
 }
 
 func (q Query) MoreArg() bool {
-	return !q.s.EqualByte(')') && !q.IsEmpty()
+	return !q.s.EqualByte(')') && !q.IsEmpty() && q.err == nil
 }
 
 func (q *Query) MatchAnything() bool {
@@ -134,185 +984,163 @@ func (q *Query) MatchAnything() bool {
 }
 
 func (q *Query) CallFun(fname string, j Json) Json {
-	switch fname {
-	case "get":
-		return funcGet(q, j)
-	case "set":
-		return funcSet(q, j)
-	case "obj":
-		return funcObj(q, j)
-	case "arr":
-		return funcArr(q, j)
-	case "raw":
-		return q.ParseRaw()
-	case "collect":
-		return funcCollect(q, j)
-	case "unique":
-		return funcUnique(q, j)
-	case "first":
-		return funcFirst(q, j)
-	case "last":
-		return funcLast(q, j)
-	case "flatten":
-		return funcFlatten(q, j)
-	case "slice":
-		return funcSlice(q, j)
-	case "reduce":
-		return funcReduce(q, j)
-	case "chunk":
-		return funcChunk(q, j)
-	case "partition":
-		return funcPartition(q, j)
-	case "min":
-		return funcMin(q, j)
-	case "max":
-		return funcMax(q, j)
-	case "at":
-		return funcAt(q, j)
-	case "group":
-		return funcGroup(q, j)
-	case "upsert":
-		return funcUpsert(q, j)
-	case "size":
-		return j.Size()
-	case "default":
-		return funcDefault(q, j)
-	case "merge":
-		return j.Merge()
-	case "iterate":
-		return funcIterate(q, j)
-	case "is-num":
-		return funcIsNum(q, j)
-	case "is-obj":
-		return funcIsObj(q, j)
-	case "is-arr":
-		return funcIsArr(q, j)
-	case "is-str":
-		return funcIsStr(q, j)
-	case "is-bool":
-		return funcIsBool(q, j)
-	case "is-null":
-		return funcIsNull(q, j)
-	case "is-empty":
-		return funcIsEmpty(q, j)
-	case "is-empty-arr":
-		return funcIsEmptyArr(q, j)
-	case "is-empty-obj":
-		return funcIsEmptyObj(q, j)
-	case "is-empty-str":
-		return funcIsEmptyStr(q, j)
-	case "is-some":
-		return funcIsSome(q, j)
-	case "is-void":
-		return funcIsVoid(q, j)
-	case "is-blank":
-		return funcIsBlank(q, j)
-	case "is-nully":
-		return funcIsNully(q, j)
-	case "truthy":
-		return funcIsTruthy(q, j)
-	case "falsy":
-		return funcIsFalsy(q, j)
-	case "exists":
-		return funcExists(q, j)
-	case "if":
-		return funcIf(q, j)
-	case "either":
-		return funcEither(q, j)
-	case "root":
-		return q.Root
-	case "this":
-		return j
-	case "in":
-		return funcIN(q, j)
-	case "==":
-		return funcEQ(q, j)
-	case "!=":
-		return funcNEQ(q, j)
-	case ">=":
-		return funcGTE(q, j)
-	case "<=":
-		return funcLTE(q, j)
-	case ">":
-		return funcGT(q, j)
-	case "<":
-		return funcLT(q, j)
-	case "or":
-		return funcOr(q, j)
-	case "and":
-		return funcAnd(q, j)
-	case "not":
-		return funcNot(q, j)
-	case "bool":
-		return funcBool(q, j)
-	case "debug":
-		return funcDebug(q, j)
-	case "keys":
-		return j.Keys()
-	case "values":
-		return j.Values()
-	case "entries":
-		return j.Entries()
-	case "objectify":
-		return j.Objectify()
-	case "ugly":
-		return j.Uglify()
-	case "pretty":
-		return j.Prettify()
-	case "jsonify":
-		return j.Jsonify()
-	case "stringify":
-		return j.Stringify()
-	case "upper":
-		return JSON(strings.ToUpper(j.String()))
-	case "lower":
-		return JSON(strings.ToLower(j.String()))
-	case "replace":
-		return funcReplace(q, j)
-	case "join":
-		return funcJoin(q, j)
-	case "split":
-		return funcSplit(q, j)
-	case "concat":
-		return funcConcat(q, j)
-	case "sort":
-		return funcSort(q, j)
-	case "reverse":
-		return funcReverse(q, j)
-	case "pick":
-		return funcPick(q, j)
-	case "pluck":
-		return funcPluck(q, j)
-	case "def":
-		return funcDef(q, j)
-	case "save":
-		return funcSave(q, j)
-	case "load":
-		return funcLoad(q, j)
-	case "key":
-		return q.k
-	case "val":
-		return q.v
-	case "arg":
-		return funcArg(q, j)
-	case "match":
-		return funcMatch(q, j)
-	case "expr":
-		return funcExpr(q, j)
-	case "unwind":
-		return funcUnwind(q, j)
-	case "transpose":
-		return funcTranspose(q, j)
-	case "valid":
-		return funcValid(q, j)
-	default:
-		if defFunMark, ok := q.defs[fname]; ok {
-			return callDefFun(q, j, defFunMark)
-		}
+	if f, ok := funcs[fname]; ok {
+		return f(q, j)
+	}
+	if defFunMark, ok := q.defs[fname]; ok {
+		return callDefFun(q, j, defFunMark)
 	}
 	return JSON("")
 }
 
+// funcs are the functions of CallFun by name.
+var funcs map[string]func(*Query, Json) Json
+
+func init() {
+	// Set here since the functions call CallFun.
+	funcs = map[string]func(*Query, Json) Json{
+		"get":            funcGet,
+		"set":            funcSet,
+		"obj":            funcObj,
+		"arr":            funcArr,
+		"raw":            func(q *Query, j Json) Json { return q.dedup("raw", q.ParseRaw()) },
+		"collect":        funcCollect,
+		"unique":         funcUnique,
+		"first":          funcFirst,
+		"last":           funcLast,
+		"flatten":        funcFlatten,
+		"slice":          funcSlice,
+		"reduce":         funcReduce,
+		"chunk":          funcChunk,
+		"partition":      funcPartition,
+		"min":            funcMin,
+		"max":            funcMax,
+		"at":             funcAt,
+		"group":          funcGroup,
+		"upsert":         funcUpsert,
+		"size":           func(q *Query, j Json) Json { return q.opts.Index.Size(j) },
+		"default":        funcDefault,
+		"merge":          funcMerge,
+		"iterate":        funcIterate,
+		"type":           funcType,
+		"to-num":         funcToNum,
+		"to-int":         funcToInt,
+		"to-str":         funcToStr,
+		"to-bool":        funcToBool,
+		"to-arr":         funcToArr,
+		"is-num":         funcIsNum,
+		"is-obj":         funcIsObj,
+		"is-arr":         funcIsArr,
+		"is-str":         funcIsStr,
+		"is-bool":        funcIsBool,
+		"is-null":        funcIsNull,
+		"is-empty":       funcIsEmpty,
+		"is-empty-arr":   funcIsEmptyArr,
+		"is-empty-obj":   funcIsEmptyObj,
+		"is-empty-str":   funcIsEmptyStr,
+		"is-some":        funcIsSome,
+		"is-void":        funcIsVoid,
+		"is-blank":       funcIsBlank,
+		"is-nully":       funcIsNully,
+		"truthy":         funcIsTruthy,
+		"falsy":          funcIsFalsy,
+		"exists":         funcExists,
+		"if":             funcIf,
+		"either":         funcEither,
+		"root":           func(q *Query, j Json) Json { return q.Root },
+		"this":           func(q *Query, j Json) Json { return j },
+		"in":             funcIN,
+		"==":             funcEQ,
+		"!=":             funcNEQ,
+		">=":             funcGTE,
+		"<=":             funcLTE,
+		">":              funcGT,
+		"<":              funcLT,
+		"or":             funcOr,
+		"and":            funcAnd,
+		"not":            funcNot,
+		"bool":           funcBool,
+		"debug":          funcDebug,
+		"keys":           func(q *Query, j Json) Json { return q.opts.Index.Keys(j) },
+		"values":         func(q *Query, j Json) Json { return j.Values() },
+		"entries":        func(q *Query, j Json) Json { return j.Entries() },
+		"objectify":      func(q *Query, j Json) Json { return q.dedup("objectify", j.Objectify()) },
+		"ugly":           func(q *Query, j Json) Json { return j.Uglify() },
+		"pretty":         func(q *Query, j Json) Json { return j.Prettify() },
+		"jsonify":        func(q *Query, j Json) Json { return j.Jsonify() },
+		"stringify":      func(q *Query, j Json) Json { return j.Stringify() },
+		"upper":          funcUpper,
+		"lower":          funcLower,
+		"trim":           funcTrim,
+		"trim-left":      funcTrimLeft,
+		"trim-right":     funcTrimRight,
+		"pad-left":       funcPadLeft,
+		"pad-right":      funcPadRight,
+		"substr":         funcSubstr,
+		"index-of":       funcIndexOf,
+		"starts-with":    funcStartsWith,
+		"ends-with":      funcEndsWith,
+		"contains":       funcContains,
+		"repeat":         funcRepeat,
+		"title":          funcTitle,
+		"case":           funcCase,
+		"truncate":       funcTruncate,
+		"len":            funcLen,
+		"replace":        funcReplace,
+		"capture":        funcCapture,
+		"scan":           funcScan,
+		"join":           funcJoin,
+		"split":          funcSplit,
+		"concat":         funcConcat,
+		"fmt":            funcFmt,
+		"base64-encode":  funcBase64Encode,
+		"base64-decode":  funcBase64Decode,
+		"hex":            funcHex,
+		"url-encode":     funcURLEncode,
+		"url-decode":     funcURLDecode,
+		"html-escape":    funcHTMLEscape,
+		"sha256":         func(q *Query, j Json) Json { return funcHash(q, j, sha256.New()) },
+		"sha1":           func(q *Query, j Json) Json { return funcHash(q, j, sha1.New()) },
+		"md5":            func(q *Query, j Json) Json { return funcHash(q, j, md5.New()) },
+		"crc32":          func(q *Query, j Json) Json { return funcHash(q, j, crc32.NewIEEE()) },
+		"uuid-v5":        funcUUIDv5,
+		"to-csv":         funcToCSV,
+		"strict":         funcStrict,
+		"sort":           funcSort,
+		"reverse":        funcReverse,
+		"pick":           funcPick,
+		"pluck":          funcPluck,
+		"def":            funcDef,
+		"let":            funcLet,
+		"with":           funcWith,
+		"save":           funcSave,
+		"load":           funcLoad,
+		"key":            func(q *Query, j Json) Json { return q.k },
+		"val":            func(q *Query, j Json) Json { return q.v },
+		"arg":            funcArg,
+		"match":          funcMatch,
+		"expr":           funcExpr,
+		"has-bit":        funcHasBit,
+		"set-bit":        funcSetBit,
+		"unwind":         funcUnwind,
+		"transpose":      funcTranspose,
+		"dup-keys":       funcDupKeys,
+		"valid":          funcValid,
+		"now":            funcNow,
+		"date-parse":     funcDateParse,
+		"date-format":    funcDateFormat,
+		"date-add":       funcDateAdd,
+		"date-diff":      funcDateDiff,
+		"date-trunc":     funcDateTrunc,
+		"date-tz":        funcDateTZ,
+		"date-unix":      funcDateUnix,
+		"date-from-unix": funcDateFromUnix,
+		"assert":         funcAssert,
+		"error":          funcError,
+		"try":            funcTry,
+	}
+}
+
 func callDefFun(q *Query, j Json, defFunMark Scanner) Json {
 	m := q.s.Mark()
 	q.s.Back(defFunMark)
@@ -335,122 +1163,180 @@ func funcDef(q *Query, j Json) Json {
 }
 
 func funcGet(q *Query, j Json) Json {
+	n := len(q.path)
 	for q.MoreArg() {
 		if q.s.MatchByte('*') {
 			q.s.WS()
 			j = funcCollect(q, j)
 		} else {
-			j = q.ParseFunOrKey(j)
+			j = q.getArg(j)
 		}
 	}
+	q.path = q.path[:n]
 	return j
 }
 
+// getArg parses an argument of (get) and
+// records the key or index it descends into.
+func (q *Query) getArg(j Json) Json {
+	if q.s.EqualByte('(') || q.s.EqualByte('$') {
+		v := q.ParseFunOrKey(j)
+		if v.s != j.s {
+			q.path = append(q.path, pathStep{made: true})
+		}
+		return v
+	}
+	v, key := q.parseKey(j)
+	q.path = append(q.path, pathStep{key: key, index: j.IsArray(), v: v})
+	return v
+}
+
+// pathStep is a key or index of a value
+// the query descended into to reach v.
+type pathStep struct {
+	key   string // Without quotes.
+	index bool
+	made  bool // The value was made by a function.
+	v     Json
+}
+
+// item sets the key or index k and the value v of an iteration
+// over the context, whose path has n steps.
+func (q *Query) item(n int, k, v Json) {
+	q.k, q.v = k, v
+	q.path = append(q.path[:n], pathStep{key: k.TrimQuote(), index: !k.IsString(), v: v})
+}
+
 func funcSet(q *Query, j Json) Json {
 	insert := q.Match("-i")
-	return funcSetInternal(q, j, insert)
+	return q.dedup("set", funcSetInternal(q, j, insert))
 }
 
 func funcSetInternal(q *Query, j Json, insert bool) Json {
+	j, keyOrIndex, more := setArgs(q, j)
+	if !more {
+		return keyOrIndex // The last item is the value.
+	}
+	if !j.IsObject() && !j.IsArray() {
+		return j
+	}
+	var o strings.Builder
+	o.Grow(len(j.s) + 32)
+	setTo(q, j, keyOrIndex, insert, &o)
+	return JSON(o.String())
+}
+
+// setArgs parses the -m flag and the key or index of (set)
+// and reports if there are more arguments; otherwise the
+// key is the value.
+func setArgs(q *Query, j Json) (Json, Json, bool) {
 	if q.Match("-m") {
 		j = q.ParseFun(j)
 	}
 	keyOrIndex := q.ParseFunOrRaw(j)
-	if !q.MoreArg() {
-		return keyOrIndex // The last item is the value.
+	return j, keyOrIndex, q.MoreArg()
+}
+
+// setValueTo writes the value of a key or index that (set)
+// matched, after calling comma, unless the value is empty.
+func setValueTo(q *Query, j Json, insert bool, o writer, comma func()) {
+	j, keyOrIndex, more := setArgs(q, j)
+	if !more {
+		if keyOrIndex.Exists() {
+			comma()
+			o.WriteString(keyOrIndex.String())
+		}
+		return
+	}
+	comma()
+	if j.IsObject() || j.IsArray() {
+		setTo(q, j, keyOrIndex, insert, o)
+	} else {
+		o.WriteString(j.String())
+	}
+}
+
+// setTo writes the object or array j with the key or index set.
+func setTo(q *Query, j, keyOrIndex Json, insert bool, o writer) {
+	n := 0
+	comma := func() {
+		if n++; n > 1 {
+			o.WriteString(",")
+		}
 	}
 	if j.IsObject() {
-		var o strings.Builder
-		o.Grow(len(j.s) + 32)
-		o.WriteString("{")
-		found := false
 		keyOrIdx := keyOrIndex.TrimQuote()
+		found := false
+		if insert && keyOrIndex.IsNumber() && !j.GetKey(keyOrIdx).Exists() {
+			// An index inserted in an object makes it an array.
+			if v := funcSetInternal(q, JSON("{}"), insert); v.Exists() {
+				o.WriteString("[")
+				o.WriteString(v.String())
+				o.WriteString("]")
+				return
+			}
+			found = true
+		}
+		o.WriteString("{")
+		at := len(q.path)
 		j.ForEachKeyVal(func(k, v Json) bool {
-			q.k, q.v = k, v
+			q.item(at, k, v)
 			if k.TrimQuote() == keyOrIdx {
 				found = true
 				if q.Match("-r") {
 					k = q.ParseRaw()
 				}
-				if v = funcSetInternal(q, v, insert); v.Exists() {
-					if o.Len() > 1 {
-						o.WriteString(",")
-					}
+				setValueTo(q, v, insert, o, func() {
+					comma()
 					o.WriteString(`"`)
 					o.WriteString(k.TrimQuote())
 					o.WriteString(`":`)
-					o.WriteString(v.String())
-				}
+				})
 			} else {
-				if o.Len() > 1 {
-					o.WriteString(",")
-				}
-				o.WriteString(k.String())
-				o.WriteString(":")
-				o.WriteString(v.String())
-			}
-			return false
-		})
-		if !found && insert {
-			if v := funcSetInternal(q, JSON("{}"), insert); v.Exists() {
-				if o.Len() > 1 {
-					o.WriteString(",")
-				}
-				if keyOrIndex.IsNumber() {
-					o.Reset()
-					o.WriteString(`[`)
-					o.WriteString(v.String())
-					o.WriteString(`]`)
-					return JSON(o.String())
-				} else {
-					o.WriteString(`"`)
-					o.WriteString(keyOrIndex.TrimQuote())
-					o.WriteString(`":`)
-					o.WriteString(v.String())
-				}
-			}
-		}
-		o.WriteString("}")
-		return JSON(o.String())
-	}
-	if j.IsArray() {
-		var o strings.Builder
-		o.Grow(len(j.s) + 32)
-		o.WriteString("[")
-		found := false
-		j.ForEach(func(i, v Json) bool {
-			q.k, q.v = i, v
-			if q.MoreArg() {
-				if i.String() == keyOrIndex.String() {
-					found = true
-					v = funcSetInternal(q, v, insert)
-				} else if keyOrIndex.s.EqualByte('*') {
-					found = true
-					m := q.s.Mark()
-					v = funcSetInternal(q, v, insert)
-					q.s.Back(m)
-				}
-			}
-			if v.Exists() {
-				if o.Len() > 1 {
-					o.WriteString(",")
-				}
+				comma()
+				o.WriteString(k.String())
+				o.WriteString(":")
 				o.WriteString(v.String())
 			}
 			return false
 		})
 		if !found && insert {
-			if v := funcSetInternal(q, JSON("{}"), insert); v.Exists() {
-				if o.Len() > 1 {
-					o.WriteString(",")
-				}
-				o.WriteString(v.String())
+			setValueTo(q, JSON("{}"), insert, o, func() {
+				comma()
+				o.WriteString(`"`)
+				o.WriteString(keyOrIdx)
+				o.WriteString(`":`)
+			})
+		}
+		o.WriteString("}")
+		return
+	}
+	o.WriteString("[")
+	found := false
+	at := len(q.path)
+	j.ForEach(func(i, v Json) bool {
+		q.item(at, i, v)
+		if q.MoreArg() {
+			if i.String() == keyOrIndex.String() {
+				found = true
+				setValueTo(q, v, insert, o, comma)
+				return false
+			} else if keyOrIndex.s.EqualByte('*') {
+				found = true
+				m := q.s.Mark()
+				setValueTo(q, v, insert, o, comma)
+				q.s.Back(m)
+				return false
 			}
 		}
-		o.WriteString("]")
-		return JSON(o.String())
+		comma()
+		o.WriteString(v.String())
+		return false
+	})
+	if !found && insert {
+		setValueTo(q, JSON("{}"), insert, o, comma)
 	}
-	return j
+	o.WriteString("]")
 }
 
 func funcArr(q *Query, j Json) Json {
@@ -491,11 +1377,17 @@ func funcArrTest(q *Query, j Json) Json {
 func funcObj(q *Query, j Json) Json {
 	var o strings.Builder
 	o.Grow(len(j.s) + 64)
+	objTo(q, j, &o)
+	return JSON(o.String())
+}
+
+func objTo(q *Query, j Json, o writer) {
 	o.WriteString("{")
+	n := 0
 	writeKeyVals := func(j Json) {
 		for q.MoreArg() {
 			if k, v := q.ParseFunOrRaw(j), q.ParseFunOrKey(j); k.Exists() && v.Exists() {
-				if o.Len() > 1 {
+				if n++; n > 1 {
 					o.WriteString(",")
 				}
 				o.WriteByte('"')
@@ -506,15 +1398,15 @@ func funcObj(q *Query, j Json) Json {
 		}
 	}
 	if q.Match("-i") {
-		m := q.s.Mark()
+		m, n := q.s.Mark(), len(q.path)
 		j.ForEach(func(i, v Json) bool {
-			q.k, q.v = i, v
+			q.item(n, i, v)
 			q.s.Back(m)
 			writeKeyVals(v)
 			return false
 		})
 		j.ForEachKeyVal(func(k, v Json) bool {
-			q.k, q.v = k, v
+			q.item(n, k, v)
 			q.s.Back(m)
 			writeKeyVals(v)
 			return false
@@ -523,19 +1415,24 @@ func funcObj(q *Query, j Json) Json {
 		writeKeyVals(j)
 	}
 	o.WriteString("}")
-	return JSON(o.String())
 }
 
 func funcCollect(q *Query, j Json) Json {
 	var o strings.Builder
 	o.Grow(len(j.s))
+	collectTo(q, j, &o)
+	return JSON(o.String())
+}
+
+func collectTo(q *Query, j Json, o writer) {
 	o.WriteString("[")
-	ini := q.s.Mark()
+	ini, at := q.s.Mark(), len(q.path)
+	n := 0
 	f := func(k, item Json) bool {
-		q.k, q.v = k, item
+		q.item(at, k, item)
 		q.s.Back(ini)
 		if item = funcGet(q, item); item.Exists() {
-			if o.Len() > 1 {
+			if n++; n > 1 {
 				o.WriteString(",")
 			}
 			o.WriteString(item.String())
@@ -546,7 +1443,6 @@ func funcCollect(q *Query, j Json) Json {
 	j.ForEach(f)
 	o.WriteString("]")
 	q.SkipArgs()
-	return JSON(o.String())
 }
 
 func funcUnique(q *Query, j Json) Json {
@@ -554,9 +1450,9 @@ func funcUnique(q *Query, j Json) Json {
 	var o strings.Builder
 	o.Grow(len(j.s))
 	o.WriteString("[")
-	ini := q.s.Mark()
+	ini, n := q.s.Mark(), len(q.path)
 	j.ForEach(func(i, item Json) bool {
-		q.k, q.v = i, item
+		q.item(n, i, item)
 		q.s.Back(ini)
 		if item = funcGet(q, item); item.Exists() && !uniq[item] {
 			uniq[item] = true
@@ -573,9 +1469,9 @@ func funcUnique(q *Query, j Json) Json {
 
 func funcFirst(q *Query, j Json) Json {
 	var first Json
-	ini := q.s.Mark()
+	ini, n := q.s.Mark(), len(q.path)
 	j.ForEach(func(i, item Json) bool {
-		q.k, q.v = i, item
+		q.item(n, i, item)
 		q.s.Back(ini)
 		first = funcGet(q, item)
 		return first.Exists()
@@ -585,9 +1481,9 @@ func funcFirst(q *Query, j Json) Json {
 
 func funcLast(q *Query, j Json) Json {
 	var last Json
-	ini := q.s.Mark()
+	ini, n := q.s.Mark(), len(q.path)
 	j.ForEach(func(i, item Json) bool {
-		q.k, q.v = i, item
+		q.item(n, i, item)
 		q.s.Back(ini)
 		if item = funcGet(q, item); item.Exists() {
 			last = item
@@ -657,6 +1553,9 @@ func funcSlice(q *Query, j Json) Json {
 	if j.IsArray() {
 		ini := q.ParseFunOrRaw(j).Int()
 		end := q.ParseFunOrRaw(j).Int()
+		if n := q.opts.Index.node(j); n != nil {
+			return n.slice(ini, end)
+		}
 		if ini < 0 || end < 0 {
 			size := j.Size().Int()
 			if ini < 0 {
@@ -689,6 +1588,12 @@ func funcSlice(q *Query, j Json) Json {
 func funcAt(q *Query, j Json) Json {
 	if j.IsArray() {
 		at := q.ParseFunOrRaw(j)
+		if q.opts.Index != nil {
+			if v := q.opts.Index.Get(j, at.String()); v.Exists() {
+				return v
+			}
+			return j
+		}
 		j.ForEach(func(i, v Json) bool {
 			if i == at {
 				j = v
@@ -751,9 +1656,9 @@ func funcPartition(q *Query, j Json) Json {
 	var o strings.Builder
 	o.Grow(len(j.s) + 5)
 	o.WriteString("[[")
-	m := q.s.Mark()
+	m, n := q.s.Mark(), len(q.path)
 	j.ForEach(func(i, v Json) bool {
-		q.k, q.v = i, v
+		q.item(n, i, v)
 		q.s.Back(m)
 		if q.ParseFunOrKey(v).Exists() {
 			if o.Len() > 2 {
@@ -778,9 +1683,9 @@ func funcPartition(q *Query, j Json) Json {
 
 func funcMin(q *Query, j Json) Json {
 	var min Json
-	ini := q.s.Mark()
+	ini, n := q.s.Mark(), len(q.path)
 	j.ForEach(func(i, item Json) bool {
-		q.k, q.v = i, item
+		q.item(n, i, item)
 		q.s.Back(ini)
 		if item = funcGet(q, item); item.Exists() {
 			if i.String() == "0" || item.LT(min) {
@@ -794,9 +1699,9 @@ func funcMin(q *Query, j Json) Json {
 
 func funcMax(q *Query, j Json) Json {
 	var max Json
-	ini := q.s.Mark()
+	ini, n := q.s.Mark(), len(q.path)
 	j.ForEach(func(i, item Json) bool {
-		q.k, q.v = i, item
+		q.item(n, i, item)
 		q.s.Back(ini)
 		if item = funcGet(q, item); item.Exists() {
 			if i.String() == "0" || item.GT(max) {
@@ -811,9 +1716,9 @@ func funcMax(q *Query, j Json) Json {
 func funcGroup(q *Query, j Json) Json {
 	group := make(map[Json][]Json, 16)
 	groupOrder := make([]Json, 0, len(group))
-	m := q.s.Mark()
+	m, n := q.s.Mark(), len(q.path)
 	j.ForEach(func(i, item Json) bool {
-		q.k, q.v = i, item
+		q.item(n, i, item)
 		q.s.Back(m)
 		if g, v := q.ParseFunOrKey(item), q.ParseFunOrKey(item); g.Exists() && v.Exists() {
 			if _, ok := group[g]; !ok {
@@ -878,41 +1783,70 @@ func funcGroup(q *Query, j Json) Json {
 	return JSON(o.String())
 }
 
+func funcMerge(q *Query, j Json) Json {
+	if q.opts.DupKeys == DupKeep || q.opts.DupKeys == DupFirst {
+		return j.Merge()
+	}
+	// Joins the objects so the policy resolves the keys.
+	var o strings.Builder
+	o.Grow(len(j.s))
+	o.WriteString("{")
+	j.ForEach(func(i, v Json) bool {
+		v.ForEachKeyVal(func(k, v Json) bool {
+			if o.Len() > 1 {
+				o.WriteString(",")
+			}
+			o.WriteString(k.String())
+			o.WriteString(":")
+			o.WriteString(v.String())
+			return false
+		})
+		return false
+	})
+	o.WriteString("}")
+	return q.dedup("merge", JSON(o.String()))
+}
+
 func funcUpsert(q *Query, j Json) Json {
 	if j.IsObject() {
-		done := make(map[string]bool)
+		// A later pair of the same key replaces the value of the earlier one.
+		var keys []string
+		vals := make(map[string]Json)
+		for q.MoreArg() {
+			if k, v := q.ParseFunOrRaw(j), q.ParseFunOrRaw(j); k.Exists() {
+				key := dupKey(k)
+				if _, ok := vals[key]; !ok {
+					keys = append(keys, key)
+				}
+				vals[key] = v
+			}
+		}
 		var o strings.Builder
 		o.Grow(len(j.s))
 		o.WriteString("{")
-		for q.MoreArg() {
-			if k, v := q.ParseFunOrRaw(j), q.ParseFunOrRaw(j); k.Exists() {
-				key := k.TrimQuote()
-				if v.Exists() {
-					if o.Len() > 1 {
-						o.WriteString(",")
-					}
-					o.WriteByte('"')
-					o.WriteString(key)
-					o.WriteString(`":`)
-					o.WriteString(v.String())
+		for _, key := range keys {
+			if v := vals[key]; v.Exists() {
+				if o.Len() > 1 {
+					o.WriteString(",")
 				}
-				done[key] = true
+				o.WriteString(quoteJSON(key))
+				o.WriteString(":")
+				o.WriteString(v.String())
 			}
 		}
 		j.ForEachKeyVal(func(k, v Json) bool {
-			if key := k.TrimQuote(); !done[key] {
+			if _, ok := vals[dupKey(k)]; !ok {
 				if o.Len() > 1 {
 					o.WriteString(",")
 				}
-				o.WriteByte('"')
-				o.WriteString(key)
-				o.WriteString(`":`)
+				o.WriteString(k.String())
+				o.WriteString(":")
 				o.WriteString(v.String())
 			}
 			return false
 		})
 		o.WriteString("}")
-		return JSON(o.String())
+		return q.dedup("upsert", JSON(o.String()))
 	}
 	return j
 }
@@ -1053,13 +1987,19 @@ func funcEither(q *Query, j Json) Json {
 }
 
 func funcArg(q *Query, j Json) Json {
-	arg := q.ParseFunOrRaw(j)
-	val := q.args[arg.Int()]
+	arg := q.ParseFunOrRaw(j).Int()
+	if arg < 0 || arg >= len(q.args) {
+		return JSON("")
+	}
+	val := q.args[arg]
 	if f, ok := val.(func(Json) Json); ok {
 		return f(j)
 	}
+	if raw, ok := val.(json.RawMessage); ok {
+		return q.dedup("arg", JSONBytes(raw))
+	}
 	jsn, _ := json.Marshal(val) // I think this is cheating.
-	return JSON(string(jsn))
+	return JSONBytes(jsn)
 }
 
 func funcMatch(q *Query, j Json) Json {
@@ -1072,7 +2012,10 @@ func funcMatch(q *Query, j Json) Json {
 			return j.GetSuffixKey(q.ParseFunOrRaw(j).TrimQuote())
 		}
 		if q.Match("-r") {
-			return j.GetRegexKey(q.ParseFunOrRaw(j).TrimQuote())
+			if re := q.Regex(q.ParseFunOrRaw(j).TrimQuote()); re != nil {
+				return j.getRegexKey(re)
+			}
+			return JSON("")
 		}
 		return j.GetKey(q.ParseFunOrRaw(j).TrimQuote())
 	}
@@ -1085,7 +2028,10 @@ func funcMatch(q *Query, j Json) Json {
 			return j.GetSuffix(q.ParseFunOrRaw(j).TrimQuote())
 		}
 		if q.Match("-r") {
-			return j.GetRegex(q.ParseFunOrRaw(j).TrimQuote())
+			if re := q.Regex(q.ParseFunOrRaw(j).TrimQuote()); re != nil {
+				return j.getRegex(re)
+			}
+			return JSON("")
 		}
 		return j.Get(q.ParseFunOrRaw(j).TrimQuote())
 	}
@@ -1108,57 +2054,745 @@ func funcMatch(q *Query, j Json) Json {
 			return j
 		}
 	case q.Match("-r"):
-		regex := q.ParseFunOrRaw(j).TrimQuote()
-		if ok, _ := regexp.MatchString(regex, v); ok {
+		if re := q.Regex(q.ParseFunOrRaw(j).TrimQuote()); re != nil && re.MatchString(v) {
+			return j
+		}
+	default:
+		exact := q.ParseFunOrRaw(j).TrimQuote()
+		if exact == v {
 			return j
 		}
-	default:
-		exact := q.ParseFunOrRaw(j).TrimQuote()
-		if exact == v {
-			return j
+	}
+	return JSON("")
+}
+
+func funcExpr(q *Query, j Json) Json {
+	p := exprParser{q: q, j: j, mode: 'f'}
+	scale, round := -1, "half-up"
+	if q.Match("-i") {
+		p.mode = 'i'
+	} else if q.Match("-d") {
+		p.mode = 'd'
+		if q.Match("-s") {
+			scale = q.ParseFunOrRaw(j).Int()
+		}
+		if q.Match("-r") {
+			round = q.ParseFunOrRaw(j).Str()
+		}
+	}
+	v := p.int(p.parseTernary())
+	if p.fail {
+		return JSON("")
+	}
+	if v.n != nil && p.mode == 'd' {
+		if scale < 0 {
+			scale = decimalScale(v.n)
+		}
+		return JSON(formatDecimal(v.n, scale, round))
+	}
+	return p.json(v)
+}
+
+// exprParser parses and evaluates the (expr) arguments.
+// Every level of precedence has its own parse method,
+// from the lowest (ternary) to the highest (primary).
+type exprParser struct {
+	q    *Query
+	j    Json
+	mode byte // f = float64, d = decimal, i = int64.
+	fail bool
+	skip bool // Parses without evaluating, for the operands that are not used.
+}
+
+// exprVal is an (expr) value. Numbers are kept as big.Rat so
+// that only the mode rounds them, and j holds any other value.
+type exprVal struct {
+	n *big.Rat
+	j Json
+}
+
+// exprOps are the operators, longer ones first.
+var exprOps = []string{"**", "//", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "+", "-", "*", "/", "%", "<", ">", "&", "|", "^", "?", ":"}
+
+// peekExprOp returns the operator at the start of s.
+func peekExprOp(s Scanner) string {
+	for _, op := range exprOps {
+		if s.Equal(op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// matchOp matches one of the operators in ops.
+func (p *exprParser) matchOp(ops ...string) string {
+	if op := peekExprOp(p.q.s); op != "" && slices.Contains(ops, op) {
+		p.q.s.Advance(len(op))
+		p.q.s.WS()
+		return op
+	}
+	return ""
+}
+
+func (p *exprParser) parseTernary() exprVal {
+	c := p.parseOr()
+	if p.matchOp("?") == "" {
+		return c
+	}
+	cond := p.truthy(c)
+	a := p.operand(cond, p.parseTernary)
+	b := exprVal{j: JSON("")}
+	if p.matchOp(":") != "" {
+		b = p.operand(!cond, p.parseTernary)
+	}
+	if cond {
+		return a
+	}
+	return b
+}
+
+func (p *exprParser) parseOr() exprVal {
+	v := p.parseAnd()
+	for p.matchOp("||") != "" {
+		t := p.truthy(v)
+		b := p.operand(!t, p.parseAnd) // Short-circuit.
+		v = p.bool(t || p.truthy(b))
+	}
+	return v
+}
+
+func (p *exprParser) parseAnd() exprVal {
+	v := p.parseBitOr()
+	for p.matchOp("&&") != "" {
+		t := p.truthy(v)
+		b := p.operand(t, p.parseBitOr) // Short-circuit.
+		v = p.bool(t && p.truthy(b))
+	}
+	return v
+}
+
+// operand parses an operand with parse. When it is not used
+// it is skipped: parsed without calling functions, looking
+// up keys or calculating, so only syntax errors fail.
+func (p *exprParser) operand(used bool, parse func() exprVal) exprVal {
+	if used {
+		return parse()
+	}
+	skip := p.skip
+	p.skip = true
+	parse()
+	p.skip = skip
+	return exprVal{}
+}
+
+func (p *exprParser) parseBitOr() exprVal {
+	v := p.parseBitXor()
+	for p.matchOp("|") != "" {
+		v = p.bitwise("|", v, p.parseBitXor())
+	}
+	return v
+}
+
+func (p *exprParser) parseBitXor() exprVal {
+	v := p.parseBitAnd()
+	for p.matchOp("^") != "" {
+		v = p.bitwise("^", v, p.parseBitAnd())
+	}
+	return v
+}
+
+func (p *exprParser) parseBitAnd() exprVal {
+	v := p.parseEquality()
+	for p.matchOp("&") != "" {
+		v = p.bitwise("&", v, p.parseEquality())
+	}
+	return v
+}
+
+func (p *exprParser) parseEquality() exprVal {
+	v := p.parseComparison()
+	for {
+		op := p.matchOp("==", "!=")
+		if op == "" {
+			return v
+		}
+		v = p.compare(op, v, p.parseComparison())
+	}
+}
+
+func (p *exprParser) parseComparison() exprVal {
+	v := p.parseShift()
+	for {
+		op := p.matchOp("<", "<=", ">", ">=")
+		if op == "" {
+			return v
+		}
+		v = p.compare(op, v, p.parseShift())
+	}
+}
+
+func (p *exprParser) parseShift() exprVal {
+	v := p.parseAdditive()
+	for {
+		op := p.matchOp("<<", ">>")
+		if op == "" {
+			return v
+		}
+		v = p.bitwise(op, v, p.parseAdditive())
+	}
+}
+
+func (p *exprParser) parseAdditive() exprVal {
+	v := p.parseMultiplicative()
+	for {
+		op := p.matchOp("+", "-")
+		if op == "" {
+			return v
+		}
+		v = p.arith(op, v, p.parseMultiplicative())
+	}
+}
+
+func (p *exprParser) parseMultiplicative() exprVal {
+	v := p.parseUnary()
+	for {
+		op := p.matchOp("*", "/", "//", "%")
+		if op == "" {
+			return v
+		}
+		v = p.arith(op, v, p.parseUnary())
+	}
+}
+
+func (p *exprParser) parseUnary() exprVal {
+	if p.q.s.MatchByte('-') {
+		p.q.s.WS()
+		return p.arith("-", exprVal{n: new(big.Rat)}, p.parseUnary())
+	}
+	if p.q.s.MatchByte('!') {
+		p.q.s.WS()
+		return p.bool(!p.truthy(p.parseUnary()))
+	}
+	return p.parsePower()
+}
+
+func (p *exprParser) parsePower() exprVal {
+	v := p.parsePrimary()
+	if p.matchOp("**") != "" {
+		return p.arith("**", v, p.parseUnary()) // Right associative.
+	}
+	return v
+}
+
+func (p *exprParser) parsePrimary() exprVal {
+	s := &p.q.s
+	switch {
+	case s.EqualByte('('):
+		if !p.isGroup() {
+			if p.skip {
+				p.q.SkipArg()
+				return exprVal{}
+			}
+			return p.value(p.q.ParseFun(p.j))
+		}
+		s.MatchByte('(')
+		s.WS()
+		v := p.parseTernary()
+		p.expect(')')
+		return v
+	case s.EqualByte('"'):
+		return p.value(p.q.ParseRaw())
+	case s.EqualByteRange('0', '9'):
+		m := s.Mark()
+		s.UtilMatchNumber()
+		v := p.value(JSON(s.Token(m)))
+		s.WS()
+		return v
+	}
+	if v, ok := p.q.ParseVar(); ok {
+		return p.value(v)
+	}
+	m := s.Mark()
+	s.MatchUntilLTEOr4(' ', ')', '(', ',', 0)
+	name := s.Token(m)
+	if s.MatchByte('(') {
+		s.WS()
+		return p.call(name)
+	}
+	s.WS()
+	switch name {
+	case "":
+		p.fail = true
+		return exprVal{j: JSON("")}
+	case "true", "false", "null":
+		return p.value(JSON(name))
+	}
+	if p.skip {
+		return exprVal{}
+	}
+	if !p.q.Step() {
+		p.fail = true
+	}
+	return p.value(p.j.Get(name))
+}
+
+// isGroup reports if the parenthesis at the current position
+// groups an expression instead of calling a jsqt function.
+// It is a function when it starts with a name followed by
+// anything but a binary operator, like (this) or (get a),
+// unless it is only a name that is not a function, like (a).
+func (p *exprParser) isGroup() bool {
+	s := p.q.s
+	s.MatchByte('(')
+	s.WS()
+	if !s.EqualByteBy(isIdentStart) {
+		return true
+	}
+	m := s.Mark()
+	s.MatchUntilLTEOr4(' ', ')', '(', ',', 0)
+	if s.EqualByte('(') {
+		return true // Math function.
+	}
+	name := s.Token(m)
+	s.WS()
+	if s.EqualByte(')') {
+		_, def := p.q.defs[name]
+		_, fun := funcs[name]
+		return !fun && !def
+	}
+	op := peekExprOp(s)
+	s.Advance(len(op))
+	return op != "" && (s.EqualByte(' ') || s.EqualByte('('))
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// exprArity is the number of arguments of the math functions
+// that have a fixed number of them. The others take one or more.
+var exprArity = map[string]int{"abs": 1, "floor": 1, "ceil": 1, "sqrt": 1, "log": 1, "pow": 2}
+
+// call calls a math function.
+func (p *exprParser) call(name string) exprVal {
+	var args []exprVal
+	for !p.q.s.EqualByte(')') && p.q.s.More() {
+		args = append(args, p.parseTernary())
+		if !p.q.s.MatchByte(',') {
+			break
+		}
+		p.q.s.WS()
+	}
+	p.expect(')')
+	nums := make([]*big.Rat, len(args))
+	for i, a := range args {
+		nums[i] = p.num(a)
+	}
+	if p.skip {
+		return exprVal{}
+	}
+	if p.fail {
+		return exprVal{j: JSON("")}
+	}
+	if n, ok := exprArity[name]; ok && n != len(nums) || len(nums) == 0 {
+		p.fail = true
+		return exprVal{j: JSON("")}
+	}
+	return p.int(p.callMath(name, args, nums))
+}
+
+func (p *exprParser) callMath(name string, args []exprVal, nums []*big.Rat) exprVal {
+	switch name {
+	case "abs":
+		return exprVal{n: new(big.Rat).Abs(nums[0])}
+	case "round":
+		digits := 0
+		if len(nums) > 1 {
+			digits = int(p.float(nums[1]))
+		}
+		return p.round(nums[0], max(0, digits), "half-up")
+	case "floor":
+		return p.round(nums[0], 0, "floor")
+	case "ceil":
+		return p.round(nums[0], 0, "ceil")
+	case "sqrt":
+		return p.float64(math.Sqrt(p.float(nums[0])))
+	case "log":
+		return p.float64(math.Log(p.float(nums[0])))
+	case "pow":
+		return p.arith("**", args[0], args[1])
+	case "min", "max":
+		v := nums[0]
+		for _, n := range nums[1:] {
+			if c := n.Cmp(v); name == "min" && c < 0 || name == "max" && c > 0 {
+				v = n
+			}
+		}
+		return exprVal{n: v}
+	}
+	p.fail = true
+	return exprVal{j: JSON("")}
+}
+
+func (p *exprParser) round(r *big.Rat, scale int, mode string) exprVal {
+	v := JSON(formatDecimal(r, scale, mode)).Decimal()
+	return exprVal{n: v}
+}
+
+func (p *exprParser) expect(c byte) {
+	if !p.q.s.MatchByte(c) {
+		p.fail = true
+	}
+	p.q.s.WS()
+}
+
+// arith calculates a op b.
+func (p *exprParser) arith(op string, a, b exprVal) exprVal {
+	if p.skip {
+		return exprVal{}
+	}
+	if p.mode == 'f' {
+		fx, fy := p.floatOf(a), p.floatOf(b)
+		switch op {
+		case "+":
+			return p.float64(fx + fy)
+		case "-":
+			return p.float64(fx - fy)
+		case "*":
+			return p.float64(fx * fy)
+		case "/":
+			return p.float64(fx / fy)
+		case "//":
+			return p.float64(math.Floor(fx / fy))
+		case "%":
+			return p.float64(math.Mod(fx, fy))
+		case "**":
+			return p.float64(math.Pow(fx, fy))
+		}
+	}
+	x, y := p.num(a), p.num(b)
+	if p.fail {
+		return exprVal{j: JSON("")}
+	}
+	if (op == "/" || op == "//" || op == "%") && y.Sign() == 0 {
+		p.fail = true // Division by zero.
+		return exprVal{j: JSON("")}
+	}
+	v := new(big.Rat)
+	switch op {
+	case "+":
+		v.Add(x, y)
+	case "-":
+		v.Sub(x, y)
+	case "*":
+		v.Mul(x, y)
+	case "/":
+		v.Quo(x, y)
+		if p.mode == 'i' {
+			v.SetInt(new(big.Int).Quo(v.Num(), v.Denom()))
+		}
+	case "//":
+		v.Quo(x, y)
+		v.SetInt(new(big.Int).Div(v.Num(), v.Denom())) // Denom is positive, so Div floors.
+	case "%":
+		// x % y = x - y * trunc(x / y)
+		v.Quo(x, y)
+		n := new(big.Int).Quo(v.Num(), v.Denom())
+		v.Sub(x, v.SetInt(n).Mul(v, y))
+	case "**":
+		return p.int(p.pow(x, y))
+	}
+	return p.int(exprVal{n: v})
+}
+
+// bitwise calculates a op b with int64 integers.
+func (p *exprParser) bitwise(op string, a, b exprVal) exprVal {
+	if p.skip {
+		return exprVal{}
+	}
+	x, okX := p.int64(a)
+	y, okY := p.int64(b)
+	if !okX || !okY || (op == "<<" || op == ">>") && (y < 0 || y > 63) {
+		p.fail = true
+		return exprVal{j: JSON("")}
+	}
+	var v int64
+	switch op {
+	case "&":
+		v = x & y
+	case "|":
+		v = x | y
+	case "^":
+		v = x ^ y
+	case "<<":
+		v = x << y
+		if v>>y != x {
+			p.fail = true // Overflow.
+		}
+	case ">>":
+		v = x >> y
+	}
+	return exprVal{n: new(big.Rat).SetInt64(v)}
+}
+
+// int64 returns the value of v as int64. It fails
+// when v is not an integer or does not fit in int64.
+func (p *exprParser) int64(v exprVal) (int64, bool) {
+	n := p.num(v)
+	if p.fail || !n.IsInt() || !n.Num().IsInt64() {
+		return 0, false
+	}
+	return n.Num().Int64(), true
+}
+
+// int makes v fail in int mode when it is not
+// an integer or when it overflows int64.
+func (p *exprParser) int(v exprVal) exprVal {
+	if p.mode == 'i' && v.n != nil {
+		if _, ok := p.int64(v); !ok {
+			p.fail = true
+			return exprVal{j: JSON("")}
+		}
+	}
+	return v
+}
+
+// pow calculates x ** y exactly when y is an integer.
+func (p *exprParser) pow(x, y *big.Rat) exprVal {
+	if !y.IsInt() || !y.Num().IsInt64() {
+		return p.float64(math.Pow(p.float(x), p.float(y)))
+	}
+	e := y.Num().Int64()
+	if x.Sign() == 0 && e < 0 || int64(max(x.Num().BitLen(), x.Denom().BitLen()))*abs64(e) > 1<<20 {
+		p.fail = true
+		return exprVal{j: JSON("")}
+	}
+	n := new(big.Int).Exp(x.Num(), big.NewInt(abs64(e)), nil)
+	d := new(big.Int).Exp(x.Denom(), big.NewInt(abs64(e)), nil)
+	if e < 0 {
+		n, d = d, n
+	}
+	return exprVal{n: new(big.Rat).SetFrac(n, d)}
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// compare compares a op b. Numbers are compared exactly
+// and other values like the comparison functions do.
+func (p *exprParser) compare(op string, a, b exprVal) exprVal {
+	if p.skip {
+		return exprVal{}
+	}
+	if a.n != nil && b.n != nil {
+		c := a.n.Cmp(b.n)
+		switch op {
+		case "==":
+			return p.bool(c == 0)
+		case "!=":
+			return p.bool(c != 0)
+		case "<":
+			return p.bool(c < 0)
+		case "<=":
+			return p.bool(c <= 0)
+		case ">":
+			return p.bool(c > 0)
+		}
+		return p.bool(c >= 0)
+	}
+	x, y := p.json(a), p.json(b)
+	switch op {
+	case "==":
+		return p.bool(x.EQ(y))
+	case "!=":
+		return p.bool(x.NEQ(y))
+	case "<":
+		return p.bool(x.LT(y))
+	case "<=":
+		return p.bool(x.LTE(y))
+	case ">":
+		return p.bool(x.GT(y))
+	}
+	return p.bool(x.GTE(y))
+}
+
+// value converts a Json to an exprVal.
+func (p *exprParser) value(j Json) exprVal {
+	if j.IsNumber() {
+		if r := j.Decimal(); r != nil {
+			return p.int(exprVal{n: r})
 		}
+		return p.float64(j.Float())
 	}
-	return JSON("")
+	return exprVal{j: j}
 }
 
-func funcExpr(q *Query, j Json) Json {
-	v := funcTerm(q, j).Float()
-	for q.MoreArg() {
-		if q.Match("+") {
-			v = v + funcTerm(q, j).Float()
-			continue
+// num returns the number of v. In float mode non-numbers
+// are zero, like Json.Float. In the other modes they fail.
+func (p *exprParser) num(v exprVal) *big.Rat {
+	if v.n == nil {
+		if p.mode != 'f' {
+			p.fail = true
 		}
-		if q.Match("-") {
-			v = v - funcTerm(q, j).Float()
-			continue
+		return new(big.Rat)
+	}
+	return v.n
+}
+
+func (p *exprParser) float(r *big.Rat) float64 {
+	f, _ := r.Float64()
+	return f
+}
+
+// floatOf returns the float64 of v. Other values
+// are converted like Json.Float, so +Inf is infinity.
+func (p *exprParser) floatOf(v exprVal) float64 {
+	if v.n != nil {
+		return p.float(v.n)
+	}
+	return v.j.Float()
+}
+
+// float64 converts f to an exprVal. NaN and Inf are
+// written as +Inf, -Inf and NaN in float mode and
+// fail in the others.
+func (p *exprParser) float64(f float64) exprVal {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		if p.mode == 'f' {
+			return exprVal{j: JSON(strconv.FormatFloat(f, 'f', -1, 64))}
 		}
-		break
+		p.fail = true
+		return exprVal{j: JSON("")}
 	}
-	return JSON(strconv.FormatFloat(v, 'f', -1, 64))
+	return exprVal{n: new(big.Rat).SetFloat64(f)}
 }
 
-func funcTerm(q *Query, j Json) Json {
-	var v float64 = 1
-	if q.Match("-") {
-		v = -1
+func (p *exprParser) bool(b bool) exprVal {
+	if b {
+		return exprVal{j: JSON("true")}
 	}
-	v = v * q.ParseFunOrRaw(j).Float()
-	for q.MoreArg() {
-		if q.Match("*") {
-			v = v * funcTerm(q, j).Float()
-			continue
+	return exprVal{j: JSON("false")}
+}
+
+func (p *exprParser) truthy(v exprVal) bool {
+	if v.n != nil {
+		return v.n.Sign() != 0
+	}
+	return v.j.IsTruthy()
+}
+
+func (p *exprParser) json(v exprVal) Json {
+	if v.n == nil {
+		return v.j
+	}
+	if p.mode == 'd' {
+		return JSON(formatDecimal(v.n, decimalScale(v.n), "half-up"))
+	}
+	if p.mode == 'i' {
+		return JSON(v.n.Num().String())
+	}
+	return JSON(strconv.FormatFloat(p.float(v.n), 'f', -1, 64))
+}
+
+// decimalScale returns the number of fraction digits needed
+// to write r exactly, or 34 if r has an infinite expansion.
+func decimalScale(r *big.Rat) int {
+	d := new(big.Int).Set(r.Denom())
+	two, five, m := big.NewInt(2), big.NewInt(5), new(big.Int)
+	c2, c5 := 0, 0
+	for d.Cmp(one) != 0 && m.Mod(d, two).Sign() == 0 {
+		d.Quo(d, two)
+		c2++
+	}
+	for d.Cmp(one) != 0 && m.Mod(d, five).Sign() == 0 {
+		d.Quo(d, five)
+		c5++
+	}
+	if d.Cmp(one) != 0 {
+		return 34
+	}
+	return max(c2, c5)
+}
+
+var one = big.NewInt(1)
+
+// formatDecimal writes r with scale fraction digits rounded by a
+// mode: half-up, half-even, half-down, up, down, ceil or floor.
+// The scale is clamped to maxDecimalExp, since it sets the size
+// of the number.
+func formatDecimal(r *big.Rat, scale int, mode string) string {
+	scale = min(scale, maxDecimalExp)
+	n := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	n.Mul(n, r.Num())
+	quo, rem := new(big.Int).QuoRem(n, r.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		// Compares 2*|rem| with the denominator to find out if the remainder is half.
+		rem.Abs(rem)
+		half := rem.Lsh(rem, 1).Cmp(r.Denom())
+		neg := r.Sign() < 0
+		inc := false
+		switch mode {
+		case "half-up":
+			inc = half >= 0
+		case "half-down":
+			inc = half > 0
+		case "half-even":
+			inc = half > 0 || half == 0 && quo.Bit(0) == 1
+		case "up":
+			inc = true
+		case "down":
+		case "ceil":
+			inc = !neg
+		case "floor":
+			inc = neg
 		}
-		if q.Match("/") {
-			v = v / funcTerm(q, j).Float()
-			continue
+		if inc {
+			if neg {
+				quo.Sub(quo, one)
+			} else {
+				quo.Add(quo, one)
+			}
 		}
-		if q.Match("%") {
-			v = math.Mod(v, funcTerm(q, j).Float())
-			continue
+	}
+	s := new(big.Int).Abs(quo).String()
+	if scale > 0 {
+		if len(s) <= scale {
+			s = strings.Repeat("0", scale-len(s)+1) + s
 		}
-		break
+		s = s[:len(s)-scale] + "." + s[len(s)-scale:]
 	}
-	return JSON(strconv.FormatFloat(v, 'f', -1, 64))
+	if quo.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+func funcHasBit(q *Query, j Json) Json {
+	if v, b, ok := bitArgs(q, j); ok && v&(1<<b) != 0 {
+		return j
+	}
+	return JSON("")
+}
+
+func funcSetBit(q *Query, j Json) Json {
+	if v, b, ok := bitArgs(q, j); ok {
+		return JSON(strconv.FormatInt(v|1<<b, 10))
+	}
+	return JSON("")
+}
+
+// bitArgs returns the context as int64 and the bit index argument.
+func bitArgs(q *Query, j Json) (int64, int, bool) {
+	b := q.ParseFunOrRaw(j)
+	v := j.Decimal()
+	if v == nil || !v.IsInt() || !v.Num().IsInt64() || !b.IsNumber() || b.Int() < 0 || b.Int() > 63 {
+		return 0, 0, false
+	}
+	return v.Num().Int64(), b.Int(), true
 }
 
 func funcUnwind(q *Query, j Json) Json {
@@ -1292,6 +2926,19 @@ func funcTranspose(q *Query, j Json) Json {
 	return j
 }
 
+func funcDupKeys(q *Query, j Json) Json {
+	var o strings.Builder
+	o.WriteString("[")
+	for _, p := range j.DupKeys() {
+		if o.Len() > 1 {
+			o.WriteString(",")
+		}
+		o.WriteString(quoteJSON(p))
+	}
+	o.WriteString("]")
+	return JSON(o.String())
+}
+
 func funcValid(q *Query, j Json) Json {
 	if j = q.ParseFunOrKeyOptional(j); j.Valid() {
 		return j
@@ -1299,6 +2946,157 @@ func funcValid(q *Query, j Json) Json {
 	return JSON("")
 }
 
+func funcAssert(q *Query, j Json) Json {
+	if q.ParseFunOrKey(j).Exists() {
+		return j
+	}
+	msg := "assertion failed"
+	if q.MoreArg() {
+		msg = q.ParseFunOrRaw(j).Str()
+	}
+	q.Fail(j, msg)
+	return JSON("")
+}
+
+func funcError(q *Query, j Json) Json {
+	msg := "error"
+	if q.MoreArg() {
+		msg = q.ParseFunOrRaw(j).Str()
+	}
+	q.Fail(j, msg)
+	return JSON("")
+}
+
+func funcTry(q *Query, j Json) Json {
+	m := q.s.Mark()
+	v := q.ParseFunOrKey(j)
+	if q.err == nil {
+		return v
+	}
+	var err *QueryError
+	if !errors.As(q.err, &err) {
+		return JSON("") // Limits and cancellations are not recoverable.
+	}
+	q.err = nil
+	q.s.Back(m)
+	q.SkipArg()
+	if !q.MoreArg() {
+		return JSON("")
+	}
+	n := len(q.vars)
+	q.vars = append(q.vars, variable{"error", JSON(err.Error()).Stringify()})
+	v = q.ParseFunOrRaw(j)
+	q.vars = q.vars[:n]
+	return v
+}
+
+func funcType(q *Query, j Json) Json {
+	if t := j.Type(); t != "" {
+		return JSON(t).Stringify()
+	}
+	return JSON("")
+}
+
+func funcToNum(q *Query, j Json) Json {
+	null, fail := q.Match("-n"), q.Match("-e")
+	if v, ok := toNum(j); ok {
+		return v
+	}
+	return convFail(q, j, null, fail, "number")
+}
+
+func funcToInt(q *Query, j Json) Json {
+	null, fail := q.Match("-n"), q.Match("-e")
+	mode := "trunc"
+	if q.MoreArg() {
+		mode = q.ParseFunOrRaw(j).Str()
+	}
+	v, ok := toNum(j)
+	if !ok {
+		return convFail(q, j, null, fail, "integer")
+	}
+	if !strings.ContainsAny(v.String(), ".eE") {
+		return v // Already an integer. Keeps big numbers exact.
+	}
+	// Rounds the exact decimal, not a float, so large numbers
+	// keep their digits. formatDecimal doesn't make -0.
+	r := v.Decimal()
+	if r == nil || intRounding[mode] == "" {
+		return convFail(q, j, null, fail, "integer")
+	}
+	return JSON(formatDecimal(r, 0, intRounding[mode]))
+}
+
+// intRounding maps the modes of (to-int) to rounding modes of formatDecimal.
+var intRounding = map[string]string{"trunc": "down", "round": "half-up", "floor": "floor", "ceil": "ceil", "even": "half-even"}
+
+func funcToStr(q *Query, j Json) Json {
+	if j.IsString() || !j.Exists() {
+		return j
+	}
+	return j.Stringify()
+}
+
+func funcToBool(q *Query, j Json) Json {
+	null, fail := q.Match("-n"), q.Match("-e")
+	switch {
+	case j.IsBool():
+		return j
+	case j.IsNumber():
+		if j.Float() == 0 {
+			return JSON("false")
+		}
+		return JSON("true")
+	case j.IsString():
+		if b, err := strconv.ParseBool(strings.TrimSpace(j.Str())); err == nil {
+			return JSON(strconv.FormatBool(b))
+		}
+	}
+	return convFail(q, j, null, fail, "boolean")
+}
+
+func funcToArr(q *Query, j Json) Json {
+	if j.IsArray() || !j.Exists() {
+		return j
+	}
+	if j.IsNull() {
+		return JSON("[]")
+	}
+	return JSON("[" + j.String() + "]")
+}
+
+// toNum converts a JSON number, a string with a JSON
+// number or a boolean to a JSON number.
+func toNum(j Json) (Json, bool) {
+	switch {
+	case j.IsNumber():
+		return j, true
+	case j.IsTrue():
+		return JSON("1"), true
+	case j.IsFalse():
+		return JSON("0"), true
+	case j.IsString():
+		v := strings.TrimSpace(j.Str())
+		if s := Scanner(v); s.UtilMatchNumber() && !s.More() {
+			return JSON(v), true
+		}
+	}
+	return JSON(""), false
+}
+
+// convFail returns the result of a failed conversion:
+// null with -n, an aborted query with -e, or an empty
+// context otherwise.
+func convFail(q *Query, j Json, null, fail bool, to string) Json {
+	if fail {
+		q.Fail(j, "cannot convert "+j.String()+" to "+to)
+	}
+	if null {
+		return JSON("null")
+	}
+	return JSON("")
+}
+
 func funcIsNum(q *Query, j Json) Json {
 	v := q.ParseFunOrKeyOptional(j)
 	if v.IsNumber() {
@@ -1513,35 +3311,305 @@ func funcAnd(q *Query, j Json) Json {
 			return v
 		}
 	}
-	return j
+	return j
+}
+
+func funcNot(q *Query, j Json) Json {
+	a := q.ParseFunOrKey(j)
+	if a.Exists() {
+		return JSON("")
+	}
+	return j
+}
+
+func funcBool(q *Query, j Json) Json {
+	j = q.ParseFunOrKeyOptional(j)
+	if j.Exists() {
+		return JSON("true")
+	}
+	return JSON("false")
+}
+
+func funcDebug(q *Query, j Json) Json {
+	msg := "debug"
+	if q.MoreArg() {
+		msg = q.ParseRaw().String()
+	}
+	if q.opts.Logger != nil {
+		q.opts.Logger.Debug(msg, "value", j.String())
+	} else if q.opts.Debug != nil {
+		fmt.Fprintf(q.opts.Debug, "[%s] %s\n", msg, j.String())
+	} else {
+		fmt.Printf("[%s] %s\n", msg, j.String())
+	}
+	return j
+}
+
+func funcUpper(q *Query, j Json) Json {
+	if j.IsString() {
+		return JSON(strings.ToUpper(j.Str())).Stringify()
+	}
+	return JSON(strings.ToUpper(j.String()))
+}
+
+func funcLower(q *Query, j Json) Json {
+	if j.IsString() {
+		return JSON(strings.ToLower(j.Str())).Stringify()
+	}
+	return JSON(strings.ToLower(j.String()))
+}
+
+func funcTrim(q *Query, j Json) Json {
+	if q.MoreArg() {
+		chars := q.ParseFunOrRaw(j).Str()
+		return mapStr(j, func(s string) string { return strings.Trim(s, chars) })
+	}
+	return mapStr(j, strings.TrimSpace)
+}
+
+func funcTrimLeft(q *Query, j Json) Json {
+	chars := " \t\n\r"
+	if q.MoreArg() {
+		chars = q.ParseFunOrRaw(j).Str()
+	}
+	return mapStr(j, func(s string) string { return strings.TrimLeft(s, chars) })
+}
+
+func funcTrimRight(q *Query, j Json) Json {
+	chars := " \t\n\r"
+	if q.MoreArg() {
+		chars = q.ParseFunOrRaw(j).Str()
+	}
+	return mapStr(j, func(s string) string { return strings.TrimRight(s, chars) })
+}
+
+func funcPadLeft(q *Query, j Json) Json {
+	n, pad := q.ParseFunOrRaw(j).Int(), " "
+	if q.MoreArg() {
+		pad = q.ParseFunOrRaw(j).Str()
+	}
+	return mapStr(j, func(s string) string { return q.padding(s, n, pad) + s })
+}
+
+func funcPadRight(q *Query, j Json) Json {
+	n, pad := q.ParseFunOrRaw(j).Int(), " "
+	if q.MoreArg() {
+		pad = q.ParseFunOrRaw(j).Str()
+	}
+	return mapStr(j, func(s string) string { return s + q.padding(s, n, pad) })
+}
+
+// padding returns the pad needed to make s n runes long.
+// It returns an empty pad if s and the pad don't fit in
+// the output limit.
+func (q *Query) padding(s string, n int, pad string) string {
+	c := n - utf8.RuneCountInString(s)
+	if c <= 0 || pad == "" {
+		return ""
+	}
+	r := []rune(pad)
+	k, rest := c/len(r), string(r[:c%len(r)])
+	if k > (math.MaxInt-len(s)-len(rest))/len(pad) || !q.fits(len(s)+k*len(pad)+len(rest)) {
+		return ""
+	}
+	return strings.Repeat(pad, k) + rest
+}
+
+func funcSubstr(q *Query, j Json) Json {
+	ini := q.ParseFunOrRaw(j).Int()
+	n := -1
+	if q.MoreArg() {
+		n = q.ParseFunOrRaw(j).Int()
+	}
+	return mapStr(j, func(s string) string {
+		r := []rune(s)
+		if ini < 0 {
+			ini = len(r) + ini
+		}
+		ini = min(max(ini, 0), len(r))
+		end := len(r)
+		if n >= 0 {
+			end = min(ini+n, len(r))
+		}
+		return string(r[ini:end])
+	})
+}
+
+func funcIndexOf(q *Query, j Json) Json {
+	sub := q.ParseFunOrRaw(j).Str()
+	if !isStr(j) {
+		return JSON("")
+	}
+	s := j.Str()
+	i := strings.Index(s, sub)
+	if i > 0 {
+		i = utf8.RuneCountInString(s[:i])
+	}
+	return JSON(strconv.Itoa(i))
+}
+
+func funcStartsWith(q *Query, j Json) Json {
+	if prefix := q.ParseFunOrRaw(j).Str(); isStr(j) && strings.HasPrefix(j.Str(), prefix) {
+		return j
+	}
+	return JSON("")
+}
+
+func funcEndsWith(q *Query, j Json) Json {
+	if suffix := q.ParseFunOrRaw(j).Str(); isStr(j) && strings.HasSuffix(j.Str(), suffix) {
+		return j
+	}
+	return JSON("")
+}
+
+func funcContains(q *Query, j Json) Json {
+	if sub := q.ParseFunOrRaw(j).Str(); isStr(j) && strings.Contains(j.Str(), sub) {
+		return j
+	}
+	return JSON("")
+}
+
+func funcRepeat(q *Query, j Json) Json {
+	n := max(q.ParseFunOrRaw(j).Int(), 0)
+	return mapStr(j, func(s string) string {
+		if len(s) > 0 && n > math.MaxInt/len(s) || !q.fits(len(s)*n) {
+			return ""
+		}
+		return strings.Repeat(s, n)
+	})
+}
+
+func funcTitle(q *Query, j Json) Json {
+	return mapStr(j, func(s string) string {
+		r := []rune(s)
+		for i := range r {
+			if i == 0 || !unicode.IsLetter(r[i-1]) && !unicode.IsDigit(r[i-1]) && r[i-1] != '\'' {
+				r[i] = unicode.ToTitle(r[i])
+			}
+		}
+		return string(r)
+	})
+}
+
+func funcCase(q *Query, j Json) Json {
+	style := q.ParseFunOrRaw(j).Str()
+	switch style {
+	case "camel", "pascal", "snake", "kebab", "screaming":
+		return mapStr(j, func(s string) string { return toCase(s, style) })
+	}
+	return j
+}
+
+// toCase converts s to a case style: camel, pascal, snake, kebab or screaming.
+func toCase(s, style string) string {
+	var o strings.Builder
+	o.Grow(len(s) + 4)
+	for i, w := range words(s) {
+		switch style {
+		case "camel", "pascal":
+			if i == 0 && style == "camel" {
+				o.WriteString(strings.ToLower(w))
+			} else {
+				r, size := utf8.DecodeRuneInString(w)
+				o.WriteRune(unicode.ToUpper(r))
+				o.WriteString(strings.ToLower(w[size:]))
+			}
+		case "snake", "screaming":
+			if i > 0 {
+				o.WriteByte('_')
+			}
+			if style == "snake" {
+				o.WriteString(strings.ToLower(w))
+			} else {
+				o.WriteString(strings.ToUpper(w))
+			}
+		case "kebab":
+			if i > 0 {
+				o.WriteByte('-')
+			}
+			o.WriteString(strings.ToLower(w))
+		}
+	}
+	return o.String()
+}
+
+// words splits s into words. Words are separated by anything
+// that is not a letter or a digit and by case changes:
+// userID is [user ID], HTTPServer is [HTTP Server].
+// Digits stay with the preceding word: address2Line is [address2 Line].
+func words(s string) []string {
+	var ws []string
+	r := []rune(s)
+	ini := -1
+	for i := 0; i <= len(r); i++ {
+		if i == len(r) || !unicode.IsLetter(r[i]) && !unicode.IsDigit(r[i]) {
+			if ini >= 0 {
+				ws = append(ws, string(r[ini:i]))
+				ini = -1
+			}
+			continue
+		}
+		if ini < 0 {
+			ini = i
+			continue
+		}
+		prev := r[i-1]
+		lowerToUpper := unicode.IsUpper(r[i]) && (unicode.IsLower(prev) || unicode.IsDigit(prev))
+		acronymEnd := unicode.IsUpper(r[i]) && unicode.IsUpper(prev) && i+1 < len(r) && unicode.IsLower(r[i+1])
+		if lowerToUpper || acronymEnd {
+			ws = append(ws, string(r[ini:i]))
+			ini = i
+		}
+	}
+	return ws
 }
 
-func funcNot(q *Query, j Json) Json {
-	a := q.ParseFunOrKey(j)
-	if a.Exists() {
-		return JSON("")
+func funcTruncate(q *Query, j Json) Json {
+	n, suffix := q.ParseFunOrRaw(j).Int(), ""
+	if q.MoreArg() {
+		suffix = q.ParseFunOrRaw(j).Str()
 	}
-	return j
+	return mapStr(j, func(s string) string {
+		if r := []rune(s); len(r) > n {
+			return string(r[:max(n, 0)]) + suffix
+		}
+		return s
+	})
 }
 
-func funcBool(q *Query, j Json) Json {
+func funcLen(q *Query, j Json) Json {
 	j = q.ParseFunOrKeyOptional(j)
-	if j.Exists() {
-		return JSON("true")
+	if j.IsString() {
+		return JSON(strconv.Itoa(utf8.RuneCountInString(j.Str())))
 	}
-	return JSON("false")
+	return j.Size()
 }
 
-func funcDebug(q *Query, j Json) Json {
-	msg := "debug"
-	if q.MoreArg() {
-		msg = q.ParseRaw().String()
+// isStr tells if a JSON is a string, a number or a boolean,
+// that is, a value the string functions can work on.
+func isStr(j Json) bool {
+	return j.IsString() || j.IsNumber() || j.IsBool()
+}
+
+// mapStr applies f to the decoded string of a JSON string,
+// number or boolean and returns the result as a JSON string.
+// Other values are returned as is.
+func mapStr(j Json, f func(string) string) Json {
+	if isStr(j) {
+		return JSON(f(j.Str())).Stringify()
 	}
-	fmt.Printf("[%s] %s\n", msg, j.String())
 	return j
 }
 
 func funcReplace(q *Query, j Json) Json {
+	if q.Match("-r") {
+		re := q.Regex(q.ParseFunOrRaw(j).TrimQuote())
+		new := q.ParseFunOrRaw(j).Str()
+		if re != nil && j.IsString() {
+			return JSON(re.ReplaceAllString(j.Str(), new)).Stringify()
+		}
+		return j
+	}
 	old := q.ParseRaw()
 	new := q.ParseRaw()
 	if j.IsString() {
@@ -1550,6 +3618,64 @@ func funcReplace(q *Query, j Json) Json {
 	return j
 }
 
+func funcCapture(q *Query, j Json) Json {
+	re := q.Regex(q.ParseFunOrRaw(j).TrimQuote())
+	if re == nil || !j.IsString() {
+		return JSON("")
+	}
+	m := re.FindStringSubmatch(j.Str())
+	if m == nil {
+		return JSON("")
+	}
+	var o strings.Builder
+	o.Grow(64)
+	if names := re.SubexpNames(); slices.ContainsFunc(names, func(n string) bool { return n != "" }) {
+		o.WriteString("{")
+		for i, name := range names {
+			if name != "" {
+				if o.Len() > 1 {
+					o.WriteString(",")
+				}
+				o.WriteString(quoteJSON(name))
+				o.WriteString(":")
+				o.WriteString(quoteJSON(m[i]))
+			}
+		}
+		o.WriteString("}")
+		return JSON(o.String())
+	}
+	if len(m) > 1 {
+		m = m[1:]
+	}
+	o.WriteString("[")
+	for i, v := range m {
+		if i > 0 {
+			o.WriteString(",")
+		}
+		o.WriteString(quoteJSON(v))
+	}
+	o.WriteString("]")
+	return JSON(o.String())
+}
+
+func funcScan(q *Query, j Json) Json {
+	re := q.Regex(q.ParseFunOrRaw(j).TrimQuote())
+	if re == nil || !j.IsString() {
+		return JSON("")
+	}
+	var o strings.Builder
+	o.Grow(64)
+	o.WriteString("[")
+	for i, v := range re.FindAllString(j.Str(), -1) {
+		if i > 0 {
+			o.WriteString(",")
+		}
+		o.WriteString(quoteJSON(v))
+	}
+	o.WriteString("]")
+	return JSON(o.String())
+}
+
 func funcJoin(q *Query, j Json) Json {
 	sep := q.ParseRaw().Str()
 	j = q.ParseFunOrKeyOptional(j)
@@ -1596,6 +3722,270 @@ func funcConcat(q *Query, j Json) Json {
 	return JSON(o.String()).Stringify()
 }
 
+func funcFmt(q *Query, j Json) Json {
+	// The template is query code, so it can't come from the data.
+	if q.s.EqualByte('(') {
+		q.Fail(j, "fmt template must be a literal")
+		return JSON("")
+	}
+	off, raw := q.offset(), q.ParseRaw()
+	tpl := raw.Str()
+	var offs []int // Offsets in raw of the bytes of tpl, if they differ.
+	if raw.IsString() && strings.IndexByte(raw.String(), '\\') >= 0 {
+		offs = rawOffsets(raw.String())
+	}
+	var o strings.Builder
+	o.Grow(len(tpl) + 32)
+	for i := 0; i < len(tpl); i++ {
+		c := tpl[i]
+		if (c == '{' || c == '}') && i+1 < len(tpl) && tpl[i+1] == c {
+			o.WriteByte(c)
+			i++
+			continue
+		}
+		if c != '{' {
+			o.WriteByte(c)
+			continue
+		}
+		// Finds the closing brace, skipping nested braces and strings.
+		ini, depth := i+1, 1
+		for i = ini; i < len(tpl); i++ {
+			if tpl[i] == '"' {
+				for i++; i < len(tpl) && (tpl[i] != '"' || tpl[i-1] == '\\'); i++ {
+				}
+			} else if tpl[i] == '{' {
+				depth++
+			} else if tpl[i] == '}' {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+		if i >= len(tpl) {
+			q.Fail(j, "unclosed { in fmt template")
+			return JSON("")
+		}
+		expr, spec := tpl[ini:i], ""
+		if k := strings.LastIndex(expr, ":%"); k >= 0 {
+			expr, spec = expr[:k], expr[k+1:]
+		}
+		at := off + ini
+		if offs != nil {
+			at = off + offs[ini]
+		} else if raw.IsString() {
+			at++ // The quote.
+		}
+		if !q.fits(o.Len() + fmtWidth(spec)) {
+			return JSON("")
+		}
+		o.WriteString(fmtValue(q.evalAt(expr, at, j), spec))
+	}
+	return JSON(o.String()).Stringify()
+}
+
+// rawOffsets returns the offsets in the JSON string raw where
+// each prefix of its decoded text ends: the element n is the
+// end of the first n decoded bytes.
+func rawOffsets(raw string) []int {
+	offs := make([]int, 1, len(raw))
+	offs[0] = 1
+	end := len(raw) - 1 // The closing quote.
+	for i := 1; i < end; {
+		w, n := 1, 1 // Raw and decoded bytes.
+		if raw[i] == '\\' {
+			w = min(2, end-i)
+			if i+1 < end && raw[i+1] == 'u' {
+				w = min(6, end-i)
+				// A surrogate pair is decoded as one rune.
+				if pair := min(12, end-i); pair == 12 && raw[i+6] == '\\' && raw[i+7] == 'u' {
+					a, _ := unquoteJSON(`"` + raw[i:i+6] + `"`)
+					b, _ := unquoteJSON(`"` + raw[i+6:i+12] + `"`)
+					if v, _ := unquoteJSON(`"` + raw[i:i+12] + `"`); v != a+b {
+						w = 12
+					}
+				}
+			}
+			v, _ := unquoteJSON(`"` + raw[i:i+w] + `"`)
+			n = len(v)
+		}
+		for ; n > 0; n-- {
+			offs = append(offs, i+w)
+		}
+		i += w
+	}
+	return offs
+}
+
+// fmtWidth returns the size the width and precision of a
+// printf style spec take, so a large one can be rejected
+// before it is formatted. Numbers above 1e6, which fmt
+// rejects, count as 1e6.
+func fmtWidth(spec string) int {
+	n := 0
+	for i := 0; i < len(spec); i++ {
+		ini := i
+		for i < len(spec) && spec[i] >= '0' && spec[i] <= '9' {
+			i++
+		}
+		if i > ini {
+			v, err := strconv.Atoi(spec[ini:i])
+			if err != nil || v > 1e6 {
+				v = 1e6
+			}
+			n += v
+		}
+	}
+	return n
+}
+
+// fmtValue formats a value for (fmt) given a printf
+// style spec. The %j verb embeds the value as JSON.
+func fmtValue(v Json, spec string) string {
+	if spec == "" {
+		if v.IsString() {
+			return v.Str()
+		}
+		return v.String()
+	}
+	switch verb := spec[len(spec)-1]; verb {
+	case 'd', 'x', 'X', 'o', 'b', 'c':
+		n, err := strconv.ParseInt(v.String(), 10, 64)
+		if err != nil {
+			n = int64(v.Float())
+		}
+		return fmt.Sprintf(spec, n)
+	case 'f', 'F', 'e', 'E', 'g', 'G':
+		return fmt.Sprintf(spec, v.Float())
+	case 't':
+		return fmt.Sprintf(spec, v.Bool())
+	case 'j':
+		return fmt.Sprintf(spec[:len(spec)-1]+"s", v.String())
+	default:
+		return fmt.Sprintf(spec, fmtValue(v, ""))
+	}
+}
+
+// encodeArg returns the text the encoding functions work on:
+// the decoded string value or, with -j, the canonical JSON.
+func encodeArg(q *Query, j Json) (string, bool) {
+	if q.Match("-j") {
+		return j.Canonical().String(), j.Exists()
+	}
+	return j.Str(), isStr(j)
+}
+
+func funcBase64Encode(q *Query, j Json) Json {
+	enc := base64.StdEncoding
+	if q.Match("-u") {
+		enc = base64.RawURLEncoding
+	}
+	if v, ok := encodeArg(q, j); ok {
+		return JSON(enc.EncodeToString([]byte(v))).Stringify()
+	}
+	return JSON("")
+}
+
+func funcBase64Decode(q *Query, j Json) Json {
+	asJSON := q.Match("-j")
+	if !j.IsString() {
+		return JSON("")
+	}
+	// Accepts both alphabets, with or without padding.
+	s := strings.TrimRight(j.Str(), "=")
+	v, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		v, err = base64.RawURLEncoding.DecodeString(s)
+	}
+	if err != nil || !utf8.Valid(v) {
+		return JSON("")
+	}
+	if asJSON {
+		if r := JSONBytes(v); r.Valid() {
+			return r
+		}
+		return JSON("")
+	}
+	return JSON(string(v)).Stringify()
+}
+
+func funcHex(q *Query, j Json) Json {
+	if v, ok := encodeArg(q, j); ok {
+		return JSON(hex.EncodeToString([]byte(v))).Stringify()
+	}
+	return JSON("")
+}
+
+func funcURLEncode(q *Query, j Json) Json {
+	if v, ok := encodeArg(q, j); ok {
+		return JSON(url.QueryEscape(v)).Stringify()
+	}
+	return JSON("")
+}
+
+func funcURLDecode(q *Query, j Json) Json {
+	if v, err := url.QueryUnescape(j.Str()); err == nil && j.IsString() && utf8.ValidString(v) {
+		return JSON(v).Stringify()
+	}
+	return JSON("")
+}
+
+func funcHTMLEscape(q *Query, j Json) Json {
+	if v, ok := encodeArg(q, j); ok {
+		return JSON(html.EscapeString(v)).Stringify()
+	}
+	return JSON("")
+}
+
+// funcHash returns the hash of a value as a hex string.
+func funcHash(q *Query, j Json, h hash.Hash) Json {
+	if v, ok := encodeArg(q, j); ok {
+		h.Write([]byte(v))
+		return JSON(hex.EncodeToString(h.Sum(nil))).Stringify()
+	}
+	return JSON("")
+}
+
+func funcUUIDv5(q *Query, j Json) Json {
+	v, ok := encodeArg(q, j)
+	ns, valid := parseUUID(q.ParseFunOrRaw(j).Str())
+	if !ok || !valid {
+		return JSON("")
+	}
+	h := sha1.New()
+	h.Write(ns)
+	h.Write([]byte(v))
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50 // Version 5.
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant.
+	x := hex.EncodeToString(u)
+	return JSON(`"` + x[:8] + "-" + x[8:12] + "-" + x[12:16] + "-" + x[16:20] + "-" + x[20:] + `"`)
+}
+
+// uuidNamespaces are the predefined namespaces of RFC 4122.
+var uuidNamespaces = map[string]string{
+	"dns":  "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+	"url":  "6ba7b811-9dad-11d1-80b4-00c04fd430c8",
+	"oid":  "6ba7b812-9dad-11d1-80b4-00c04fd430c8",
+	"x500": "6ba7b814-9dad-11d1-80b4-00c04fd430c8",
+}
+
+// parseUUID parses a UUID or a predefined namespace name.
+func parseUUID(s string) ([]byte, bool) {
+	if ns, ok := uuidNamespaces[strings.ToLower(s)]; ok {
+		s = ns
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	return b, err == nil && len(b) == 16
+}
+
+func funcStrict(q *Query, j Json) Json {
+	v, err := Lenient(j.String(), LenientOptions{})
+	if err != nil {
+		return JSON("")
+	}
+	return v
+}
+
 func funcSort(q *Query, j Json) Json {
 	asc := !q.Match("desc")
 	key := q.MoreArg()
@@ -1673,7 +4063,7 @@ func funcPick(q *Query, j Json) Json {
 			}
 		}
 		o.WriteByte('}')
-		return JSON(o.String())
+		return q.dedup("pick", JSON(o.String()))
 	}
 	return j
 }
@@ -1725,15 +4115,339 @@ func funcSave(q *Query, j Json) Json {
 	} else {
 		q.save = j
 	}
-	return j
-}
-
-func funcLoad(q *Query, j Json) Json {
-	if q.MoreArg() {
-		id := q.ParseRaw().String()
-		return q.savs[id]
+	return j
+}
+
+func funcLoad(q *Query, j Json) Json {
+	if q.MoreArg() {
+		id := q.ParseRaw().String()
+		return q.savs[id]
+	}
+	return q.save
+}
+
+func funcLet(q *Query, j Json) Json {
+	name := q.ParseRaw().String()
+	val := q.ParseFunOrKey(j)
+	n := len(q.vars)
+	q.vars = append(q.vars, variable{name, val})
+	j = funcGet(q, j)
+	q.vars = q.vars[:n]
+	return j
+}
+
+func funcWith(q *Query, j Json) Json {
+	n := len(q.vars)
+	if q.s.MatchByte('{') {
+		for q.s.WS() && q.s.More() && !q.s.MatchByte('}') {
+			ini := q.s.Mark()
+			q.s.MatchUntilLTEOr2(' ', ':', '}')
+			name := q.s.Token(ini)
+			q.s.WS()
+			q.s.MatchByte(':')
+			q.s.WS()
+			var val Json
+			if q.s.EqualByte('(') {
+				val = q.ParseFun(j)
+			} else if v, ok := q.ParseVar(); ok {
+				val = v
+			} else {
+				ini := q.s.Mark()
+				_ = q.s.UtilMatchString('"') || q.s.MatchUntilLTEOr4(' ', ',', '}', ')', 0)
+				val = j.Get(JSON(q.s.Token(ini)).TrimQuote())
+			}
+			q.vars = append(q.vars, variable{name, val})
+			q.s.WS()
+			q.s.MatchByte(',')
+		}
+		q.s.WS()
+	}
+	j = funcGet(q, j)
+	q.vars = q.vars[:n]
+	return j
+}
+
+func funcNow(q *Query, j Json) Json {
+	now := time.Now
+	if q.opts.Now != nil {
+		now = q.opts.Now
+	}
+	return jsonTime(now())
+}
+
+func funcDateParse(q *Query, j Json) Json {
+	layout := dateLayout(q.ParseFunOrRaw(j).Str())
+	if t, err := dateParse(layout, j.Str()); err == nil {
+		return jsonTime(t)
+	}
+	return JSON("")
+}
+
+func funcDateFormat(q *Query, j Json) Json {
+	layout := dateLayout(q.ParseFunOrRaw(j).Str())
+	if t, ok := j.Time(); ok {
+		return JSON(dateFormat(t, layout)).Stringify()
+	}
+	return JSON("")
+}
+
+func funcDateAdd(q *Query, j Json) Json {
+	dur := q.ParseFunOrRaw(j).Str()
+	if t, ok := j.Time(); ok {
+		if t, ok := addDuration(t, dur); ok {
+			return jsonTime(t)
+		}
+	}
+	return JSON("")
+}
+
+func funcDateDiff(q *Query, j Json) Json {
+	unit := q.ParseFunOrRaw(j).Str()
+	a, okA := j.Time()
+	b, okB := q.ParseFunOrKey(j).Time()
+	if !okA || !okB {
+		return JSON("")
+	}
+	d := a.Sub(b)
+	var v float64
+	switch unit {
+	case "ns":
+		v = float64(d.Nanoseconds())
+	case "us":
+		v = float64(d.Microseconds())
+	case "ms":
+		v = float64(d.Milliseconds())
+	case "s":
+		v = d.Seconds()
+	case "m":
+		v = d.Minutes()
+	case "h":
+		v = d.Hours()
+	case "d":
+		v = d.Hours() / 24
+	case "w":
+		v = d.Hours() / 24 / 7
+	default:
+		return JSON("")
+	}
+	return JSON(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+func funcDateTrunc(q *Query, j Json) Json {
+	unit := q.ParseFunOrRaw(j).Str()
+	t, ok := j.Time()
+	if !ok {
+		return JSON("")
+	}
+	y, mo, d := t.Date()
+	h, mi, s := t.Clock()
+	switch unit {
+	case "year":
+		mo, d, h, mi, s = 1, 1, 0, 0, 0
+	case "month":
+		d, h, mi, s = 1, 0, 0, 0
+	case "day":
+		h, mi, s = 0, 0, 0
+	case "hour":
+		mi, s = 0, 0
+	case "minute":
+		s = 0
+	case "second":
+	default:
+		return JSON("")
+	}
+	return jsonTime(time.Date(y, mo, d, h, mi, s, 0, t.Location()))
+}
+
+func funcDateTZ(q *Query, j Json) Json {
+	zone := q.ParseFunOrRaw(j).Str()
+	t, ok := j.Time()
+	if !ok {
+		return JSON("")
+	}
+	if loc, ok := dateLocation(zone); ok {
+		return jsonTime(t.In(loc))
+	}
+	return JSON("")
+}
+
+func funcDateUnix(q *Query, j Json) Json {
+	ms := q.Match("-ms")
+	if t, ok := j.Time(); ok {
+		if ms {
+			return JSON(strconv.FormatInt(t.UnixMilli(), 10))
+		}
+		return JSON(strconv.FormatInt(t.Unix(), 10))
+	}
+	return JSON("")
+}
+
+func funcDateFromUnix(q *Query, j Json) Json {
+	ms := q.Match("-ms")
+	if !j.IsNumber() {
+		return JSON("")
+	}
+	if ms {
+		return jsonTime(time.UnixMilli(j.Int64()).UTC())
+	}
+	sec, frac := math.Modf(j.Float())
+	return jsonTime(time.Unix(int64(sec), int64(frac*1e9)).UTC())
+}
+
+// jsonTime formats a time as a RFC3339 JSON string.
+func jsonTime(t time.Time) Json {
+	return JSON(t.Format(time.RFC3339Nano)).Stringify()
+}
+
+// dateLayouts are the layout names accepted by the date functions.
+var dateLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RubyDate":    time.RubyDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+	"Stamp":       time.Stamp,
+	"DateTime":    time.DateTime,
+	"DateOnly":    time.DateOnly,
+	"TimeOnly":    time.TimeOnly,
+}
+
+// strftime maps strftime directives to Go layouts.
+var strftime = map[byte]string{
+	'a': "Mon", 'A': "Monday", 'b': "Jan", 'B': "January", 'h': "Jan",
+	'd': "02", 'e': "_2", 'j': "002", 'm': "01", 'y': "06", 'Y': "2006",
+	'H': "15", 'I': "03", 'M': "04", 'S': "05", 'p': "PM", 'f': "000000", 'L': "000",
+	'z': "-0700", 'Z': "MST", 'F': "2006-01-02", 'T': "15:04:05", 'D': "01/02/06",
+	'R': "15:04", '%': "%",
+}
+
+// dateLayout converts a layout name or a strftime
+// pattern to a Go layout. Go layouts are kept as is.
+func dateLayout(layout string) string {
+	if v, ok := dateLayouts[layout]; ok {
+		return v
+	}
+	if !strings.Contains(layout, "%") {
+		return layout
+	}
+	var o strings.Builder
+	for i := 0; i < len(layout); i++ {
+		if layout[i] == '%' && i+1 < len(layout) {
+			if v, ok := strftime[layout[i+1]]; ok {
+				if s := o.String(); v == "000000" && !strings.HasSuffix(s, ".") && !strings.HasSuffix(s, ",") {
+					v = fracSecond
+				}
+				o.WriteString(v)
+				i++
+				continue
+			}
+		}
+		o.WriteByte(layout[i])
+	}
+	return o.String()
+}
+
+// fracSecond is a %f of a layout of dateLayout that
+// isn't after a . or a ,, which Go layouts can't express.
+const fracSecond = "\x00"
+
+// dateFormat formats t with a layout of dateLayout.
+func dateFormat(t time.Time, layout string) string {
+	parts := strings.Split(layout, fracSecond)
+	for i, p := range parts {
+		parts[i] = t.Format(p)
+	}
+	return strings.Join(parts, fmt.Sprintf("%06d", t.Nanosecond()/1000))
+}
+
+// dateParse parses s with a layout of dateLayout. The digits
+// of the first fracSecond, up to 6 like in strftime, are
+// parsed as a fraction after a dot.
+func dateParse(layout, s string) (time.Time, error) {
+	i := strings.Index(layout, fracSecond)
+	if i < 0 {
+		return time.Parse(layout, s)
+	}
+	head, tail := layout[:i], strings.ReplaceAll(layout[i+1:], fracSecond, "000000")
+	for p := 0; p < len(s); p++ {
+		n := p
+		for n < len(s) && n-p < 6 && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		if n > p {
+			t, e := time.Parse(head+"."+strings.Repeat("0", n-p)+tail, s[:p]+"."+s[p:])
+			if e == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, &time.ParseError{Layout: layout, Value: s, Message: ": fractional second not found"}
+}
+
+// dateLocation returns a location given an IANA
+// time zone name or an offset like +03:00.
+func dateLocation(zone string) (*time.Location, bool) {
+	if t, err := time.Parse("-07:00", zone); err == nil {
+		_, off := t.Zone()
+		return time.FixedZone(zone, off), true
+	}
+	loc, err := time.LoadLocation(zone)
+	return loc, err == nil
+}
+
+// addDuration adds a duration like 1y2mo3w4d5h6m7s8ms to a time.
+// The duration can start with a sign. Units up to days are
+// calendar units; the others are Go duration units.
+func addDuration(t time.Time, dur string) (time.Time, bool) {
+	s := Scanner(dur)
+	sign := 1
+	if s.MatchByte('-') {
+		sign = -1
+	} else {
+		s.MatchByte('+')
+	}
+	if !s.More() {
+		return t, false
+	}
+	var clock strings.Builder
+	for s.More() {
+		num := s.TokenByteBy(func(c byte) bool { return c >= '0' && c <= '9' || c == '.' })
+		unit := s.TokenByteBy(func(c byte) bool { return c >= 'a' && c <= 'z' || c == 0xC2 || c == 0xB5 })
+		if num == "" || unit == "" {
+			return t, false
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil && (unit == "y" || unit == "mo" || unit == "w" || unit == "d") {
+			return t, false
+		}
+		switch unit {
+		case "y":
+			t = t.AddDate(sign*n, 0, 0)
+		case "mo":
+			t = t.AddDate(0, sign*n, 0)
+		case "w":
+			t = t.AddDate(0, 0, sign*n*7)
+		case "d":
+			t = t.AddDate(0, 0, sign*n)
+		default:
+			clock.WriteString(num)
+			clock.WriteString(unit)
+		}
+	}
+	if clock.Len() > 0 {
+		d, err := time.ParseDuration(clock.String())
+		if err != nil {
+			return t, false
+		}
+		t = t.Add(time.Duration(sign) * d)
 	}
-	return q.save
+	return t, true
 }
 
 // #endregion Functions
@@ -1749,16 +4463,105 @@ type Json struct {
 
 func (j Json) Query(qry string) Json {
 	j.s.WS()
-	q := Query{s: Scanner(qry), Root: j}
+	q := Query{qry: qry, s: Scanner(qry), Root: j}
 	return q.Parse(j)
 }
 
 func (j Json) QueryWith(qry string, args []any) Json {
 	j.s.WS()
-	q := Query{s: Scanner(qry), Root: j, args: args}
+	q := Query{qry: qry, s: Scanner(qry), Root: j, args: args}
 	return q.Parse(j)
 }
 
+// QueryE is like Query but also returns the error
+// that aborted the query, if any.
+func (j Json) QueryE(qry string) (Json, error) {
+	j.s.WS()
+	q := Query{qry: qry, s: Scanner(qry), Root: j}
+	v := q.Parse(j)
+	return v, q.Err()
+}
+
+// QueryContext runs a query that is aborted when ctx is done
+// or when it exceeds one of the opts limits. In that case it
+// returns an empty Json and ctx.Err() or a *LimitError.
+// Use it to run untrusted queries.
+func (j Json) QueryContext(ctx context.Context, qry string, opts Options) (Json, error) {
+	j.s.WS()
+	j, err := j.resolve(&opts)
+	if err != nil {
+		return JSON(""), err
+	}
+	q := Query{qry: qry, s: Scanner(qry), Root: j, args: opts.Args, ctx: ctx, opts: opts}
+	v := q.Parse(j)
+	return v, q.Err()
+}
+
+// QueryTo is like Query but writes the result to w.
+// See QueryToContext.
+func (j Json) QueryTo(w io.Writer, qry string) error {
+	return j.queryTo(nil, bufio.NewWriter(w), qry, Options{})
+}
+
+// QueryToContext is like QueryContext but writes the result to w.
+// When the last function of the query, or the last function of a
+// (get), is (collect), (obj), (set), (pretty) or (ugly), it writes
+// its output to w as it makes it, so the output doesn't need to fit
+// in memory. Part of the result may have been written when an error
+// is returned, if it was larger than the write buffer. The Tracer
+// receives an empty Output for that function.
+func (j Json) QueryToContext(ctx context.Context, w io.Writer, qry string, opts Options) error {
+	return j.queryTo(ctx, bufio.NewWriter(w), qry, opts)
+}
+
+// QueryAppend is like QueryAppendContext with no limits.
+func (j Json) QueryAppend(dst []byte, qry string) ([]byte, error) {
+	return j.QueryAppendContext(context.Background(), dst, qry, Options{})
+}
+
+// QueryAppendContext is like QueryToContext but appends the
+// result to dst and returns the extended buffer. The functions
+// that QueryToContext streams write into dst as they make their
+// output, without building a string that is then copied, so a
+// reused dst saves the allocations of the result. On error dst
+// is returned as it was.
+func (j Json) QueryAppendContext(ctx context.Context, dst []byte, qry string, opts Options) ([]byte, error) {
+	w := &appendWriter{b: dst}
+	if err := j.queryTo(ctx, w, qry, opts); err != nil {
+		return dst, err
+	}
+	return w.b, nil
+}
+
+func (j Json) queryTo(ctx context.Context, w flushWriter, qry string, opts Options) error {
+	j.s.WS()
+	j, err := j.resolve(&opts)
+	if err != nil {
+		return err
+	}
+	q := Query{qry: qry, s: Scanner(qry), Root: j, args: opts.Args, ctx: ctx, opts: opts}
+	o := &streamWriter{flushWriter: w, q: &q}
+	q.s.WS()
+	q.getTo(j, o)
+	if q.err == nil {
+		q.err = o.Flush()
+	}
+	return q.Err()
+}
+
+// resolve resolves the duplicate keys of j with the DupKeys
+// policy of opts. When j is the document of opts.Index, it
+// sets opts.Index to the index of the resolved document.
+func (j Json) resolve(opts *Options) (Json, error) {
+	x := opts.Index
+	if x == nil || opts.DupKeys == DupKeep || len(j.s) != len(x.doc.s) || offsetOf(x.doc.String(), j.String()) != 0 {
+		return j.Dedup(opts.DupKeys)
+	}
+	d, y, err := x.dedup(opts.DupKeys)
+	opts.Index = y
+	return d, err
+}
+
 // String returns the raw JSON data.
 func (j Json) String() string {
 	return j.s.String()
@@ -1769,6 +4572,24 @@ func (j Json) Bytes() []byte {
 	return j.s.Bytes()
 }
 
+// AppendTo appends the raw JSON data to dst and returns
+// the extended buffer. Reuse dst to avoid the allocation
+// of Bytes.
+func (j Json) AppendTo(dst []byte) []byte {
+	return append(dst, j.s...)
+}
+
+// BytesIn returns the raw JSON data as a slice of src,
+// without a copy, when the JSON is part of src, like the
+// values taken from JSONBytes(src) that were not built
+// by a function. Otherwise it returns a copy.
+func (j Json) BytesIn(src []byte) []byte {
+	if off := offsetOf(unsafe.String(unsafe.SliceData(src), len(src)), j.String()); off >= 0 {
+		return src[off : off+len(j.s) : off+len(j.s)]
+	}
+	return j.Bytes()
+}
+
 // Stringify converts a JSON to a JSON string.
 // Examples:
 //
@@ -1780,7 +4601,7 @@ func (j Json) Bytes() []byte {
 //
 // Stringify reverts Jsonify.
 func (j Json) Stringify() Json {
-	return JSON(strconv.Quote(j.String()))
+	return JSON(quoteJSON(j.String()))
 }
 
 // Jsonify converts a JSON string to a JSON.
@@ -1793,7 +4614,7 @@ func (j Json) Stringify() Json {
 //
 // Jsonify reverts Stringify.
 func (j Json) Jsonify() Json {
-	v, _ := strconv.Unquote(j.String())
+	v, _ := unquoteJSON(j.String())
 	return JSON(v)
 }
 
@@ -1811,7 +4632,7 @@ func (j Json) TrimQuote() string {
 func (j Json) Str() string {
 	v := j.String()
 	if j.IsString() {
-		v, _ = strconv.Unquote(v)
+		v, _ = unquoteJSON(v)
 	}
 	return v
 }
@@ -1840,12 +4661,94 @@ func (j Json) Float() float64 {
 	return v
 }
 
+// Time converts a RFC3339 JSON string to time.
+func (j Json) Time() (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, j.Str())
+	return t, err == nil
+}
+
+// BigInt converts a JSON number to big.Int without losing
+// precision. Numbers with a fraction convert to zero.
+func (j Json) BigInt() *big.Int {
+	if r := j.Decimal(); r != nil && r.IsInt() {
+		return r.Num()
+	}
+	return new(big.Int)
+}
+
+// BigFloat converts a JSON number to big.Float with
+// enough precision to hold all of its digits.
+func (j Json) BigFloat() *big.Float {
+	f, _, err := big.ParseFloat(j.String(), 10, uint(len(j.s))*4+64, big.ToNearestEven)
+	if err != nil || !j.IsNumber() {
+		return new(big.Float)
+	}
+	return f
+}
+
+// Decimal converts a JSON number to its exact value as a
+// big.Rat. It returns nil if the Json is not a number.
+func (j Json) Decimal() *big.Rat {
+	d, ok := parseDecimal(j.String())
+	if !ok || d.exp > maxDecimalExp || d.exp < -maxDecimalExp {
+		return nil
+	}
+	if d.digits == "" {
+		return new(big.Rat)
+	}
+	n, _ := new(big.Int).SetString(d.digits, 10)
+	r := new(big.Rat).SetInt(n)
+	e := d.exp - len(d.digits)
+	p := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(e))), nil)
+	if e > 0 {
+		r.Mul(r, new(big.Rat).SetInt(p))
+	} else {
+		r.Quo(r, new(big.Rat).SetInt(p))
+	}
+	if d.neg {
+		r.Neg(r)
+	}
+	return r
+}
+
+// maxDecimalExp limits the exponent of numbers converted to
+// big values, since 1e999999999 would need a lot of memory.
+const maxDecimalExp = 10000
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
 // Bool converts a JSON boolean to bool.
 func (j Json) Bool() bool {
 	v, _ := strconv.ParseBool(j.String())
 	return v
 }
 
+// Type returns the JSON type name: object, array,
+// string, number, boolean or null. It returns an empty
+// string for an empty or invalid Json.
+func (j Json) Type() string {
+	switch {
+	case j.IsObject():
+		return "object"
+	case j.IsArray():
+		return "array"
+	case j.IsString():
+		return "string"
+	case j.IsNumber():
+		return "number"
+	case j.IsBool():
+		return "boolean"
+	case j.IsNull():
+		return "null"
+	}
+	return ""
+}
+
 func (j Json) IsObject() bool {
 	return j.s.EqualByte('{')
 }
@@ -1933,56 +4836,144 @@ func (j Json) IN(arr Json) (yes bool) {
 
 func (j Json) EQ(b Json) bool {
 	if j.IsNumber() && b.IsNumber() {
-		na, nb := toFloat(j, b)
-		return na == nb
+		return cmpNumber(j, b) == 0
 	}
 	return j.String() == b.String()
 }
 
 func (j Json) NEQ(b Json) bool {
 	if j.IsNumber() && b.IsNumber() {
-		na, nb := toFloat(j, b)
-		return na != nb
+		return cmpNumber(j, b) != 0
 	}
 	return j.String() != b.String()
 }
 
 func (j Json) GT(b Json) bool {
 	if j.IsNumber() && b.IsNumber() {
-		na, nb := toFloat(j, b)
-		return na > nb
+		return cmpNumber(j, b) > 0
 	}
 	return j.String() > b.String()
 }
 
 func (j Json) GTE(b Json) bool {
 	if j.IsNumber() && b.IsNumber() {
-		na, nb := toFloat(j, b)
-		return na >= nb
+		return cmpNumber(j, b) >= 0
 	}
 	return j.String() >= b.String()
 }
 
 func (j Json) LT(b Json) bool {
 	if j.IsNumber() && b.IsNumber() {
-		na, nb := toFloat(j, b)
-		return na < nb
+		return cmpNumber(j, b) < 0
 	}
 	return j.String() < b.String()
 }
 
 func (j Json) LTE(b Json) bool {
 	if j.IsNumber() && b.IsNumber() {
-		na, nb := toFloat(j, b)
-		return na <= nb
+		return cmpNumber(j, b) <= 0
 	}
 	return j.String() <= b.String()
 }
 
-func toFloat(a, b Json) (float64, float64) {
-	na, _ := strconv.ParseFloat(a.String(), 64)
-	nb, _ := strconv.ParseFloat(b.String(), 64)
-	return na, nb
+// cmpNumber compares two JSON numbers exactly, so big
+// numbers like 64-bit IDs are not rounded. It returns
+// -1, 0 or +1. Invalid numbers are compared as floats.
+func cmpNumber(a, b Json) int {
+	if a.String() == b.String() {
+		return 0
+	}
+	da, okA := parseDecimal(a.String())
+	db, okB := parseDecimal(b.String())
+	if !okA || !okB {
+		na, _ := strconv.ParseFloat(a.String(), 64)
+		nb, _ := strconv.ParseFloat(b.String(), 64)
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return +1
+		}
+		return 0
+	}
+	return da.cmp(db)
+}
+
+// isNumber reports if s is a JSON number.
+func isNumber(s string) bool {
+	if d := strings.TrimPrefix(s, "-"); d == "" || d[0] < '0' || d[0] > '9' {
+		return false // UtilMatchNumber accepts numbers like .5
+	}
+	sc := Scanner(s)
+	return sc.UtilMatchNumber() && !sc.More()
+}
+
+// decimal is a JSON number in the form 0.digits × 10^exp.
+// Digits have no leading or trailing zeros; zero has no digits.
+type decimal struct {
+	neg    bool
+	digits string
+	exp    int
+}
+
+// parseDecimal parses a JSON number into a decimal.
+func parseDecimal(s string) (d decimal, ok bool) {
+	if !isNumber(s) {
+		return d, false
+	}
+	if s[0] == '-' {
+		d.neg = true
+		s = s[1:]
+	}
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(strings.TrimPrefix(s[i+1:], "+"))
+		if err != nil {
+			return d, false
+		}
+		d.exp, s = e, s[:i]
+	}
+	digits := s
+	d.exp += len(s)
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		digits = s[:i] + s[i+1:]
+		d.exp -= len(s) - i
+	}
+	for len(digits) > 0 && digits[0] == '0' {
+		digits = digits[1:]
+		d.exp--
+	}
+	d.digits = strings.TrimRight(digits, "0")
+	if d.digits == "" {
+		d.neg, d.exp = false, 0
+	}
+	return d, true
+}
+
+func (a decimal) cmp(b decimal) int {
+	if a.neg != b.neg {
+		if a.neg {
+			return -1
+		}
+		return +1
+	}
+	c := 0
+	switch {
+	case a.digits == "" || b.digits == "":
+		c = len(a.digits) - len(b.digits) // Zero is smaller than any magnitude.
+	case a.exp != b.exp:
+		c = a.exp - b.exp
+	default:
+		c = strings.Compare(a.digits, b.digits)
+	}
+	if c > 0 {
+		c = 1
+	} else if c < 0 {
+		c = -1
+	}
+	if a.neg {
+		return -c
+	}
+	return c
 }
 
 func (j Json) Iterator(depth int, m func(k, v Json)) {
@@ -2092,6 +5083,15 @@ func (j Json) IterateKeys(m func(Json) Json) Json {
 	return JSON(o.String())
 }
 
+// RenameKeys renames all the keys of a valid Json
+// with a function that receives and returns the
+// decoded key.
+func (j Json) RenameKeys(f func(string) string) Json {
+	return j.IterateKeys(func(k Json) Json {
+		return JSON(f(k.Str())).Stringify()
+	})
+}
+
 // IterateValues iterates over the values (excluding the keys)
 // of a valid Json and apply a map function to transform each
 // emitted value.
@@ -2244,6 +5244,9 @@ func (j Json) IterateFast(m func(k, v Json) (Json, Json)) Json {
 	return JSON(o.String())
 }
 
+// Get returns the value of a key of an object or of an index
+// of an array. The first key is found when there are duplicates.
+// See GetDup. It scans j; see Index.Get for repeated lookups.
 func (j Json) Get(keyOrIndex string) (r Json) {
 	f := func(k, v Json) bool {
 		if k.TrimQuote() == keyOrIndex {
@@ -2260,6 +5263,42 @@ func (j Json) Get(keyOrIndex string) (r Json) {
 	return r
 }
 
+// GetDup is like Get but resolves the duplicates of the key
+// with the policy p. Keys are compared decoded, so "\u0061" is
+// found by a. The values are returned as they are.
+func (j Json) GetDup(keyOrIndex string, p DupPolicy) (Json, error) {
+	if p == DupKeep || !j.IsObject() {
+		return j.Get(keyOrIndex), nil
+	}
+	var vs []Json
+	j.ForEachKeyVal(func(k, v Json) bool {
+		if dupKey(k) == keyOrIndex {
+			vs = append(vs, v)
+		}
+		return false
+	})
+	switch {
+	case len(vs) == 0:
+		return JSON(""), nil
+	case len(vs) == 1 || p == DupFirst:
+		return vs[0], nil
+	case p == DupLast:
+		return vs[len(vs)-1], nil
+	case p == DupError:
+		return JSON(""), &DupKeyError{Path: keyPath(JSON(quoteJSON(keyOrIndex)))}
+	}
+	var o strings.Builder
+	o.WriteString("[")
+	for i, v := range vs {
+		if i > 0 {
+			o.WriteString(",")
+		}
+		o.WriteString(v.String())
+	}
+	o.WriteString("]")
+	return JSON(o.String()), nil
+}
+
 func (j Json) GetKey(key string) (r Json) {
 	j.ForEachKeyVal(func(k, v Json) bool {
 		if k.TrimQuote() == key {
@@ -2316,9 +5355,16 @@ func (j Json) GetSuffixKey(suffix string) (r Json) {
 }
 
 func (j Json) GetRegex(pattern string) (r Json) {
+	if re, _ := compileRegex(pattern, 0); re != nil {
+		return j.getRegex(re)
+	}
+	return r
+}
+
+func (j Json) getRegex(re *regexp.Regexp) (r Json) {
 	if j.IsObject() {
 		j.ForEachKeyVal(func(k, v Json) bool {
-			if ok, _ := regexp.MatchString(pattern, k.TrimQuote()); ok {
+			if re.MatchString(k.TrimQuote()) {
 				r = v
 				return true
 			}
@@ -2329,9 +5375,16 @@ func (j Json) GetRegex(pattern string) (r Json) {
 }
 
 func (j Json) GetRegexKey(pattern string) (r Json) {
+	if re, _ := compileRegex(pattern, 0); re != nil {
+		return j.getRegexKey(re)
+	}
+	return r
+}
+
+func (j Json) getRegexKey(re *regexp.Regexp) (r Json) {
 	if j.IsObject() {
 		j.ForEachKeyVal(func(k, v Json) bool {
-			if ok, _ := regexp.MatchString(pattern, k.TrimQuote()); ok {
+			if re.MatchString(k.TrimQuote()) {
 				r = k
 				return true
 			}
@@ -2503,6 +5556,8 @@ func (j Json) Size() Json {
 	return JSON(strconv.Itoa(c))
 }
 
+// Keys returns the keys of an object as an array.
+// It scans j; see Index.Keys for repeated calls.
 func (j Json) Keys() Json {
 	var o strings.Builder
 	o.Grow(len(j.s) >> 1)
@@ -2552,52 +5607,371 @@ func (j Json) Entries() Json {
 	return JSON(o.String())
 }
 
-func (j Json) Objectify() Json {
+func (j Json) Objectify() Json {
+	var o strings.Builder
+	o.Grow(len(j.s) + 128)
+	o.WriteString("{")
+	j.ForEach(func(i, v Json) bool {
+		if o.Len() > 1 {
+			o.WriteString(",")
+		}
+		o.WriteString(`"`)
+		o.WriteString(v.Get("0").TrimQuote())
+		o.WriteString(`":`)
+		o.WriteString(v.Get("1").String())
+		return false
+	})
+	o.WriteString("}")
+	return JSON(o.String())
+}
+
+func (j Json) Merge() Json {
+	done := make(map[string]bool)
+	var o strings.Builder
+	o.Grow(len(j.s))
+	o.WriteString("{")
+	j.ForEach(func(i, v Json) bool {
+		v.ForEachKeyVal(func(k, v Json) bool {
+			if !done[k.String()] {
+				if o.Len() > 1 {
+					o.WriteString(",")
+				}
+				o.WriteString(k.String())
+				o.WriteString(`:`)
+				o.WriteString(v.String())
+				done[k.String()] = true
+			}
+			return false
+		})
+		return false
+	})
+	o.WriteString("}")
+	return JSON(o.String())
+}
+
+// DupKeys returns the paths of the duplicate keys of
+// the objects in j, like .a.b[0].c, once for each key.
+func (j Json) DupKeys() []string {
+	var paths []string
+	j.dupKeys("", &paths)
+	return paths
+}
+
+func (j Json) dupKeys(path string, paths *[]string) {
+	if j.IsObject() {
+		seen := map[string]int{}
+		j.ForEachKeyVal(func(k, v Json) bool {
+			key := dupKey(k)
+			p := path + keyPath(k)
+			if seen[key]++; seen[key] == 2 {
+				*paths = append(*paths, p)
+			}
+			v.dupKeys(p, paths)
+			return false
+		})
+	} else if j.IsArray() {
+		j.ForEach(func(i, v Json) bool {
+			v.dupKeys(path+"["+i.String()+"]", paths)
+			return false
+		})
+	}
+}
+
+// dupKey returns the key k decoded, so "a" and "\u0061"
+// are the same key.
+func dupKey(k Json) string {
+	if key, ok := unquoteJSON(k.String()); ok {
+		return key
+	}
+	return k.TrimQuote()
+}
+
+// Dedup resolves the duplicate keys of the objects in j
+// with the policy p. The JSON is returned as it is when
+// it has no duplicate keys or p is DupKeep. DupError
+// returns a *DupKeyError with the first duplicate key.
+func (j Json) Dedup(p DupPolicy) (Json, error) {
+	if p == DupKeep {
+		return j, nil
+	}
+	dups := j.DupKeys()
+	if len(dups) == 0 {
+		return j, nil
+	}
+	if p == DupError {
+		return JSON(""), &DupKeyError{Path: dups[0]}
+	}
+	var o strings.Builder
+	o.Grow(len(j.s))
+	j.dedup(&o, p)
+	return JSON(o.String()), nil
+}
+
+func (j Json) dedup(o *strings.Builder, p DupPolicy) {
+	switch {
+	case j.IsObject():
+		var keys []Json
+		vals := map[string][]Json{}
+		j.ForEachKeyVal(func(k, v Json) bool {
+			key := dupKey(k)
+			if _, ok := vals[key]; !ok {
+				keys = append(keys, k)
+			}
+			vals[key] = append(vals[key], v)
+			return false
+		})
+		o.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				o.WriteString(",")
+			}
+			o.WriteString(k.String())
+			o.WriteString(":")
+			switch vs := vals[dupKey(k)]; {
+			case len(vs) == 1 || p == DupFirst:
+				vs[0].dedup(o, p)
+			case p == DupLast:
+				vs[len(vs)-1].dedup(o, p)
+			default:
+				o.WriteString("[")
+				for i, v := range vs {
+					if i > 0 {
+						o.WriteString(",")
+					}
+					v.dedup(o, p)
+				}
+				o.WriteString("]")
+			}
+		}
+		o.WriteString("}")
+	case j.IsArray():
+		o.WriteString("[")
+		j.ForEach(func(i, v Json) bool {
+			if i.Int() > 0 {
+				o.WriteString(",")
+			}
+			v.dedup(o, p)
+			return false
+		})
+		o.WriteString("]")
+	default:
+		o.WriteString(j.String())
+	}
+}
+
+// Canonical returns the JSON with object keys sorted, no white
+// spaces and strings with minimal escapes, so documents with the
+// same content have the same text. Numbers are written with
+// their exact digits in the form of canonicalNumber, so 1, 1.0
+// and 1e0 have the same text too.
+func (j Json) Canonical() Json {
+	var o strings.Builder
+	o.Grow(len(j.s))
+	j.canonical(&o)
+	return JSON(o.String())
+}
+
+func (j Json) canonical(o *strings.Builder) {
+	switch {
+	case j.IsObject():
+		type keyVal struct {
+			k string
+			v Json
+		}
+		var kvs []keyVal
+		j.ForEachKeyVal(func(k, v Json) bool {
+			kvs = append(kvs, keyVal{canonicalStr(k), v})
+			return false
+		})
+		sort.SliceStable(kvs, func(a, b int) bool { return kvs[a].k < kvs[b].k })
+		o.WriteString("{")
+		for i, kv := range kvs {
+			if i > 0 {
+				o.WriteString(",")
+			}
+			o.WriteString(kv.k)
+			o.WriteString(":")
+			kv.v.canonical(o)
+		}
+		o.WriteString("}")
+	case j.IsArray():
+		o.WriteString("[")
+		j.ForEach(func(i, v Json) bool {
+			if i.Int() > 0 {
+				o.WriteString(",")
+			}
+			v.canonical(o)
+			return false
+		})
+		o.WriteString("]")
+	case j.IsString():
+		o.WriteString(canonicalStr(j))
+	case j.IsNumber():
+		o.WriteString(canonicalNumber(j.String()))
+	default:
+		o.WriteString(j.String())
+	}
+}
+
+// canonicalNumber returns the shortest exact text of a JSON number,
+// laid out like JavaScript does (and RFC 8785, JSON canonicalization):
+// with an exponent from 1e21 and below 1e-6. An invalid number is
+// kept as it is.
+func canonicalNumber(s string) string {
+	d, ok := parseDecimal(s)
+	if !ok {
+		return s
+	}
+	if d.digits == "" {
+		return "0"
+	}
+	var o strings.Builder
+	if d.neg {
+		o.WriteByte('-')
+	}
+	// The value is 0.digits times 10 to the n.
+	k, n := len(d.digits), d.exp
+	switch {
+	case k <= n && n <= 21:
+		o.WriteString(d.digits)
+		o.WriteString(strings.Repeat("0", n-k))
+	case 0 < n && n <= 21:
+		o.WriteString(d.digits[:n])
+		o.WriteString(".")
+		o.WriteString(d.digits[n:])
+	case -6 < n && n <= 0:
+		o.WriteString("0.")
+		o.WriteString(strings.Repeat("0", -n))
+		o.WriteString(d.digits)
+	default:
+		o.WriteString(d.digits[:1])
+		if k > 1 {
+			o.WriteString(".")
+			o.WriteString(d.digits[1:])
+		}
+		o.WriteString("e")
+		if n-1 > 0 {
+			o.WriteString("+")
+		}
+		o.WriteString(strconv.Itoa(n - 1))
+	}
+	return o.String()
+}
+
+// canonicalStr returns the canonical form of a JSON string.
+// An invalid string is kept as it is, so it can't be equal
+// to a valid one.
+func canonicalStr(j Json) string {
+	if v, ok := unquoteJSON(j.String()); ok {
+		return quoteJSON(v)
+	}
+	return j.String()
+}
+
+// quoteJSON quotes a string escaping only what JSON requires.
+func quoteJSON(s string) string {
+	var o strings.Builder
+	o.Grow(len(s) + 2)
+	o.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			o.WriteString(`\"`)
+		case '\\':
+			o.WriteString(`\\`)
+		case '\b':
+			o.WriteString(`\b`)
+		case '\f':
+			o.WriteString(`\f`)
+		case '\n':
+			o.WriteString(`\n`)
+		case '\r':
+			o.WriteString(`\r`)
+		case '\t':
+			o.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&o, `\u%04x`, r)
+			} else {
+				o.WriteRune(r)
+			}
+		}
+	}
+	o.WriteByte('"')
+	return o.String()
+}
+
+// unquoteJSON decodes a JSON string. It reports
+// false if s is not a valid JSON string.
+func unquoteJSON(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", false
+	}
+	s = s[1 : len(s)-1]
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, true
+	}
 	var o strings.Builder
-	o.Grow(len(j.s) + 128)
-	o.WriteString("{")
-	j.ForEach(func(i, v Json) bool {
-		if o.Len() > 1 {
-			o.WriteString(",")
+	o.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			o.WriteByte(s[i])
+			continue
 		}
-		o.WriteString(`"`)
-		o.WriteString(v.Get("0").TrimQuote())
-		o.WriteString(`":`)
-		o.WriteString(v.Get("1").String())
-		return false
-	})
-	o.WriteString("}")
-	return JSON(o.String())
+		if i++; i == len(s) {
+			return "", false
+		}
+		switch s[i] {
+		case '"', '\\', '/':
+			o.WriteByte(s[i])
+		case 'b':
+			o.WriteByte('\b')
+		case 'f':
+			o.WriteByte('\f')
+		case 'n':
+			o.WriteByte('\n')
+		case 'r':
+			o.WriteByte('\r')
+		case 't':
+			o.WriteByte('\t')
+		case 'u':
+			r, ok := unquoteHex(s[i+1:])
+			if !ok {
+				return "", false
+			}
+			i += 4
+			if utf16.IsSurrogate(r) && strings.HasPrefix(s[i+1:], `\u`) {
+				if r2, ok := unquoteHex(s[i+3:]); ok && utf16.DecodeRune(r, r2) != utf8.RuneError {
+					r = utf16.DecodeRune(r, r2)
+					i += 6
+				}
+			}
+			o.WriteRune(r) // A lone surrogate becomes U+FFFD.
+		default:
+			return "", false
+		}
+	}
+	return o.String(), true
 }
 
-func (j Json) Merge() Json {
-	done := make(map[string]bool)
+// unquoteHex decodes the four hex digits of a \u escape.
+func unquoteHex(s string) (rune, bool) {
+	if len(s) < 4 {
+		return 0, false
+	}
+	r, err := strconv.ParseUint(s[:4], 16, 32)
+	return rune(r), err == nil
+}
+
+func (j Json) Uglify() Json {
 	var o strings.Builder
 	o.Grow(len(j.s))
-	o.WriteString("{")
-	j.ForEach(func(i, v Json) bool {
-		v.ForEachKeyVal(func(k, v Json) bool {
-			if !done[k.String()] {
-				if o.Len() > 1 {
-					o.WriteString(",")
-				}
-				o.WriteString(k.String())
-				o.WriteString(`:`)
-				o.WriteString(v.String())
-				done[k.String()] = true
-			}
-			return false
-		})
-		return false
-	})
-	o.WriteString("}")
+	j.uglifyTo(&o)
 	return JSON(o.String())
 }
 
-func (j Json) Uglify() Json {
+func (j Json) uglifyTo(o writer) {
 	s := j.String()
-	var o strings.Builder
-	o.Grow(len(s))
 	for i := 0; i < len(s); i++ {
 		if s[i] > ' ' {
 			if s[i] == '"' {
@@ -2613,14 +5987,18 @@ func (j Json) Uglify() Json {
 			}
 		}
 	}
-	return JSON(o.String())
 }
 
 func (j Json) Prettify() Json {
+	var o strings.Builder
+	o.Grow(len(j.s) << 2)
+	j.prettifyTo(&o)
+	return JSON(o.String())
+}
+
+func (j Json) prettifyTo(o writer) {
 	pad := "    "
 	s := j.String()
-	var o strings.Builder
-	o.Grow(len(s) << 2)
 	depth := 0
 	for i := 0; i < len(s); i++ {
 		if s[i] > ' ' {
@@ -2675,69 +6053,474 @@ func (j Json) Prettify() Json {
 			}
 		}
 	}
-	return JSON(o.String())
+}
+
+// keyPath returns the path segment of an object key:
+// .key or ["key"] if the key is not an identifier.
+func keyPath(k Json) string {
+	if key := k.TrimQuote(); isIdent(key) {
+		return "." + key
+	}
+	return "[" + k.String() + "]"
+}
+
+// offsetOf returns the offset of sub inside s when sub
+// shares the memory of s; otherwise returns -1.
+func offsetOf(s, sub string) int {
+	if len(s) == 0 || len(sub) == 0 {
+		return -1
+	}
+	off := int(uintptr(unsafe.Pointer(unsafe.StringData(sub))) - uintptr(unsafe.Pointer(unsafe.StringData(s))))
+	if off < 0 || off+len(sub) > len(s) {
+		return -1
+	}
+	return off
+}
+
+func isIdent(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
 }
 
 func (j Json) Valid() bool {
-	return j.valid() && !j.s.More()
+	return j.Validate() == nil
 }
 
-func (j *Json) valid() bool {
-	for j.s.More() {
-		switch j.s.Curr() {
-		case ' ', '\t', '\n', '\r':
-		case '{':
-			j.s.Next()
-			for i := 0; j.s.WS() && j.s.More(); i++ {
-				if j.s.MatchByte('}') {
-					return true
-				}
-				if i > 0 && j.s.MatchByte(',') && j.s.WS() && !j.s.EqualByte('"') {
-					return false
-				}
-				if !j.s.UtilMatchString('"') {
-					return false
-				}
-				j.s.WS()
-				if !j.s.MatchByte(':') {
-					return false
-				}
-				if !j.valid() {
-					return false
-				}
+// Check is like Valid but returns a *SyntaxError
+// describing why the JSON is invalid.
+func Check(jsn string) error {
+	return JSON(jsn).Validate()
+}
+
+// Validate returns a *SyntaxError if the JSON is invalid.
+func (j Json) Validate() error {
+	v := validator{s: j.String()}
+	if v.ws(); v.valid() {
+		if v.ws(); v.i < len(v.s) {
+			v.fail("end of input")
+		}
+	}
+	if v.err != nil {
+		return v.err
+	}
+	return nil
+}
+
+// SyntaxError describes where and why a JSON is invalid.
+type SyntaxError struct {
+	Msg      string // Description of the error.
+	Offset   int    // Byte offset of the error.
+	Line     int    // Line of the error, starting at 1.
+	Column   int    // Column of the error in bytes, starting at 1.
+	Expected string // Expected token, like ", or }". Empty if the error is not about a missing token.
+	Snippet  string // Text around the error.
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("json: line %d, column %d: %s near %q", e.Line, e.Column, e.Msg, e.Snippet)
+}
+
+// validator is a strict RFC 8259 validator.
+type validator struct {
+	s   string
+	i   int
+	err *SyntaxError
+}
+
+func (v *validator) valid() bool {
+	if v.i >= len(v.s) {
+		return v.fail("a value")
+	}
+	switch c := v.s[v.i]; c {
+	case '{':
+		v.i++
+		if v.ws(); v.match('}') {
+			return true
+		}
+		for {
+			if v.i >= len(v.s) || v.s[v.i] != '"' {
+				return v.fail("a string key")
 			}
-			return false
-		case '[':
-			j.s.Next()
-			for i := 0; j.s.WS() && j.s.More(); i++ {
-				if j.s.MatchByte(']') {
-					return true
+			if !v.str() {
+				return false
+			}
+			if v.ws(); !v.match(':') {
+				return v.fail(":")
+			}
+			if v.ws(); !v.valid() {
+				return false
+			}
+			if v.ws(); v.match('}') {
+				return true
+			}
+			if !v.match(',') {
+				return v.fail(", or }")
+			}
+			v.ws()
+		}
+	case '[':
+		v.i++
+		if v.ws(); v.match(']') {
+			return true
+		}
+		for {
+			if !v.valid() {
+				return false
+			}
+			if v.ws(); v.match(']') {
+				return true
+			}
+			if !v.match(',') {
+				return v.fail(", or ]")
+			}
+			v.ws()
+		}
+	case '"':
+		return v.str()
+	case 't', 'f', 'n':
+		for _, w := range []string{"true", "false", "null"} {
+			if strings.HasPrefix(v.s[v.i:], w) {
+				v.i += len(w)
+				return true
+			}
+		}
+		return v.fail("a value")
+	case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return v.number()
+	}
+	return v.fail("a value")
+}
+
+func (v *validator) str() bool {
+	for v.i++; v.i < len(v.s); v.i++ {
+		switch c := v.s[v.i]; {
+		case c == '"':
+			v.i++
+			return true
+		case c < ' ':
+			return v.failf("control character %q in string", c)
+		case c == '\\':
+			if v.i++; v.i >= len(v.s) {
+				return v.fail(`"`)
+			}
+			switch e := v.s[v.i]; e {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				r, ok := v.hex()
+				if !ok {
+					return false
 				}
-				if i > 0 {
-					if !(j.s.MatchByte(',') && j.valid()) {
-						return false
+				if utf16.IsSurrogate(r) {
+					if !v.pair(r) {
+						return v.failf(`lone surrogate \u%04x`, r)
 					}
-				} else if !j.valid() {
-					return false
+					v.i += 6
 				}
+			default:
+				v.i--
+				return v.failf(`invalid escape \%c`, e)
+			}
+		}
+	}
+	return v.fail(`"`)
+}
+
+// hex matches the 4 hexadecimal digits after \u.
+func (v *validator) hex() (rune, bool) {
+	if v.i+4 < len(v.s) {
+		if r, err := strconv.ParseUint(v.s[v.i+1:v.i+5], 16, 32); err == nil {
+			v.i += 4
+			return rune(r), true
+		}
+	}
+	v.i--
+	return 0, v.failf(`invalid escape \u`)
+}
+
+// pair reports if the high surrogate r is followed by a low one.
+func (v *validator) pair(r rune) bool {
+	if r < 0xdc00 && v.i+6 < len(v.s) && strings.HasPrefix(v.s[v.i+1:], `\u`) {
+		r2, err := strconv.ParseUint(v.s[v.i+3:v.i+7], 16, 32)
+		if err == nil && r2 >= 0xdc00 && r2 <= 0xdfff {
+			return true
+		}
+	}
+	v.i -= 5 // Points the error to the backslash.
+	return false
+}
+
+func (v *validator) number() bool {
+	v.match('-')
+	if v.match('0') {
+		if v.digit() {
+			return v.failf("leading zero in number")
+		}
+	} else if !v.digits() {
+		return v.fail("a digit")
+	}
+	if v.match('.') && !v.digits() {
+		return v.fail("a digit")
+	}
+	if v.match('e') || v.match('E') {
+		if !v.match('+') {
+			v.match('-')
+		}
+		if !v.digits() {
+			return v.fail("a digit")
+		}
+	}
+	return true
+}
+
+func (v *validator) digits() bool {
+	ini := v.i
+	for v.digit() {
+		v.i++
+	}
+	return v.i > ini
+}
+
+func (v *validator) digit() bool {
+	return v.i < len(v.s) && v.s[v.i] >= '0' && v.s[v.i] <= '9'
+}
+
+func (v *validator) match(c byte) bool {
+	if v.i < len(v.s) && v.s[v.i] == c {
+		v.i++
+		return true
+	}
+	return false
+}
+
+func (v *validator) ws() {
+	for v.i < len(v.s) {
+		if c := v.s[v.i]; c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			return
+		}
+		v.i++
+	}
+}
+
+// fail sets an error of a missing token.
+func (v *validator) fail(expected string) bool {
+	found := "end of input"
+	if v.i < len(v.s) {
+		r, _ := utf8.DecodeRuneInString(v.s[v.i:])
+		found = strconv.QuoteRune(r)
+	}
+	v.failf("expected %s, found %s", expected, found)
+	v.err.Expected = expected
+	return false
+}
+
+func (v *validator) failf(format string, args ...any) bool {
+	ini, end := max(0, v.i-20), min(len(v.s), v.i+20)
+	for ini > 0 && !utf8.RuneStart(v.s[ini]) {
+		ini--
+	}
+	for end < len(v.s) && !utf8.RuneStart(v.s[end]) {
+		end++
+	}
+	v.err = &SyntaxError{
+		Msg:     fmt.Sprintf(format, args...),
+		Offset:  v.i,
+		Line:    1 + strings.Count(v.s[:v.i], "\n"),
+		Column:  v.i - strings.LastIndexByte(v.s[:v.i], '\n'),
+		Snippet: v.s[ini:end],
+	}
+	return false
+}
+
+// Index returns a structural index of j. The index records the
+// keys and values of an object or array of j the first time it is
+// accessed through the index, so later accesses don't scan it again:
+// key and index lookups are O(1) and sizes are known. Objects and
+// arrays smaller than 256 bytes are not indexed, since scanning them
+// is cheaper. Use Options.Index to share the index between queries.
+// With a DupKeys policy, the queries on j use an index of j resolved
+// by the policy, made once. Methods of Json, like Get and Keys, don't
+// use the index; use the methods of Index instead.
+func (j Json) Index() *Index {
+	j.s.WS()
+	return &Index{doc: j, nodes: map[int]*indexNode{}}
+}
+
+// Index is a structural index of a JSON document.
+// It is safe for concurrent use. See Json.Index.
+type Index struct {
+	doc   Json
+	mu    sync.RWMutex
+	nodes map[int]*indexNode   // By offset in doc.
+	dups  map[DupPolicy]*Index // Indexes of doc resolved by a DupKeys policy.
+}
+
+// indexNode is an indexed object or array.
+type indexNode struct {
+	len   int
+	keys  map[string]int // Position of the first value of a key. Nil for arrays.
+	names []Json
+	vals  []Json
+}
+
+// indexMinLen is the minimum length of an indexed object or array.
+const indexMinLen = 256
+
+// Json returns the indexed document.
+func (x *Index) Json() Json {
+	return x.doc
+}
+
+// Get is like j.Get, where j is the document or a part of it.
+func (x *Index) Get(j Json, keyOrIndex string) Json {
+	n := x.node(j)
+	if n == nil {
+		return j.Get(keyOrIndex)
+	}
+	if n.keys != nil {
+		if i, ok := n.keys[keyOrIndex]; ok {
+			return n.vals[i]
+		}
+		return JSON("")
+	}
+	if i, err := strconv.Atoi(keyOrIndex); err == nil && i >= 0 && i < len(n.vals) && strconv.Itoa(i) == keyOrIndex {
+		return n.vals[i]
+	}
+	return JSON("")
+}
+
+// Size is like j.Size, where j is the document or a part of it.
+func (x *Index) Size(j Json) Json {
+	if n := x.node(j); n != nil {
+		return JSON(strconv.Itoa(len(n.vals)))
+	}
+	return j.Size()
+}
+
+// Keys is like j.Keys, where j is the document or a part of it.
+func (x *Index) Keys(j Json) Json {
+	n := x.node(j)
+	if n == nil || n.keys == nil {
+		return j.Keys()
+	}
+	var o strings.Builder
+	o.WriteString("[")
+	for i, k := range n.names {
+		if i > 0 {
+			o.WriteString(",")
+		}
+		o.WriteString(k.String())
+	}
+	o.WriteString("]")
+	return JSON(o.String())
+}
+
+// Query is like Query on the indexed document, using the index.
+func (x *Index) Query(qry string) Json {
+	v, _ := x.doc.QueryContext(context.Background(), qry, Options{Index: x})
+	return v
+}
+
+// dedup returns the document resolved with the policy p and
+// its index, which is made on first use and shared by the
+// queries with the same policy.
+func (x *Index) dedup(p DupPolicy) (Json, *Index, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if y := x.dups[p]; y != nil {
+		return y.doc, y, nil
+	}
+	d, err := x.doc.Dedup(p)
+	if err != nil {
+		return d, x, err
+	}
+	y := x
+	if offsetOf(x.doc.String(), d.String()) != 0 {
+		y = d.Index()
+	}
+	if x.dups == nil {
+		x.dups = map[DupPolicy]*Index{}
+	}
+	x.dups[p] = y
+	return d, y, nil
+}
+
+// node returns the node of j, indexing it on first use. It returns
+// nil if j is not an object or array of the document, or is small.
+func (x *Index) node(j Json) *indexNode {
+	if x == nil || len(j.s) < indexMinLen || !j.IsObject() && !j.IsArray() {
+		return nil
+	}
+	off := offsetOf(x.doc.String(), j.String())
+	if off < 0 {
+		return nil
+	}
+	x.mu.RLock()
+	n := x.nodes[off]
+	x.mu.RUnlock()
+	if n == nil {
+		n = newIndexNode(j)
+		x.mu.Lock()
+		if m := x.nodes[off]; m != nil && m.len == n.len {
+			n = m // Indexed by another goroutine.
+		} else {
+			x.nodes[off] = n
+		}
+		x.mu.Unlock()
+	}
+	if n.len != len(j.s) {
+		return nil // j is a part of a value.
+	}
+	return n
+}
+
+func newIndexNode(j Json) *indexNode {
+	n := &indexNode{len: len(j.s)}
+	if j.IsObject() {
+		n.keys = map[string]int{}
+		j.ForEachKeyVal(func(k, v Json) bool {
+			if _, ok := n.keys[k.TrimQuote()]; !ok {
+				n.keys[k.TrimQuote()] = len(n.vals)
 			}
+			n.names = append(n.names, k)
+			n.vals = append(n.vals, v)
 			return false
-		case '"':
-			return j.s.UtilMatchString('"')
-		case 't':
-			return j.s.Match("true")
-		case 'f':
-			return j.s.Match("false")
-		case 'n':
-			return j.s.Match("null")
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '-':
-			return j.s.UtilMatchNumber()
-		default:
+		})
+	} else {
+		j.ForEach(func(i, v Json) bool {
+			n.vals = append(n.vals, v)
 			return false
+		})
+	}
+	return n
+}
+
+// slice is funcSlice of an indexed array.
+func (n *indexNode) slice(ini, end int) Json {
+	size := len(n.vals)
+	if ini < 0 {
+		ini = size + ini
+	}
+	if end < 0 {
+		end = size + end
+	}
+	if end == 0 || end > size {
+		end = size
+	}
+	var o strings.Builder
+	o.WriteString("[")
+	for i := max(ini, 0); i < end; i++ {
+		if i > max(ini, 0) {
+			o.WriteString(",")
 		}
-		j.s.Next()
+		o.WriteString(n.vals[i].String())
 	}
-	return false
+	o.WriteString("]")
+	return JSON(o.String())
 }
 
 // #endregion Json
@@ -1,10 +1,20 @@
 package jsqt
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"reflect"
+	"regexp"
+	"runtime/pprof"
+	"sort"
 	"strings"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func TestGet(t *testing.T) {
@@ -42,6 +52,67 @@ func TestGet(t *testing.T) {
 		{give: `[2,1,3]`, when: `(max)`, then: `3`},
 		{give: `[2]`, when: `(max)`, then: `2`},
 		{give: `[2]`, when: `(min)`, then: `2`},
+		// (type)
+		{give: `{}`, when: `(type)`, then: `"object"`},
+		{give: `[]`, when: `(type)`, then: `"array"`},
+		{give: `""`, when: `(type)`, then: `"string"`},
+		{give: `-3`, when: `(type)`, then: `"number"`},
+		{give: `false`, when: `(type)`, then: `"boolean"`},
+		{give: `null`, when: `(type)`, then: `"null"`},
+		{give: ``, when: `(type)`, then: ``},
+		{give: `{"a":[3,"3",null]}`, when: `(get a * (type))`, then: `["number","string","null"]`},
+		// (to-num)
+		{give: `"42"`, when: `(to-num)`, then: `42`},
+		{give: `" -1.5e3 "`, when: `(to-num)`, then: `-1.5e3`},
+		{give: `42`, when: `(to-num)`, then: `42`},
+		{give: `true`, when: `(to-num)`, then: `1`},
+		{give: `false`, when: `(to-num)`, then: `0`},
+		{give: `"042"`, when: `(to-num)`, then: ``},
+		{give: `"abc"`, when: `(to-num)`, then: ``},
+		{give: `"abc"`, when: `(to-num -n)`, then: `null`},
+		{give: `{}`, when: `(to-num -n)`, then: `null`},
+		{give: `{"a":"1","b":"x","c":"2"}`, when: `(iterate -v (to-num -n))`, then: `{"a":1,"b":null,"c":2}`},
+		// (to-int)
+		{give: `"2.5"`, when: `(to-int)`, then: `2`},
+		{give: `-2.5`, when: `(to-int)`, then: `-2`},
+		{give: `2.5`, when: `(to-int round)`, then: `3`},
+		{give: `-2.5`, when: `(to-int round)`, then: `-3`},
+		{give: `2.5`, when: `(to-int even)`, then: `2`},
+		{give: `2.1`, when: `(to-int ceil)`, then: `3`},
+		{give: `-2.1`, when: `(to-int floor)`, then: `-3`},
+		{give: `"9007199254740993"`, when: `(to-int)`, then: `9007199254740993`},
+		{give: `1e3`, when: `(to-int)`, then: `1000`},
+		{give: `-0.5`, when: `(to-int)`, then: `0`},
+		{give: `-0.5`, when: `(to-int round)`, then: `-1`},
+		{give: `-0.4`, when: `(to-int round)`, then: `0`},
+		{give: `1e300`, when: `(to-int round)`, then: `1` + strings.Repeat("0", 300)},
+		{give: `9007199254740993.7`, when: `(to-int floor)`, then: `9007199254740993`},
+		{give: `-9007199254740993.5`, when: `(to-int even)`, then: `-9007199254740994`},
+		{give: `1e99999`, when: `(to-int -n)`, then: `null`},
+		{give: `2.5`, when: `(to-int x)`, then: ``},
+		{give: `"x"`, when: `(to-int -n round)`, then: `null`},
+		// (to-str)
+		{give: `42`, when: `(to-str)`, then: `"42"`},
+		{give: `"a"`, when: `(to-str)`, then: `"a"`},
+		{give: `true`, when: `(to-str)`, then: `"true"`},
+		{give: `null`, when: `(to-str)`, then: `"null"`},
+		{give: `{"a":"b"}`, when: `(to-str)`, then: `"{\"a\":\"b\"}"`},
+		{give: ``, when: `(to-str)`, then: ``},
+		// (to-bool)
+		{give: `"true"`, when: `(to-bool)`, then: `true`},
+		{give: `"FALSE"`, when: `(to-bool)`, then: `false`},
+		{give: `"1"`, when: `(to-bool)`, then: `true`},
+		{give: `0`, when: `(to-bool)`, then: `false`},
+		{give: `0.5`, when: `(to-bool)`, then: `true`},
+		{give: `true`, when: `(to-bool)`, then: `true`},
+		{give: `"yes"`, when: `(to-bool)`, then: ``},
+		{give: `null`, when: `(to-bool -n)`, then: `null`},
+		// (to-arr)
+		{give: `3`, when: `(to-arr)`, then: `[3]`},
+		{give: `{"a":3}`, when: `(to-arr)`, then: `[{"a":3}]`},
+		{give: `[3]`, when: `(to-arr)`, then: `[3]`},
+		{give: `null`, when: `(to-arr)`, then: `[]`},
+		{give: ``, when: `(to-arr)`, then: ``},
 		// (valid)
 		{give: ``, when: `(valid)`, then: ``},
 		{give: `{"a":[3,{"a":}]}`, when: `(valid a)`, then: ``},
@@ -57,6 +128,9 @@ func TestGet(t *testing.T) {
 		{give: `{"a":[{"b":"c"},null,false,true,{},[3,1.2,01]]}`, when: `(valid)`, then: ``},
 		{give: `{"a":[{"b":"c"},null,false,true,{},[3,1.2,x]]}`, when: `(valid)`, then: ``},
 		{give: `{"a":[{"b":"c"},null,false,true,{},[3,1.2,null]]}`, when: `(valid)`, then: `{"a":[{"b":"c"},null,false,true,{},[3,1.2,null]]}`},
+		// (dup-keys)
+		{give: `{"a":1,"b":{"c":1,"c":2,"c":3},"a":2,"d":[{"x":1,"x":2}],"e f":{"g":1,"g":2}}`, when: `(dup-keys)`, then: `[".b.c",".a",".d[0].x","[\"e f\"].g"]`},
+		{give: `{"a":1}`, when: `(dup-keys)`, then: `[]`},
 		{give: `{"a":[{"b":"c"},null,false,true,{},[]]}`, when: `(valid)`, then: `{"a":[{"b":"c"},null,false,true,{},[]]}`},
 		{give: `{"a":[{},[]]}`, when: `(valid)`, then: `{"a":[{},[]]}`},
 		{give: `{"a":[,""]}`, when: `(valid)`, then: ``},
@@ -116,7 +190,9 @@ func TestGet(t *testing.T) {
 		{give: `{"a":3,"b":[4,5]}`, when: `(unwind b -r x)`, then: `[{"a":3,"x":4},{"a":3,"x":5}]`},
 		{give: `{"a":3,"b":[4,5]}`, when: `(unwind b)`, then: `[{"a":3,"b":4},{"a":3,"b":5}]`},
 		// (expr)
-		{give: ``, when: `(expr 1 + 2 ? 3)`, then: `3`},
+		{give: ``, when: `(expr 1 + 2 @ 3)`, then: `3`},
+		{give: ``, when: `(expr 1 + 2 ? 4)`, then: `4`},
+		{give: ``, when: `(expr 1 - 1 ? 4)`, then: ``},
 		{give: ``, when: `(expr -4 * -5 + -(raw 1) - -2 + -3)`, then: `18`},
 		{give: `{"a":3}`, when: `(expr 4 * (expr 5 + (get a)))`, then: `32`},
 		{give: `{"a":3}`, when: `(expr 4 * 5 + (get a))`, then: `23`},
@@ -139,6 +215,194 @@ func TestGet(t *testing.T) {
 		{give: ``, when: `(expr 3 * 4)`, then: `12`},
 		{give: ``, when: `(expr 3 + 4)`, then: `7`},
 		{give: ``, when: `(expr 3)`, then: `3`},
+		{give: ``, when: `(expr (1 + 2) * 3)`, then: `9`},
+		{give: ``, when: `(expr ((1 + 2) * (3 + 1)) / 2)`, then: `6`},
+		{give: ``, when: `(expr 8 / 2 / 2)`, then: `2`},
+		{give: ``, when: `(expr 2 ** 3 ** 2)`, then: `512`},
+		{give: ``, when: `(expr -2 ** 2)`, then: `-4`},
+		{give: ``, when: `(expr 2 ** -1)`, then: `0.5`},
+		{give: ``, when: `(expr !0)`, then: `true`},
+		{give: ``, when: `(expr !(1 < 2))`, then: `false`},
+		{give: ``, when: `(expr 1 + 2 * 3 == 7)`, then: `true`},
+		{give: ``, when: `(expr 1 != 1.0)`, then: `false`},
+		{give: ``, when: `(expr 3 >= 3 && 2 < 1)`, then: `false`},
+		{give: ``, when: `(expr 3 >= 3 || 2 < 1)`, then: `true`},
+		{give: ``, when: `(expr 0 || "")`, then: `false`},
+		{give: `{"a":0}`, when: `(expr a != 0 && 10 / a > 1)`, then: `false`},
+		{give: `{"a":0}`, when: `(expr a == 0 || 10 / a > 1)`, then: `true`},
+		{give: `{"a":5}`, when: `(expr a > 3 ? "big" : "small")`, then: `"big"`},
+		{give: `{"a":1}`, when: `(expr a > 3 ? "big" : "small")`, then: `"small"`},
+		{give: `{"a":1}`, when: `(expr a > 3 ? "big" : a > 0 ? "some" : "none")`, then: `"some"`},
+		{give: `{"a":0}`, when: `(expr a ? 10 / a : -1)`, then: `-1`},
+		{give: `{"a":0}`, when: `(expr a ? 1 : 10 / a)`, then: `+Inf`},
+		{give: `{"a":0}`, when: `(expr a ? (upsert b 1) : (this))`, then: `{"a":0}`},
+		{give: `{"a":0}`, when: `(expr a && b.c || (this))`, then: `true`},
+		{give: `{"a":5}`, when: `(expr (a) + 1)`, then: `6`},
+		{give: `{"a":5}`, when: `(expr ((a)) * (a))`, then: `25`},
+		{give: `{"a":5}`, when: `(expr (size) + (a))`, then: `6`},
+		{give: `{"a":"x","b":"x"}`, when: `(expr a == b)`, then: `true`},
+		{give: `{"a":"x"}`, when: `(expr a == "x")`, then: `true`},
+		{give: `{"a":9007199254740993}`, when: `(expr a == 9007199254740992)`, then: `false`},
+		{give: `{"a":{"b":3}}`, when: `(expr (get a b) * 2)`, then: `6`},
+		{give: `{"a":[1,2,3]}`, when: `(expr (get a (size)) + 1)`, then: `4`},
+		{give: `[1,2,3]`, when: `(expr (size) - 1)`, then: `2`},
+		{give: `{"a":3}`, when: `(with {x: a} (expr ($x + 1) * 2))`, then: `8`},
+		{give: ``, when: `(expr abs(-3))`, then: `3`},
+		{give: ``, when: `(expr round(2.5))`, then: `3`},
+		{give: ``, when: `(expr round(-2.5))`, then: `-3`},
+		{give: ``, when: `(expr round(3.14159, 2))`, then: `3.14`},
+		{give: ``, when: `(expr floor(-2.5))`, then: `-3`},
+		{give: ``, when: `(expr ceil(2.1))`, then: `3`},
+		{give: ``, when: `(expr sqrt(16))`, then: `4`},
+		{give: ``, when: `(expr pow(2, 10))`, then: `1024`},
+		{give: ``, when: `(expr log(1))`, then: `0`},
+		{give: ``, when: `(expr min(3, 1, 2) + max(3, 1, 2))`, then: `4`},
+		{give: `{"a":-4}`, when: `(expr abs(a) * 2)`, then: `8`},
+		{give: ``, when: `(expr sqrt(-1))`, then: `NaN`},
+		{give: ``, when: `(expr 1 / 0)`, then: `+Inf`},
+		{give: ``, when: `(expr -1 / 0)`, then: `-Inf`},
+		{give: ``, when: `(expr 0 / 0)`, then: `NaN`},
+		{give: ``, when: `(expr 1 % 0)`, then: `NaN`},
+		{give: ``, when: `(expr 1 / 0 + 1)`, then: `+Inf`},
+		{give: ``, when: `(expr -d sqrt(-1))`, then: ``},
+		{give: ``, when: `(expr abs(1, 2))`, then: ``},
+		{give: ``, when: `(expr nope(1))`, then: ``},
+		{give: ``, when: `(expr 1 +)`, then: ``},
+		{give: ``, when: `(expr true)`, then: `true`},
+		{give: ``, when: `(expr -d 2 ** 100)`, then: `1267650600228229401496703205376`},
+		{give: ``, when: `(expr -d 2 ** -2)`, then: `0.25`},
+		{give: ``, when: `(expr -d 0.1 + 0.2 == 0.3)`, then: `true`},
+		{give: ``, when: `(expr -d round(1 / 3, 4))`, then: `0.3333`},
+		{give: ``, when: `(expr -d 0 ** -1)`, then: ``},
+		{give: ``, when: `(expr 10 / 3)`, then: `3.3333333333333335`},
+		{give: ``, when: `(expr -i 10 / 3)`, then: `3`},
+		{give: ``, when: `(expr -i -7 / 2)`, then: `-3`},
+		{give: ``, when: `(expr -i -7 // 2)`, then: `-4`},
+		{give: ``, when: `(expr -i -7 % 2)`, then: `-1`},
+		{give: ``, when: `(expr 7 // 2)`, then: `3`},
+		{give: ``, when: `(expr -7.5 // 2)`, then: `-4`},
+		{give: ``, when: `(expr -d 7.5 // 2)`, then: `3`},
+		{give: ``, when: `(expr -i 9223372036854775807)`, then: `9223372036854775807`},
+		{give: ``, when: `(expr -i 9223372036854775807 + 1)`, then: ``},
+		{give: ``, when: `(expr -i -9223372036854775807 - 2)`, then: ``},
+		{give: ``, when: `(expr -i 4294967296 * 4294967296)`, then: ``},
+		{give: ``, when: `(expr -i 2 ** 62)`, then: `4611686018427387904`},
+		{give: ``, when: `(expr -i 2 ** 63)`, then: ``},
+		{give: ``, when: `(expr -i 2 ** -1)`, then: ``},
+		{give: ``, when: `(expr -i 2.5 * 2)`, then: ``},
+		{give: ``, when: `(expr -i 1 / 0)`, then: ``},
+		{give: ``, when: `(expr -i sqrt(16))`, then: `4`},
+		{give: ``, when: `(expr -i sqrt(2))`, then: ``},
+		{give: `{"a":"x"}`, when: `(expr -i a + 1)`, then: ``},
+		{give: `{"a":9007199254740993}`, when: `(expr -i a + 1)`, then: `9007199254740994`},
+		{give: ``, when: `(expr 6 & 3)`, then: `2`},
+		{give: ``, when: `(expr 6 | 3)`, then: `7`},
+		{give: ``, when: `(expr 6 ^ 3)`, then: `5`},
+		{give: ``, when: `(expr 1 << 4)`, then: `16`},
+		{give: ``, when: `(expr -16 >> 2)`, then: `-4`},
+		{give: ``, when: `(expr 1 << 64)`, then: ``},
+		{give: ``, when: `(expr 1 << -1)`, then: ``},
+		{give: ``, when: `(expr -i 1 << 63)`, then: ``},
+		{give: ``, when: `(expr 1.5 & 1)`, then: ``},
+		{give: ``, when: `(expr 1 | 2 ^ 3 & 4)`, then: `3`},
+		{give: ``, when: `(expr 1 + 1 << 2)`, then: `8`},
+		{give: ``, when: `(expr (5 & 4) == 4 && 1 < 2)`, then: `true`},
+		{give: `{"perm":5}`, when: `(expr -i (perm & 4) != 0)`, then: `true`},
+		// (base64-encode) (base64-decode) (hex) (url-encode) (url-decode) (html-escape)
+		{give: `"héllo"`, when: `(base64-encode)`, then: `"aMOpbGxv"`},
+		{give: `"\u00e9"`, when: `(base64-encode)`, then: `"w6k="`},
+		{give: `"\u00e9"`, when: `(base64-encode -u)`, then: `"w6k"`},
+		{give: `3`, when: `(base64-encode)`, then: `"Mw=="`},
+		{give: `{"b":1, "a":2}`, when: `(base64-encode -j)`, then: `"eyJhIjoyLCJiIjoxfQ=="`},
+		{give: `{"a":1}`, when: `(base64-encode)`, then: ``},
+		{give: `"aMOpbGxv"`, when: `(base64-decode)`, then: `"héllo"`},
+		{give: `"w6k="`, when: `(base64-decode)`, then: `"é"`},
+		{give: `"w6k"`, when: `(base64-decode)`, then: `"é"`},
+		{give: `"Pz8-"`, when: `(base64-decode)`, then: `"??>"`},
+		{give: `"Pz8+"`, when: `(base64-decode)`, then: `"??>"`},
+		{give: `"eyJhIjoyLCJiIjoxfQ=="`, when: `(base64-decode -j)`, then: `{"a":2,"b":1}`},
+		{give: `"aGk="`, when: `(base64-decode -j)`, then: ``},
+		{give: `"!!"`, when: `(base64-decode)`, then: ``},
+		{give: `"/w=="`, when: `(base64-decode)`, then: ``},
+		{give: `3`, when: `(base64-decode)`, then: ``},
+		{give: `"hé"`, when: `(hex)`, then: `"68c3a9"`},
+		{give: `[1]`, when: `(hex -j)`, then: `"5b315d"`},
+		{give: `"a b&c=d/é"`, when: `(url-encode)`, then: `"a+b%26c%3Dd%2F%C3%A9"`},
+		{give: `"a+b%26c%3Dd%2F%C3%A9"`, when: `(url-decode)`, then: `"a b&c=d/é"`},
+		{give: `"%zz"`, when: `(url-decode)`, then: ``},
+		{give: `"<a href=\"x\">&'</a>"`, when: `(html-escape)`, then: `"&lt;a href=&#34;x&#34;&gt;&amp;&#39;&lt;/a&gt;"`},
+		// (sha256) (sha1) (md5) (crc32) (uuid-v5)
+		{give: `"hello"`, when: `(sha256)`, then: `"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`},
+		{give: `"hello"`, when: `(sha1)`, then: `"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"`},
+		{give: `"hello"`, when: `(md5)`, then: `"5d41402abc4b2a76b9719d911017c592"`},
+		{give: `"hello"`, when: `(crc32)`, then: `"3610a686"`},
+		{give: `"h\u0065llo"`, when: `(md5)`, then: `"5d41402abc4b2a76b9719d911017c592"`},
+		{give: `3`, when: `(sha256)`, then: `"4e07408562bedb8b60ce05c1decfe3ad16b72230967de01f640b7e4729b49fce"`},
+		{give: `{"b": [2, "\u0078"], "a": 1}`, when: `(sha256 -j)`, then: `"454597f51f0e5988dd7d0864f82e826d91fd43ed815a21bb06cd7181e8547a2f"`},
+		{give: `{"a":1}`, when: `(sha256)`, then: ``},
+		{give: ``, when: `(sha256 -j)`, then: ``},
+		{give: `"example.com"`, when: `(uuid-v5 dns)`, then: `"cfbff0d1-9375-5685-968c-48ce8b15ae17"`},
+		{give: `"example.com"`, when: `(uuid-v5 6ba7b810-9dad-11d1-80b4-00c04fd430c8)`, then: `"cfbff0d1-9375-5685-968c-48ce8b15ae17"`},
+		{give: `{"b":[2,"x"],"a":1}`, when: `(uuid-v5 -j url)`, then: `"fd80a924-9072-5778-8ba2-35e99dcb5dab"`},
+		{give: `"example.com"`, when: `(uuid-v5 nope)`, then: ``},
+		{give: `[{"id":"a"},{"id":"b"}]`, when: `(collect (obj id id key (get id (sha1))))`, then: `[{"id":"a","key":"86f7e437faa5a7fce15d1ddcb9eaeaea377667b8"},{"id":"b","key":"e9d71f5ee7c92d6dc9e92ffdad17b8bd49418f98"}]`},
+		// (to-csv)
+		{give: `[{"a":1,"b":"x"},{"a":2,"b":"y, \"z\""}]`, when: `(to-csv)`, then: `"a,b\r\n1,x\r\n2,\"y, \"\"z\"\"\"\r\n"`},
+		{give: `[{"a":1,"b":"x"},{"b":"y","c":null}]`, when: `(to-csv)`, then: `"a,b\r\n1,x\r\n,y\r\n"`},
+		{give: `[{"a":1,"b":"x"},{"b":"y","c":[3]}]`, when: `(to-csv -u)`, then: `"a,b,c\r\n1,x,\r\n,y,[3]\r\n"`},
+		{give: `[{"a":1,"b":"x"},{"b":"y","c":true}]`, when: `(to-csv -cols c a)`, then: `"c,a\r\n,1\r\ntrue,\r\n"`},
+		{give: `[{"a":1,"b":"x"}]`, when: `(to-csv -cols b a -sep ;)`, then: `"b;a\r\nx;1\r\n"`},
+		{give: `[{"a":1,"b":"x"}]`, when: `(to-csv -sep "\t")`, then: `"a\tb\r\n1\tx\r\n"`},
+		{give: `[[1,"a b"],[2,"é"]]`, when: `(to-csv)`, then: `"1,a b\r\n2,é\r\n"`},
+		{give: `[[1,2]]`, when: `(to-csv -cols x y)`, then: `"x,y\r\n1,2\r\n"`},
+		{give: `[{"a":"1\n2"}]`, when: `(to-csv)`, then: `"a\r\n\"1\r\n2\"\r\n"`},
+		{give: `[]`, when: `(to-csv)`, then: `""`},
+		{give: `{"a":1}`, when: `(to-csv)`, then: ``},
+		{give: `[{"a":1}]`, when: `(to-csv -sep ,,)`, then: ``},
+		// (strict)
+		{give: "{\n  // c\n  a: [1, 'x',], /* d */\n}", when: `(strict)`, then: "{\n  \"a\": [1, \"x\"]\n}"},
+		{give: "{a: 1, /* c */ b: {c: .5,}}", when: `(strict) (get b c)`, then: `0.5`},
+		{give: `{"a":1}`, when: `(get a) (strict)`, then: `1`},
+		{give: `{a: NaN}`, when: `(strict)`, then: ``},
+		// (has-bit) (set-bit)
+		{give: `5`, when: `(has-bit 2)`, then: `5`},
+		{give: `5`, when: `(has-bit 1)`, then: ``},
+		{give: `-1`, when: `(has-bit 63)`, then: `-1`},
+		{give: `5`, when: `(has-bit 64)`, then: ``},
+		{give: `5.5`, when: `(has-bit 0)`, then: ``},
+		{give: `"5"`, when: `(has-bit 0)`, then: ``},
+		{give: `5`, when: `(set-bit 1)`, then: `7`},
+		{give: `5`, when: `(set-bit 0)`, then: `5`},
+		{give: `0`, when: `(set-bit 63)`, then: `-9223372036854775808`},
+		{give: `5`, when: `(set-bit -1)`, then: ``},
+		{give: `{"a":1,"b":3}`, when: `(with {b: b} (get a (set-bit $b)))`, then: `9`},
+		{give: `[1,6,4,3]`, when: `(collect (has-bit 2))`, then: `[6,4]`},
+		{give: ``, when: `(expr 0.1 + 0.2)`, then: `0.30000000000000004`},
+		{give: ``, when: `(expr -d 0.1 + 0.2)`, then: `0.3`},
+		{give: ``, when: `(expr -d 9007199254740993 + 1)`, then: `9007199254740994`},
+		{give: ``, when: `(expr -d 1 / 3)`, then: `0.3333333333333333333333333333333333`},
+		{give: ``, when: `(expr -d 1 / 8)`, then: `0.125`},
+		{give: ``, when: `(expr -d -s 2 1 / 8)`, then: `0.13`},
+		{give: ``, when: `(expr -d -s 2 -r half-even 1 / 8)`, then: `0.12`},
+		{give: ``, when: `(expr -d -s 2 -r half-down 1 / 8)`, then: `0.12`},
+		{give: ``, when: `(expr -d -s 100000000 1 / 4) (to-str) (len)`, then: `10002`},
+		{give: ``, when: `(expr -d round(1 / 3, 100000000)) (to-str) (len)`, then: `10002`},
+		{give: ``, when: `(expr -d -s 2 -r down 2 / 3)`, then: `0.66`},
+		{give: ``, when: `(expr -d -s 2 -r up 1 / 3)`, then: `0.34`},
+		{give: ``, when: `(expr -d -s 0 -r floor -5 / 2)`, then: `-3`},
+		{give: ``, when: `(expr -d -s 0 -r ceil -5 / 2)`, then: `-2`},
+		{give: ``, when: `(expr -d -s 0 -5 / 2)`, then: `-3`},
+		{give: ``, when: `(expr -d -s 3 2)`, then: `2.000`},
+		{give: ``, when: `(expr -d -4 * -5 + -(raw 1) - -2 + -3)`, then: `18`},
+		{give: ``, when: `(expr -d 8 / 2 / 2)`, then: `2`},
+		{give: ``, when: `(expr -d 7.5 % 2)`, then: `1.5`},
+		{give: ``, when: `(expr -d -7 % 2)`, then: `-1`},
+		{give: ``, when: `(expr -d 1e-3 * 2E2)`, then: `0.2`},
+		{give: `{"a":19.99,"b":3}`, when: `(expr -d (get a) * (get b))`, then: `59.97`},
+		{give: ``, when: `(expr -d 1 / 0)`, then: ``},
+		{give: ``, when: `(expr -d 1 % 0)`, then: ``},
+		{give: ``, when: `(expr -d 1 + a)`, then: ``},
+		{give: ``, when: `(expr -d 1e99999 + 1)`, then: ``},
 		// (at)
 		{give: `[3,4]`, when: `(at (raw 1))`, then: `4`},
 		{give: `[3,4]`, when: `(at 0)`, then: `3`},
@@ -270,6 +534,75 @@ func TestGet(t *testing.T) {
 		{give: `{"a":3}`, when: `(iterate -k (key))`, then: `{"a":3}`},
 		{give: `{"a":3}`, when: `(iterate -v (val))`, then: `{"a":3}`},
 		{give: `{"a":3}`, when: `(iterate -kv (concat (key) (val)))`, then: `{"aa":"33"}`},
+		// (date-x)
+		{give: `"07/09/2022 12:30"`, when: `(date-parse "01/02/2006 15:04")`, then: `"2022-07-09T12:30:00Z"`},
+		{give: `"2022-09-07 12:30:00"`, when: `(date-parse "%Y-%m-%d %H:%M:%S")`, then: `"2022-09-07T12:30:00Z"`},
+		{give: `"Wed, 07 Sep 2022 12:30:00 GMT"`, when: `(date-parse RFC1123)`, then: `"2022-09-07T12:30:00Z"`},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-parse RFC3339)`, then: `"2022-09-07T12:30:00Z"`},
+		{give: `"x"`, when: `(date-parse RFC3339)`, then: ``},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-format RFC1123)`, then: `"Wed, 07 Sep 2022 12:30:00 UTC"`},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-format "%d/%m/%Y %%")`, then: `"07/09/2022 %"`},
+		{give: `"2022-09-07T12:30:00.123Z"`, when: `(date-format "%H:%M:%S.%L")`, then: `"12:30:00.123"`},
+		{give: `"2022-09-07T12:30:00.123456Z"`, when: `(date-format "%H:%M:%S.%f")`, then: `"12:30:00.123456"`},
+		{give: `"2022-09-07T12:30:00.123456Z"`, when: `(date-format "%H%M%S%f")`, then: `"123000123456"`},
+		{give: `"2022-09-07T12:30:00.5Z"`, when: `(date-format "%S%f|%f")`, then: `"00500000|500000"`},
+		{give: `"2022-09-07 12:30:00.123456"`, when: `(date-parse "%Y-%m-%d %H:%M:%S.%f")`, then: `"2022-09-07T12:30:00.123456Z"`},
+		{give: `"20220907123000123456"`, when: `(date-parse "%Y%m%d%H%M%S%f")`, then: `"2022-09-07T12:30:00.123456Z"`},
+		{give: `"12:30:00 5 UTC"`, when: `(date-parse "%H:%M:%S %f %Z")`, then: `"0000-01-01T12:30:00.5Z"`},
+		{give: `"12:30:00 x"`, when: `(date-parse "%H:%M:%S %f")`, then: ``},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-format "Jan 2, 2006")`, then: `"Sep 7, 2022"`},
+		{give: `3`, when: `(date-format RFC1123)`, then: ``},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-add 1d2h)`, then: `"2022-09-08T14:30:00Z"`},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-add -1y1mo1w)`, then: `"2021-07-31T12:30:00Z"`},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-add 90m)`, then: `"2022-09-07T14:00:00Z"`},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-add 1.5d)`, then: ``},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-add x)`, then: ``},
+		{give: `{"a":"2022-09-08T12:30:00Z","b":"2022-09-07T00:30:00Z"}`, when: `(with {b: b} a (date-diff h $b))`, then: `36`},
+		{give: `{"a":"2022-09-08T12:30:00Z","b":"2022-09-07T00:30:00Z"}`, when: `(get a (date-diff d (get (root) b)))`, then: `1.5`},
+		{give: `{"a":"2022-09-08T12:30:00Z","b":"2022-09-07T00:30:00Z"}`, when: `(get b (date-diff s (raw "2022-09-07T00:30:10Z")))`, then: `-10`},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-diff x (this))`, then: ``},
+		{give: `"2022-09-07T12:30:45.5+02:00"`, when: `(date-trunc year)`, then: `"2022-01-01T00:00:00+02:00"`},
+		{give: `"2022-09-07T12:30:45.5+02:00"`, when: `(date-trunc month)`, then: `"2022-09-01T00:00:00+02:00"`},
+		{give: `"2022-09-07T12:30:45.5+02:00"`, when: `(date-trunc day)`, then: `"2022-09-07T00:00:00+02:00"`},
+		{give: `"2022-09-07T12:30:45.5+02:00"`, when: `(date-trunc hour)`, then: `"2022-09-07T12:00:00+02:00"`},
+		{give: `"2022-09-07T12:30:45.5+02:00"`, when: `(date-trunc minute)`, then: `"2022-09-07T12:30:00+02:00"`},
+		{give: `"2022-09-07T12:30:45.5+02:00"`, when: `(date-trunc second)`, then: `"2022-09-07T12:30:45+02:00"`},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-tz -03:00)`, then: `"2022-09-07T09:30:00-03:00"`},
+		{give: `"2022-09-07T12:30:00+02:00"`, when: `(date-tz UTC)`, then: `"2022-09-07T10:30:00Z"`},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-tz Nowhere/Land)`, then: ``},
+		{give: `"2022-09-07T12:30:00Z"`, when: `(date-unix)`, then: `1662553800`},
+		{give: `"2022-09-07T12:30:00.5Z"`, when: `(date-unix -ms)`, then: `1662553800500`},
+		{give: `1662553800`, when: `(date-from-unix)`, then: `"2022-09-07T12:30:00Z"`},
+		{give: `1662553800.5`, when: `(date-from-unix)`, then: `"2022-09-07T12:30:00.5Z"`},
+		{give: `1662553800500`, when: `(date-from-unix -ms)`, then: `"2022-09-07T12:30:00.5Z"`},
+		{give: `"x"`, when: `(date-from-unix)`, then: ``},
+		// (try) (assert) (error)
+		{give: `{"a":3}`, when: `(try (get a (assert (is-str) "not a string")) (raw 0))`, then: `0`},
+		{give: `{"a":3}`, when: `(try (get a (assert (is-num) "not a number")) (raw 0))`, then: `3`},
+		{give: `{"a":3}`, when: `(try (error oops) $error)`, then: `".: oops"`},
+		{give: `{"a":3}`, when: `(try (error oops))`, then: ``},
+		{give: `{"a":3}`, when: `(try a (raw 0))`, then: `3`},
+		{give: `[1,"x",3]`, when: `(collect (try (assert (is-num)) (raw 0)))`, then: `[1,0,3]`},
+		{give: `{"a":3}`, when: `(arr (try (error x) (raw 1)) a)`, then: `[1,3]`},
+		{give: `{"a":3}`, when: `(assert (is-str a))`, then: ``},
+		{give: `{"a":3}`, when: `(error)`, then: ``},
+		// (let) (with)
+		{give: `{"a":3}`, when: `(let x a (arr $x $x))`, then: `[3,3]`},
+		{give: `{"a":3}`, when: `(let x (get a) (obj v $x))`, then: `{"v":3}`},
+		{give: `{"a":3}`, when: `(let x a) (arr $x)`, then: `[]`},
+		{give: `{"$x":3}`, when: `(get $x)`, then: `3`},
+		{give: `{"$x":3,"a":4}`, when: `(let y a (arr $x $y))`, then: `[3,4]`},
+		{give: `{"a":3}`, when: `(let x a (let x (raw 4) (arr $x)))`, then: `[4]`},
+		{give: `{"a":3}`, when: `(let x a (arr (let x (raw 4) (this)) $x))`, then: `[{"a":3},3]`},
+		{give: `[{"id":1,"v":[3,4]},{"id":2,"v":[5]}]`, when: `(collect (let id id v (collect (arr $id (this)))))`, then: `[[[1,3],[1,4]],[[2,5]]]`},
+		{give: `[[3,4],[5]]`, when: `(get * (let i (key) * (obj i $i j (key))))`, then: `[[{"i":0,"j":0},{"i":0,"j":1}],[{"i":1,"j":0}]]`},
+		{give: `{"a":{"b":3}}`, when: `(iterate -c (let k (key) (if (is-num) (arr $k (val)) (nothing))))`, then: `[["b",3]]`},
+		{give: `{"a":3,"b":4}`, when: `(with {x: a, y: (get b)} (arr $y $x))`, then: `[4,3]`},
+		{give: `{"a":3,"b":4}`, when: `(with {x: a, y: $x} (arr $x $y))`, then: `[3,3]`},
+		{give: `{"a":3,"b":4}`, when: `(with {x: a,y: b} (expr $x + $y))`, then: `7`},
+		{give: `{"a b":3}`, when: `(with {x: "a b"} (arr $x))`, then: `[3]`},
+		{give: `[1,2,3]`, when: `(with {n: (size)} (collect (expr (this) / $n)))`, then: `[0.3333333333333333,0.6666666666666666,1]`},
+		{give: `{"a":[1,2],"b":10}`, when: `(let b b a (collect (expr (this) * $b)))`, then: `[10,20]`},
 		// (save) (load)
 		{give: `{"a":3,"b":4}`, when: `(save -k a b c -v (raw 7)) (obj x (load a) y (load b) z (load c)`, then: `{"x":3,"y":4,"z":7}`},
 		{give: `{"a":3}`, when: `(save (get a)) (arr (load))`, then: `[3]`},
@@ -353,13 +686,106 @@ func TestGet(t *testing.T) {
 		{give: `{"a":"x","b":3,"c":true,"d":null,"e":{},"f":[],"g":{"h": 4},"i":false}`, when: `(concat a b c d e f g i)`, then: `"x3truenullfalse"`},
 		{give: `{ "a": "hello" }`, when: `(concat a (raw " \"world\""))`, then: `"hello \"world\""`},
 		{give: `{ "a": "hello", "b": "world" }`, when: `(concat a (raw " ") b)`, then: `"hello world"`},
+		// (fmt)
+		{give: `{"name":"Ann","items":[3,4]}`, when: `(fmt "Hello {name}, you have {items (size)} items")`, then: `"Hello Ann, you have 2 items"`},
+		{give: `{"a":{"b":[3]},"c":null,"d":true}`, when: `(fmt "{a} {a b} {c} {d} {x}")`, then: `"{\"b\":[3]} [3] null true "`},
+		{give: `{"a":"x\"y"}`, when: `(fmt "{a} {a:%j} {a:%q}")`, then: `"x\"y \"x\\\"y\" \"x\\\"y\""`},
+		{give: `{"p":3.14159,"n":42,"s":"ab"}`, when: `(fmt "{p:%.2f}|{n:%05d}|{n:%x}|{s:%-4s}|{s:%4s}|{n:%v}")`, then: `"3.14|00042|2a|ab  |  ab|42"`},
+		{give: `{"p":3.7}`, when: `(fmt "{p:%d}")`, then: `"3"`},
+		{give: `{"a":3}`, when: `(fmt "{{a}} {a} }}")`, then: `"{a} 3 }"`},
+		{give: `{"a b":3}`, when: `(fmt "{(get \"a b\")}")`, then: `"3"`},
+		{give: `{"a":[1,2,3]}`, when: `(fmt "{a (collect (expr (this) * 2)):%j}")`, then: `"[2,4,6]"`},
+		{give: `{"a":3}`, when: `(let x a (fmt "x={$x}"))`, then: `"x=3"`},
+		{give: `[{"n":"a"},{"n":"b"}]`, when: `(collect (fmt "#{(key)} {n}"))`, then: `["#0 a","#1 b"]`},
 		//(replace)
 		{give: `"a b"`, when: `(replace " " ")`, then: `"a"b"`}, // Invalid second param. This tests a crash protection.
 		{give: `"a b"`, when: `(replace " " "_")`, then: `"a_b"`},
+		{give: `"2022-09-07"`, when: `(replace -r "(\d+)-(\d+)-(\d+)" "$3/$2/$1")`, then: `"07/09/2022"`},
+		{give: `"2022-09-07"`, when: `(replace -r "(?P<y>\d+)-(?P<m>\d+)-(?P<d>\d+)" "${d}.${m}.${y}")`, then: `"07.09.2022"`},
+		{give: `"a\"b\"c"`, when: `(replace -r "\"" ')`, then: `"a'b'c"`},
+		{give: `"aaa"`, when: `(replace -r "a+" (raw "b"))`, then: `"b"`},
+		{give: `"aaa"`, when: `(replace -r "(" b)`, then: `"aaa"`},
+		{give: `3`, when: `(replace -r 3 b)`, then: `3`},
+		// (capture)
+		{give: `"2022-09-07"`, when: `(capture "(?P<y>\d+)-(?P<m>\d+)-(\d+)")`, then: `{"y":"2022","m":"09"}`},
+		{give: `"2022-09-07"`, when: `(capture "(\d+)-(\d+)")`, then: `["2022","09"]`},
+		{give: `"2022-09-07"`, when: `(capture "\d+")`, then: `["2022"]`},
+		{give: `"2022-09-07"`, when: `(capture "x")`, then: ``},
+		{give: `3`, when: `(capture "3")`, then: ``},
+		// (scan)
+		{give: `"a1 b22 c333"`, when: `(scan "\d+")`, then: `["1","22","333"]`},
+		{give: `"abc"`, when: `(scan "\d+")`, then: `[]`},
+		{give: `"a\u0007"`, when: `(scan .)`, then: `["a","\u0007"]`},
+		{give: `["a1","b2"]`, when: `(collect (scan "\d"))`, then: `[["1"],["2"]]`},
 		// (upper)
 		{give: `"a"`, when: `(upper)`, then: `"A"`},
+		{give: `"a\nb\u00e9"`, when: `(upper)`, then: `"A\nBÉ"`},
+		{give: `"a\/b"`, when: `(upper)`, then: `"A/B"`},
+		{give: `"x\u007fy\ud83d\ude00"`, when: `(upper)`, then: "\"X\x7fY\U0001f600\""},
 		// (lower)
 		{give: `"A"`, when: `(lower)`, then: `"a"`},
+		{give: `"A\tB"`, when: `(lower)`, then: `"a\tb"`},
+		// (trim) (trim-left) (trim-right)
+		{give: `"  a b  "`, when: `(trim)`, then: `"a b"`},
+		{give: `"\n a \t"`, when: `(trim)`, then: `"a"`},
+		{give: `"--a--"`, when: `(trim -)`, then: `"a"`},
+		{give: `"--a--"`, when: `(trim-left -)`, then: `"a--"`},
+		{give: `"--a--"`, when: `(trim-right -)`, then: `"--a"`},
+		{give: `"  a  "`, when: `(trim-left)`, then: `"a  "`},
+		{give: `"\"a\""`, when: `(trim "\"")`, then: `"a"`},
+		{give: `{"a":3}`, when: `(trim)`, then: `{"a":3}`},
+		// (pad-left) (pad-right)
+		{give: `7`, when: `(pad-left 3 0)`, then: `"007"`},
+		{give: `"ab"`, when: `(pad-left 5)`, then: `"   ab"`},
+		{give: `"ab"`, when: `(pad-right 5 "xy")`, then: `"abxyx"`},
+		{give: `"ééé"`, when: `(pad-left 4 *)`, then: `"*ééé"`},
+		{give: `"abc"`, when: `(pad-left 2 0)`, then: `"abc"`},
+		{give: `"a"`, when: `(pad-right 4 "é*")`, then: `"aé*é"`},
+		// (substr)
+		{give: `"héllo"`, when: `(substr 1 3)`, then: `"éll"`},
+		{give: `"héllo"`, when: `(substr 2)`, then: `"llo"`},
+		{give: `"héllo"`, when: `(substr -2)`, then: `"lo"`},
+		{give: `"héllo"`, when: `(substr 3 10)`, then: `"lo"`},
+		{give: `"héllo"`, when: `(substr 10)`, then: `""`},
+		// (index-of)
+		{give: `"héllo"`, when: `(index-of l)`, then: `2`},
+		{give: `"héllo"`, when: `(index-of x)`, then: `-1`},
+		{give: `"a\"b"`, when: `(index-of "\"")`, then: `1`},
+		{give: `[]`, when: `(index-of x)`, then: ``},
+		// (starts-with) (ends-with) (contains)
+		{give: `"hello"`, when: `(starts-with he)`, then: `"hello"`},
+		{give: `"hello"`, when: `(starts-with lo)`, then: ``},
+		{give: `"hello"`, when: `(ends-with lo)`, then: `"hello"`},
+		{give: `"a\"b"`, when: `(contains "\"")`, then: `"a\"b"`},
+		{give: `"hello"`, when: `(contains x)`, then: ``},
+		{give: `["ab","bc","cd"]`, when: `(collect (contains b))`, then: `["ab","bc"]`},
+		// (repeat)
+		{give: `"ab"`, when: `(repeat 3)`, then: `"ababab"`},
+		{give: `"ab"`, when: `(repeat -1)`, then: `""`},
+		// (title)
+		{give: `"hello wide-world ça va"`, when: `(title)`, then: `"Hello Wide-World Ça Va"`},
+		{give: `"don't stop"`, when: `(title)`, then: `"Don't Stop"`},
+		// (case)
+		{give: `"user_id"`, when: `(case camel)`, then: `"userId"`},
+		{give: `"userID"`, when: `(case snake)`, then: `"user_id"`},
+		{give: `"HTTPServerURL"`, when: `(case kebab)`, then: `"http-server-url"`},
+		{give: `"http server"`, when: `(case pascal)`, then: `"HttpServer"`},
+		{give: `"address2Line"`, when: `(case screaming)`, then: `"ADDRESS2_LINE"`},
+		{give: `"__user--name  "`, when: `(case snake)`, then: `"user_name"`},
+		{give: `"ação_rápida"`, when: `(case camel)`, then: `"açãoRápida"`},
+		{give: `"userId"`, when: `(case x)`, then: `"userId"`},
+		{give: `{"user_id":1,"home_address":{"zip_code":"x_y"}}`, when: `(iterate -k (case camel))`, then: `{"userId":1,"homeAddress":{"zipCode":"x_y"}}`},
+		{give: `{"userId":1,"list":[{"itemID":2}]}`, when: `(iterate -k (case snake))`, then: `{"user_id":1,"list":[{"item_id":2}]}`},
+		// (truncate)
+		{give: `"héllo"`, when: `(truncate 3)`, then: `"hél"`},
+		{give: `"héllo"`, when: `(truncate 3 "…")`, then: `"hél…"`},
+		{give: `"héllo"`, when: `(truncate 5 "…")`, then: `"héllo"`},
+		// (len)
+		{give: `"héllo"`, when: `(len)`, then: `5`},
+		{give: `"a\"b"`, when: `(len)`, then: `3`},
+		{give: `"a\/b"`, when: `(len)`, then: `3`},
+		{give: `{"a":"ü"}`, when: `(len a)`, then: `1`},
+		{give: `[3,4]`, when: `(len)`, then: `2`},
 		// (stringify)
 		{give: `3`, when: `(stringify)`, then: `"3"`},
 		{give: `-3`, when: `(stringify)`, then: `"-3"`},
@@ -772,6 +1198,471 @@ func Test_Invalid_Query(t *testing.T) {
 	}
 }
 
+func TestGetE(t *testing.T) {
+
+	tt := []struct {
+		give string
+		when string
+		then string
+		err  string
+	}{
+		{give: `{"a":3}`, when: `(get a)`, then: `3`, err: ``},
+		{give: `{"a":3}`, when: `(error "invalid document")`, then: ``, err: `.: invalid document`},
+		{give: `{"a":{"b":[3,"x"]}}`, when: `(get a b * (assert (is-num) "must be a number"))`, then: ``, err: `.a.b[1]: must be a number`},
+		{give: `{"a b":[{"c":3}]}`, when: `(get "a b" 0 c (error (concat (raw "bad ") (this))))`, then: ``, err: `["a b"][0].c: bad 3`},
+		{give: `{"a":3}`, when: `(obj x (raw 4)) (error built)`, then: ``, err: `built`},
+		{give: `{"a":3}`, when: `(get a (assert (is-str)))`, then: ``, err: `.a: assertion failed`},
+		{give: `{"a":3}`, when: `(collect (error first)) (error second)`, then: ``, err: `.a: first`},
+		{give: `{"a":3}`, when: `(try (error x) (error y))`, then: ``, err: `.: y`},
+		{give: `{"a":["1","x"]}`, when: `(get a * (to-num -e))`, then: ``, err: `.a[1]: cannot convert "x" to number`},
+		{give: `{"a":3}`, when: `(fmt "x{a")`, then: ``, err: `.: unclosed { in fmt template`},
+		{give: `{"a":3}`, when: `(expr 1 ? 2 : (error x))`, then: `2`, err: ``},
+		{give: `{"a":3}`, when: `(expr 0 ? (error x) : 3)`, then: `3`, err: ``},
+		{give: `{"a":3}`, when: `(expr 0 && (error x))`, then: `false`, err: ``},
+		{give: `{"a":3}`, when: `(expr 1 || (error x) || (error y))`, then: `true`, err: ``},
+		{give: `{"a":3}`, when: `(expr 1 && (error x))`, then: ``, err: `.: x`},
+		{give: `{"t":"{(raw injected)}"}`, when: `(fmt (get t))`, then: ``, err: `.: fmt template must be a literal`},
+		{give: `{"t":"{(raw injected)}"}`, when: `(let t (get t) (fmt $t))`, then: `"$t"`, err: ``},
+		{give: `{"a":[1,2]}`, when: `(get a (last (error x)))`, then: ``, err: `.a[0]: x`},
+		{give: `{"a":[1,2]}`, when: `(get a (this) 0 (error x))`, then: ``, err: `.a[0]: x`},
+		{give: `{"a":[1,2]}`, when: `(obj x (get a 1 (error x)))`, then: ``, err: `.a[1]: x`},
+		{give: `{"a":[1,2]}`, when: `(obj x a y (error x))`, then: ``, err: `.: x`},
+		{give: `{"b":1,"c":2}`, when: `(obj b (raw 1)) b (error x)`, then: ``, err: `x`},
+		{give: `{"a":{"b":1},"c":{"b":1}}`, when: `c (error x)`, then: ``, err: `.c: x`},
+		{give: `{"a":[{"b":1}]}`, when: `(get a (group b (error x)))`, then: ``, err: `.a[0]: x`},
+	}
+	for _, tc := range tt {
+		r, err := GetE(tc.give, tc.when)
+		assertEqual(t, tc.then, r.String(), tc)
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		assertEqual(t, tc.err, msg, tc)
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+
+	tt := []struct {
+		give string
+		when string
+		opts Options
+		then string
+		err  error
+	}{
+		{give: `[3,4,5]`, when: `(collect (expr (this) * 2))`, opts: Options{}, then: `[6,8,10]`},
+		{give: `[3,4,5]`, when: `(collect (expr (this) * 2))`, opts: Options{MaxSteps: 7}, then: `[6,8,10]`},
+		{give: `[3,4,5]`, when: `(collect (expr (this) * 2))`, opts: Options{MaxSteps: 6}, err: &LimitError{Limit: "steps", Max: 6}},
+		{give: `[3,4,5]`, when: `(get * a)`, opts: Options{MaxSteps: 2}, err: &LimitError{Limit: "steps", Max: 2}},
+		{give: `3`, when: `(def f (f)) (f)`, opts: Options{MaxDepth: 100}, err: &LimitError{Limit: "depth", Max: 100}},
+		{give: `3`, when: `(arr (arr (arr)))`, opts: Options{MaxDepth: 3}, then: `[[[]]]`},
+		{give: `3`, when: `(arr (arr (arr)))`, opts: Options{MaxDepth: 2}, err: &LimitError{Limit: "depth", Max: 2}},
+		{give: `[3,4,5]`, when: `(collect (this))`, opts: Options{MaxOutput: 7}, then: `[3,4,5]`},
+		{give: `[3,4,5]`, when: `(collect (this))`, opts: Options{MaxOutput: 6}, err: &LimitError{Limit: "output", Max: 6}},
+		{give: `"aaa"`, when: `(match -r "^a+$")`, opts: Options{MaxRegex: 10}, then: `"aaa"`},
+		{give: `"aaa"`, when: `(match -r "^(a+b+c+d+e+)+$")`, opts: Options{MaxRegex: 10}, err: &LimitError{Limit: "regex", Max: 10}},
+		{give: `{"aaa":3}`, when: `(match -k -r "a{1,100}b{1,100}")`, opts: Options{MaxRegex: 100}, err: &LimitError{Limit: "regex", Max: 100}},
+		{give: `{"a":3}`, when: `(try (get (get (get (get (get a))))) 1)`, opts: Options{MaxDepth: 2}, err: &LimitError{Limit: "depth", Max: 2}},
+		{give: `[3,4,5]`, when: `(try (collect (this)) 1)`, opts: Options{MaxOutput: 6}, err: &LimitError{Limit: "output", Max: 6}},
+		{give: `"ab"`, when: `(repeat 1000000000)`, opts: Options{MaxOutput: 100}, err: &LimitError{Limit: "output", Max: 100}},
+		{give: `"ab"`, when: `(repeat 9223372036854775807)`, opts: Options{}, then: `""`},
+		{give: `"ab"`, when: `(pad-left 1000000000 xy)`, opts: Options{MaxOutput: 100}, err: &LimitError{Limit: "output", Max: 100}},
+		{give: `"ab"`, when: `(pad-right 50 xy)`, opts: Options{MaxOutput: 100}, then: `"abxyxyxyxyxyxyxyxyxyxyxyxyxyxyxyxyxyxyxyxyxyxyxyxy"`},
+		{give: `3`, when: `(fmt "{(this):%999999d}")`, opts: Options{MaxOutput: 100}, err: &LimitError{Limit: "output", Max: 100}},
+		{give: `3`, when: `(fmt "{(this):%.99999999999999999999f}")`, opts: Options{MaxOutput: 100}, err: &LimitError{Limit: "output", Max: 100}},
+		{give: `3`, when: `(fmt "{(this):%5.1f}")`, opts: Options{MaxOutput: 100}, then: `"  3.0"`},
+		{give: `{"a":3}`, when: `(arr (try (error x) 1) (arr (arr a)))`, opts: Options{MaxDepth: 3}, then: `[1,[[3]]]`},
+		{give: ``, when: `(arg 1)`, opts: Options{Args: []any{3}}, then: ``},
+		{give: ``, when: `(arg 0)`, opts: Options{Args: []any{3}}, then: `3`},
+	}
+	for _, tc := range tt {
+		r, err := JSON(tc.give).QueryContext(context.Background(), tc.when, tc.opts)
+		assertEqual(t, tc.then, r.String(), tc)
+		assertEqual(t, tc.err, err, tc)
+	}
+}
+
+func TestQueryContext_DupKeys(t *testing.T) {
+
+	give := `{"a":1,"b":2,"a":3}`
+
+	tt := []struct {
+		when string
+		dup  DupPolicy
+		then string
+		err  error
+	}{
+		{when: `(get a)`, dup: DupKeep, then: `1`},
+		{when: `(get a)`, dup: DupFirst, then: `1`},
+		{when: `(get a)`, dup: DupLast, then: `3`},
+		{when: `(get a)`, dup: DupMerge, then: `[1,3]`},
+		{when: `(get a)`, dup: DupError, err: &DupKeyError{Path: ".a"}},
+		{when: `(set a 5)`, dup: DupKeep, then: `{"a":5,"b":2}`},
+		{when: `(set a 5)`, dup: DupLast, then: `{"a":5,"b":2}`},
+		{when: `(set b -r a 5)`, dup: DupLast, then: `{"a":5}`},
+		{when: `(pick a b)`, dup: DupLast, then: `{"a":3,"b":2}`},
+		{when: `(pick a b -r a)`, dup: DupMerge, then: `{"a":[[1,3],2]}`},
+		{when: `(pluck b)`, dup: DupKeep, then: `{"a":1,"a":3}`},
+		{when: `(pluck b)`, dup: DupFirst, then: `{"a":1}`},
+		{when: `(entries) (objectify)`, dup: DupLast, then: `{"a":3,"b":2}`},
+		{when: `(raw [["a",1],["a",2]]) (objectify)`, dup: DupError, err: &DupKeyError{Path: ".a"}},
+		{when: `(raw [{"a":1},{"a":2,"b":3}]) (merge)`, dup: DupKeep, then: `{"a":1,"b":3}`},
+		{when: `(raw [{"a":1},{"a":2,"b":3}]) (merge)`, dup: DupLast, then: `{"a":2,"b":3}`},
+		{when: `(raw [{"a":1},{"a":2,"b":3}]) (merge)`, dup: DupMerge, then: `{"a":[1,2],"b":3}`},
+		{when: `(raw {"x":1,"x":2}) (get x)`, dup: DupLast, then: `2`},
+		{when: `(raw {"x":1,"\u0078":2}) (get x)`, dup: DupLast, then: `2`},
+		{when: `(arg 0) (get x)`, dup: DupMerge, then: `[1,2]`},
+		{when: `(upsert c 4 c 5)`, dup: DupKeep, then: `{"c":5,"a":1,"b":2,"a":3}`},
+		{when: `(upsert c 4)`, dup: DupLast, then: `{"c":4,"a":3,"b":2}`},
+		{when: `(upsert "\u0061" 4)`, dup: DupKeep, then: `{"a":4,"b":2}`},
+	}
+	for _, tc := range tt {
+		opts := Options{DupKeys: tc.dup, Args: []any{json.RawMessage(`{"x":1,"x":2}`)}}
+		r, err := JSON(give).QueryContext(context.Background(), tc.when, opts)
+		assertEqual(t, tc.then, r.String(), tc)
+		assertEqual(t, tc.err, err, tc)
+		r, err = GetContext(context.Background(), give, tc.when, opts)
+		assertEqual(t, tc.then, r.String(), tc)
+		assertEqual(t, tc.err, err, tc)
+	}
+
+	// Paths in objects made by functions are relative to them.
+	_, err := JSON(`{"b":{}}`).QueryContext(context.Background(), `(get b (raw {"x":{"y":1,"y":2}}))`, Options{DupKeys: DupError})
+	assertEqual(t, "jsqt: duplicate key .x.y in the result of (raw)", fmt.Sprint(err), "func path")
+	_, err = JSON(`[["a",1],["a",2]]`).QueryContext(context.Background(), `(objectify)`, Options{DupKeys: DupError})
+	assertEqual(t, &DupKeyError{Path: ".a", Func: "objectify"}, err, "func error")
+}
+
+func TestJsonGetDup(t *testing.T) {
+	j := JSON(`{"a":1,"b":2,"\u0061":3}`)
+
+	tt := []struct {
+		dup  DupPolicy
+		then string
+		err  error
+	}{
+		{dup: DupKeep, then: `1`},
+		{dup: DupFirst, then: `1`},
+		{dup: DupLast, then: `3`},
+		{dup: DupMerge, then: `[1,3]`},
+		{dup: DupError, err: &DupKeyError{Path: ".a"}},
+	}
+	for _, tc := range tt {
+		v, err := j.GetDup("a", tc.dup)
+		assertEqual(t, tc.then, v.String(), tc)
+		assertEqual(t, tc.err, err, tc)
+	}
+	v, _ := j.GetDup("c", DupLast)
+	assertEqual(t, false, v.Exists(), "missing")
+	v, _ = JSON(`[5,6]`).GetDup("1", DupLast)
+	assertEqual(t, `6`, v.String(), "array")
+}
+
+func TestJsonDedup(t *testing.T) {
+	j := JSON(`{ "a": [{"x":1,"x":2}], "b": {"y":{"z":1}}, "a": 3 }`)
+
+	v, err := j.Dedup(DupMerge)
+	assertEqual(t, nil, err, "merge")
+	assertEqual(t, `{"a":[[{"x":[1,2]}],3],"b":{"y":{"z":1}}}`, v.String(), "merge")
+
+	v, _ = j.Dedup(DupLast)
+	assertEqual(t, `{"a":3,"b":{"y":{"z":1}}}`, v.String(), "last")
+
+	v, _ = JSON(`{ "a": 1 }`).Dedup(DupLast)
+	assertEqual(t, `{ "a": 1 }`, v.String(), "no duplicates")
+
+	assertEqual(t, "jsqt: duplicate key .a in the result of (set)", (&DupKeyError{Path: ".a", Func: "set"}).Error(), "func error")
+	_, err = j.Dedup(DupError)
+	assertEqual(t, "jsqt: duplicate key .a[0].x", fmt.Sprint(err), "error")
+
+	j = JSON(`{"a":1,"\u0061":2,"a\/b":3,"a/b":4}`)
+	assertEqual(t, []string{`["\u0061"]`, `["a/b"]`}, j.DupKeys(), "decoded")
+	v, _ = j.Dedup(DupLast)
+	assertEqual(t, `{"a":2,"a\/b":4}`, v.String(), "decoded")
+}
+
+func TestQueryTo(t *testing.T) {
+
+	give := `{"a":{"b":[{"c":1,"d":"x"},{"c":2,"d":"y"}]},"e":3}`
+
+	tt := []string{
+		`(get a b)`,
+		`(get a b * c)`,
+		`(get a b) (collect d)`,
+		`(get a (get b (collect (obj n c))))`,
+		`(obj x e y (get a b 0 d))`,
+		`(set e 4)`,
+		`(set a b * c (expr (this) * 10))`,
+		`(set a b 1 (void))`,
+		`(set -i a b 2 c 3)`,
+		`(set -i f 0 1)`,
+		`(set -m (get a) b 0 c 5)`,
+		`(set e -r f 4)`,
+		`(set e)`,
+		`(pretty)`,
+		`(get a b) (ugly)`,
+		`(get a b) (size)`,
+		`(get x)`,
+		`(collect (error oops))`,
+	}
+	for _, qry := range tt {
+		var o strings.Builder
+		exp, expErr := JSON(give).QueryE(qry)
+		err := JSON(give).QueryTo(&o, qry)
+		if expErr == nil {
+			assertEqual(t, exp.String(), o.String(), qry)
+		}
+		assertEqual(t, expErr, err, qry)
+	}
+}
+
+func TestQueryTo_Errors(t *testing.T) {
+	var o strings.Builder
+	err := JSON(`[1,2,3,4]`).QueryToContext(context.Background(), &o, `(collect (this))`, Options{MaxOutput: 4})
+	assertEqual(t, &LimitError{Limit: "output", Max: 4}, err)
+	assertEqual(t, ``, o.String(), "nothing is flushed")
+
+	w := &failWriter{n: 2}
+	big := `[` + strings.Repeat(`"abcdefghij",`, 1000) + `0]`
+	err = JSON(big).QueryTo(w, `(collect (this))`)
+	assertEqual(t, io.ErrShortWrite, err)
+	assertEqual(t, 2, w.calls, "stops at the error")
+}
+
+type failWriter struct{ n, calls int }
+
+func (w *failWriter) Write(b []byte) (int, error) {
+	if w.calls++; w.calls >= w.n {
+		return 0, io.ErrShortWrite
+	}
+	return len(b), nil
+}
+
+func BenchmarkQueryTo(b *testing.B) {
+	j := JSON(`[` + strings.Repeat(`{"a":1,"b":"x"},`, 1000) + `{}]`)
+	for i := 0; i < b.N; i++ {
+		_ = j.QueryTo(io.Discard, `(collect (obj b a))`)
+	}
+}
+
+func TestQueryContext_Cancel(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r, err := JSON(`[3,4,5]`).QueryContext(ctx, `(collect (this))`, Options{})
+	assertEqual(t, ``, r.String())
+	assertEqual(t, true, errors.Is(err, context.Canceled))
+
+	r, err = JSON(`[3,4,5]`).QueryContext(ctx, `(try (collect (this)) 1)`, Options{})
+	assertEqual(t, ``, r.String())
+	assertEqual(t, true, errors.Is(err, context.Canceled))
+
+	r, err = JSON(`[3,4,5]`).QueryContext(context.Background(), `(error oops)`, Options{})
+	var qe *QueryError
+	assertEqual(t, ``, r.String())
+	assertEqual(t, true, errors.As(err, &qe))
+}
+
+func TestQueryContext_Tracer(t *testing.T) {
+
+	var r []string
+	opts := Options{Tracer: func(ev TraceEvent) {
+		r = append(r, fmt.Sprint(ev.Func, " ", ev.Offset, " ", ev.Depth, " ", ev.Input, " ", ev.Output))
+	}}
+
+	v, _ := JSON(`{"a":[3,4]}`).QueryContext(context.Background(), `a (collect (expr (this) * 2))`, opts)
+
+	assertEqual(t, `[6,8]`, v.String())
+	assertEqual(t, []string{
+		"this 17 3 3 3",
+		"expr 11 2 3 6",
+		"this 17 3 4 4",
+		"expr 11 2 4 8",
+		"collect 2 1 [3,4] [6,8]",
+	}, r)
+}
+
+func TestQueryContext_TracerFmt(t *testing.T) {
+
+	var r []string
+	opts := Options{Tracer: func(ev TraceEvent) {
+		r = append(r, fmt.Sprint(ev.Func, " ", ev.Offset))
+	}}
+
+	v, _ := JSON(`{"a":3}`).QueryContext(context.Background(), `(fmt "x{(get a)}") (fmt "\"{(this)}")`, opts)
+
+	assertEqual(t, `"\"x3"`, v.String())
+	assertEqual(t, []string{"get 8", "fmt 0", "this 28", "fmt 19"}, r)
+}
+
+func TestRawOffsets(t *testing.T) {
+	// a \n 😀 b: the emoji is a surrogate pair of 4 bytes.
+	assertEqual(t, []int{1, 2, 4, 16, 16, 16, 16, 17}, rawOffsets(`"a\n\ud83d\ude00b"`))
+	// A lone surrogate is decoded as U+FFFD, of 3 bytes.
+	assertEqual(t, []int{1, 7, 7, 7, 13}, rawOffsets(`"\ud83d\u0041"`))
+	assertEqual(t, []int{1, 2, 3}, rawOffsets(`"ab"`))
+}
+
+func TestQueryContext_Debug(t *testing.T) {
+
+	var w strings.Builder
+	v, _ := JSON(`{"a":3}`).QueryContext(context.Background(), `(debug) a (debug a_val)`, Options{Debug: &w})
+
+	assertEqual(t, `3`, v.String())
+	assertEqual(t, "[debug] {\"a\":3}\n[a_val] 3\n", w.String())
+
+	w.Reset()
+	h := slog.NewTextHandler(&w, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	_, _ = JSON(`{"a":3}`).QueryContext(context.Background(), `a (debug a_val)`, Options{Debug: io.Discard, Logger: slog.New(h)})
+
+	assertEqual(t, "level=DEBUG msg=a_val value=3\n", w.String())
+}
+
+func TestExplain(t *testing.T) {
+
+	var e Explain
+	v, _ := JSON(`[3,4]`).QueryContext(context.Background(), `(collect (expr (this) * 2)) (size)`, Options{Tracer: e.Trace})
+
+	r := regexp.MustCompile(`\) [^ ]+ `).ReplaceAllString(e.String(), ") ")
+
+	assertEqual(t, `2`, v.String())
+	assertEqual(t, strings.Join([]string{
+		"(collect) [3,4] -> [6,8]",
+		"    (expr) 3 -> 6",
+		"        (this) 3 -> 3",
+		"    (expr) 4 -> 8",
+		"        (this) 4 -> 4",
+		"(size) [6,8] -> 2",
+		"",
+	}, "\n"), r)
+}
+
+func TestProfile(t *testing.T) {
+
+	var p Profile
+	v, _ := JSON(`[{"a":2},{"a":1}]`).QueryContext(context.Background(), `(collect (obj b a)) (sort b)`, Options{Tracer: p.Trace})
+
+	assertEqual(t, `[{"b":1},{"b":2}]`, v.String())
+
+	var r []string
+	for _, s := range p.Sites() {
+		r = append(r, fmt.Sprint(s.Func, " ", s.Offset, " ", s.Calls, " ", s.Built, " ", s.Scanned))
+	}
+	sort.Strings(r)
+	assertEqual(t, []string{
+		"collect 0 1 17 17",
+		"obj 9 2 14 14",
+		"sort 20 1 17 17",
+	}, r)
+
+	lines := strings.Split(p.String(), "\n")
+	assertEqual(t, 5, len(lines))
+	assertEqual(t, true, strings.HasPrefix(lines[0], "SITE"))
+}
+
+func TestQueryContext_PprofLabels(t *testing.T) {
+
+	var w labelWriter
+	v, _ := JSON(`[3]`).QueryContext(context.Background(), `(collect (debug))`, Options{PprofLabels: true, Debug: &w})
+
+	assertEqual(t, `[3]`, v.String())
+	assertEqual(t, true, strings.Contains(w.profile, `"jsqt_func":"debug"`), w.profile)
+	assertEqual(t, true, strings.Contains(w.profile, `"jsqt_offset":"9"`), w.profile)
+
+	// A streamed function writes its output, larger
+	// than the write buffer, inside its labels.
+	w = labelWriter{}
+	big := "[" + strings.Repeat("1, ", 3000) + "1]"
+	err := JSON(big).QueryToContext(context.Background(), &w, `(get (ugly))`, Options{PprofLabels: true})
+
+	assertEqual(t, nil, err)
+	assertEqual(t, true, strings.Contains(w.profile, `"jsqt_func":"ugly"`), w.profile)
+	assertEqual(t, true, strings.Contains(w.profile, `"jsqt_offset":"5"`), w.profile)
+
+	// The labels of the outer function are restored
+	// when an inner call returns.
+	w = labelWriter{}
+	big = "[" + strings.Repeat(`"abcdefghij",`, 1000) + "0]"
+	err = JSON(big).QueryToContext(context.Background(), &w, `(collect (this))`, Options{PprofLabels: true})
+
+	assertEqual(t, nil, err)
+	assertEqual(t, true, strings.Contains(w.profile, `"jsqt_func":"collect"`), w.profile)
+	assertEqual(t, true, strings.Contains(w.profile, `"jsqt_offset":"0"`), w.profile)
+}
+
+// labelWriter keeps the goroutine profile, with the
+// pprof labels of the goroutines, at the time of its
+// first write.
+type labelWriter struct{ profile string }
+
+func (w *labelWriter) Write(b []byte) (int, error) {
+	if w.profile == "" {
+		var o strings.Builder
+		pprof.Lookup("goroutine").WriteTo(&o, 1)
+		w.profile = o.String()
+	}
+	return len(b), nil
+}
+
+func TestQueryContext_Now(t *testing.T) {
+
+	now := func() time.Time { return time.Date(2022, 9, 7, 12, 30, 0, 0, time.UTC) }
+
+	v, _ := JSON(`{}`).QueryContext(context.Background(), `(obj now (now) tomorrow (get (now) (date-add 1d)))`, Options{Now: now})
+
+	assertEqual(t, `{"now":"2022-09-07T12:30:00Z","tomorrow":"2022-09-08T12:30:00Z"}`, v.String())
+}
+
+func TestExprIsGroup(t *testing.T) {
+	for name := range funcs {
+		if isIdentStart(name[0]) {
+			q := Query{s: JSON("(" + name + ")").s}
+			p := exprParser{q: &q}
+			assertEqual(t, false, p.isGroup(), name)
+		}
+	}
+	q := Query{s: JSON("(a)").s}
+	p := exprParser{q: &q}
+	assertEqual(t, true, p.isGroup(), "(a)")
+}
+
+func TestCompileRegex(t *testing.T) {
+	a, n := compileRegex(`^a+$`, 0)
+	b, _ := compileRegex(`^a+$`, 0)
+	assertEqual(t, true, a != nil && a == b)
+	assertEqual(t, 6, n)
+
+	c, n := compileRegex(`^b{1,100}$`, 10)
+	assertEqual(t, true, c == nil && n > 10, "too big")
+	c, _ = compileRegex(`^b{1,100}$`, 0)
+	assertEqual(t, true, c != nil, "compiled when allowed")
+
+	c, n = compileRegex(`(`, 0)
+	assertEqual(t, true, c == nil && n == -1)
+
+	src := []byte(`^c+$`)
+	d, _ := compileRegex(unsafe.String(unsafe.SliceData(src), len(src)), 0)
+	copy(src, `^x+$`)
+	e, _ := compileRegex(`^c+$`, 0)
+	assertEqual(t, true, d == e && e.MatchString("cc"), "the cache owns the key")
+}
+
+func Benchmark_QueryFunction_MatchRegex(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Get(`["a1","b2","c3"]`, `(collect (match -r "^[a-z]\d$"))`)
+	}
+}
+
 func TestGetWith(t *testing.T) {
 
 	tt := []struct {
@@ -792,6 +1683,12 @@ func TestGetWith(t *testing.T) {
 			args: []any{func(j Json) Json { return j.Stringify() }},
 			then: `{"a":"3"}`,
 		},
+		{
+			give: ``,
+			when: `(obj a (arg 0))`,
+			args: []any{json.RawMessage(`{"b":[3]}`)},
+			then: `{"a":{"b":[3]}}`,
+		},
 	}
 	for _, tc := range tt {
 		r := GetWith(tc.give, tc.when, tc.args)
@@ -806,6 +1703,505 @@ func BenchmarkGetWith(b *testing.B) {
 	}
 }
 
+func TestGetMany(t *testing.T) {
+	j := ` {"a":{"b":[3,{"c":4}],"d":"x"},"a":{"d":"dup"},"e f":5,"g":null}`
+	qrys := []string{
+		`a d`,
+		`(get a b 1 c)`,
+		`a (get b) 0`,
+		`"e f"`,
+		`g`,
+		`a x`,
+		`a b 5`,
+		``,
+		`(get a b) (size)`,
+		`(get a b * c)`,
+		`a d (upper)`,
+	}
+	r := GetMany(j, qrys...)
+	assertEqual(t, len(qrys), len(r))
+	for i, qry := range qrys {
+		assertEqual(t, Get(j, qry).String(), r[i].String(), qry)
+	}
+
+	paths := map[string]bool{}
+	for _, qry := range qrys {
+		_, ok := queryPath(qry)
+		paths[qry] = ok
+	}
+	assertEqual(t, map[string]bool{
+		`a d`: true, `(get a b 1 c)`: true, `a (get b) 0`: true, `"e f"`: true, `g`: true, `a x`: true, `a b 5`: true, ``: true,
+		`(get a b) (size)`: false, `(get a b * c)`: false, `a d (upper)`: false,
+	}, paths)
+}
+
+func TestExtractor(t *testing.T) {
+	e := NewExtractor(map[string]string{
+		"id":    `data id`,
+		"name":  `(get data user name)`,
+		"tags":  `data tags (size)`,
+		"miss":  `data nope`,
+		"first": `data tags 0`,
+	})
+	m := e.Extract(`{"data":{"id":7,"user":{"name":"Ann"},"tags":["a","b"]}}`)
+	assertEqual(t, 4, len(m))
+	assertEqual(t, `7`, m["id"].String())
+	assertEqual(t, `"Ann"`, m["name"].String())
+	assertEqual(t, `2`, m["tags"].String())
+	assertEqual(t, `"a"`, m["first"].String())
+}
+
+func BenchmarkGetMany(b *testing.B) {
+	qrys := []string{`name`, `age`, `address city`, `(get address country)`, `contacts 1 last`}
+	for i := 0; i < b.N; i++ {
+		_ = GetMany(TestData1, qrys...)
+	}
+}
+
+func BenchmarkExtractor(b *testing.B) {
+	e := NewExtractor(map[string]string{"a": `name`, "b": `age`, "c": `address city`, "d": `(get address country)`, "e": `contacts 1 last`})
+	for i := 0; i < b.N; i++ {
+		_ = e.Extract(TestData1)
+	}
+}
+
+func BenchmarkGetMany_Get(b *testing.B) {
+	qrys := []string{`name`, `age`, `address city`, `(get address country)`, `contacts 1 last`}
+	for i := 0; i < b.N; i++ {
+		for _, qry := range qrys {
+			_ = Get(TestData1, qry)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	var o strings.Builder
+	o.WriteString(`{"a":{"b":[3,4]},"a":1,"arr":[`)
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			o.WriteString(",")
+		}
+		fmt.Fprintf(&o, `{"id":%d}`, i)
+	}
+	o.WriteString(`]`)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&o, `,"k%d":%d`, i, i)
+	}
+	o.WriteString(`}`)
+	j := JSON(o.String())
+	x := j.Index()
+
+	qrys := []string{
+		`a`, `a b 1`, `k0`, `k99`, `k100`, `"k5"`, `arr 42 id`, `arr 0042`, `arr 100`, `arr -1`,
+		`arr (at 7) id`, `arr (at 100)`, `arr (slice 97 0)`, `arr (slice -2 -1)`, `arr (slice 98 200)`,
+		`(size)`, `arr (size)`, `(keys) (size)`, `(keys) 2`, `arr * id (size)`, `a b (at 1)`,
+	}
+	for _, qry := range qrys {
+		assertEqual(t, j.Query(qry).String(), x.Query(qry).String(), qry)
+	}
+
+	assertEqual(t, `{"id":9}`, x.Get(x.Get(j, "arr"), "9").String())
+	assertEqual(t, `103`, x.Size(j).String())
+	assertEqual(t, `100`, x.Size(x.Get(j, "arr")).String())
+	assertEqual(t, `["id"]`, x.Keys(JSON(`{"id":1}`)).String(), "not in the document")
+	assertEqual(t, 2, len(x.nodes), "only large containers")
+
+	// A DupKeys policy uses an index of the resolved document.
+	for i := 0; i < 2; i++ {
+		v, err := j.QueryContext(context.Background(), `arr 42 id`, Options{Index: x, DupKeys: DupLast})
+		assertEqual(t, nil, err)
+		assertEqual(t, `42`, v.String(), "dup last")
+		v, _ = j.QueryContext(context.Background(), `a`, Options{Index: x, DupKeys: DupLast})
+		assertEqual(t, `1`, v.String(), "dup last")
+	}
+	y := x.dups[DupLast]
+	assertEqual(t, true, y != nil && y != x && len(y.nodes) == 2, "resolved index")
+	_, err := j.QueryContext(context.Background(), `a`, Options{Index: x, DupKeys: DupError})
+	assertEqual(t, &DupKeyError{Path: ".a"}, err, "dup error")
+	v, _ := JSON(`{"a":1}`).QueryContext(context.Background(), `a`, Options{Index: x, DupKeys: DupLast})
+	assertEqual(t, `1`, v.String(), "not the document")
+}
+
+func BenchmarkIndex(b *testing.B) {
+	var o strings.Builder
+	o.WriteString(`[`)
+	for i := 0; i < 10000; i++ {
+		if i > 0 {
+			o.WriteString(",")
+		}
+		fmt.Fprintf(&o, `{"id":%d}`, i)
+	}
+	o.WriteString(`]`)
+	j := JSON(o.String())
+	b.Run("Get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = j.Get("9000")
+		}
+	})
+	b.Run("Index", func(b *testing.B) {
+		x := j.Index()
+		for i := 0; i < b.N; i++ {
+			_ = x.Get(j, "9000")
+		}
+	})
+}
+
+func TestJSONBytes(t *testing.T) {
+	src := []byte(`{"a":{"b":[3,4]}}`)
+
+	r := GetBytes(src, `(get a b)`)
+	assertEqual(t, `[3,4]`, r.String())
+
+	b := r.BytesIn(src)
+	assertEqual(t, `[3,4]`, string(b))
+	assertEqual(t, &src[10], &b[0], "shares the memory")
+	assertEqual(t, 5, cap(b), "can't append to src")
+
+	c := GetBytes(src, `(get a b) (size)`).BytesIn(src)
+	assertEqual(t, `2`, string(c), "a copy")
+
+	buf := make([]byte, 0, 64)
+	n := testing.AllocsPerRun(10, func() {
+		buf = r.AppendTo(buf[:0])
+	})
+	assertEqual(t, `[3,4]`, string(buf))
+	assertEqual(t, 0.0, n, "allocs")
+
+	buf, err := JSONBytes(src).QueryAppend(buf[:0], `(get a b (collect (expr (this) * 2)))`)
+	assertEqual(t, nil, err)
+	assertEqual(t, `[6,8]`, string(buf), "append")
+	buf, err = JSONBytes(src).QueryAppend(buf, `(get a (pretty))`)
+	assertEqual(t, nil, err)
+	assertEqual(t, "[6,8]{\n    \"b\": [\n        3,\n        4\n    ]\n}", string(buf), "append")
+	out, err := JSONBytes(src).QueryAppendContext(context.Background(), buf, `(get a b (collect (this)))`, Options{MaxOutput: 2})
+	assertEqual(t, &LimitError{Limit: "output", Max: 2}, err, "limit")
+	assertEqual(t, string(buf), string(out), "dst as it was")
+}
+
+func TestFromCSV(t *testing.T) {
+
+	tt := []struct {
+		give string
+		opts CSVOptions
+		then string
+		err  bool
+	}{
+		{give: ``, then: `[]`},
+		{give: "a,b\n", then: `[]`},
+		{give: "a,b\r\n1,x\r\n2,\"y, \"\"z\"\"\"\r\n", then: `[{"a":"1","b":"x"},{"a":"2","b":"y, \"z\""}]`},
+		{give: "a,b,c,d\n1,true,007,\n", opts: CSVOptions{Infer: true}, then: `[{"a":1,"b":true,"c":"007","d":""}]`},
+		{give: "a,b\n-1.5e2,.5\n", opts: CSVOptions{Infer: true}, then: `[{"a":-1.5e2,"b":".5"}]`},
+		{give: "a\tb\n1\t\"x\ny\"\n", opts: CSVOptions{Sep: '\t'}, then: `[{"a":"1","b":"x\ny"}]`},
+		{give: "1,2\n3,4\n", opts: CSVOptions{Header: []string{"x", "y"}, Infer: true}, then: `[{"x":1,"y":2},{"x":3,"y":4}]`},
+		{give: "a,b\n1\n", err: true},
+		{give: "a\n\"x\n", err: true},
+	}
+	for _, tc := range tt {
+		j, err := FromCSV(strings.NewReader(tc.give), tc.opts)
+		assertEqual(t, tc.err, err != nil, tc.give)
+		assertEqual(t, tc.then, j.String(), tc.give)
+		if !tc.err {
+			assertEqual(t, true, j.Valid(), tc.give)
+		}
+	}
+}
+
+func TestFromCSV_RoundTrip(t *testing.T) {
+	give := `[{"a":1,"b":"x, \"y\""},{"a":2,"b":"é\nz"}]`
+	csv := Get(give, `(to-csv)`).Str()
+	j, err := FromCSV(strings.NewReader(csv), CSVOptions{Infer: true})
+	assertEqual(t, nil, err, "err")
+	assertEqual(t, give, j.String(), "round trip")
+}
+
+func TestFromYAML(t *testing.T) {
+
+	tt := []struct {
+		give string
+		then string
+		err  string
+	}{
+		{give: ``, then: `null`},
+		{give: `42`, then: `42`},
+		{give: "a: 1\nb: two\nc:\n  d: [1, 2, {e: f}]\n  g: null\n", then: `{"a":1,"b":"two","c":{"d":[1,2,{"e":"f"}],"g":null}}`},
+		{give: "- x\n- y: 1\n  z: 2\n-   - n1\n    - n2\n-\n", then: `["x",{"y":1,"z":2},["n1","n2"],null]`},
+		{give: "key:\n- a\n- b\nother: x\n", then: `{"key":["a","b"],"other":"x"}`},
+		{give: "z: 1\ny: 2\nx: 3\n", then: `{"z":1,"y":2,"x":3}`},
+		{give: "# c\nname: \"Ann \\u00e9\\t\" # c\nq: 'it''s'\nurl: http://x.com/a#b\n", then: `{"name":"Ann é\t","q":"it's","url":"http://x.com/a#b"}`},
+		{give: "n: 007\nh: 0x1F\no: 0o17\nf: .5\ng: +1.\ne: 1e3\nt: True\nnl: ~\ns: !!str 123\ninf: .inf\nv: 1.2.3\n", then: `{"n":7,"h":31,"o":15,"f":0.5,"g":1,"e":1e3,"t":true,"nl":null,"s":"123","inf":".inf","v":"1.2.3"}`},
+		{give: "base: &b\n  x: 1\n  y: 2\nderived:\n  <<: *b\n  y: 3\nref: *b\nlist: &l [1, 2]\nl2: *l\n", then: `{"base":{"x":1,"y":2},"derived":{"x":1,"y":3},"ref":{"x":1,"y":2},"list":[1,2],"l2":[1,2]}`},
+		{give: "a: &a {x: 1}\nb: &b {x: 2, y: 2}\nc:\n  z: 0\n  <<: [*a, *b]\n", then: `{"a":{"x":1},"b":{"x":2,"y":2},"c":{"z":0,"x":1,"y":2}}`},
+		{give: "lit: |\n  line1\n    line2\n\n  line4\nfold: >-\n  a\n  b\n\n  c\nkeep: |+\n  k\n\nnext: 1\n", then: `{"lit":"line1\n  line2\n\nline4\n","fold":"a b\nc","keep":"k\n\n","next":1}`},
+		{give: "plain: multi\n  line\nempty:\nquoted: \"a\n  b\"\n", then: `{"plain":"multi line","empty":null,"quoted":"a b"}`},
+		{give: "flow: {a: [1, 2\n  , 3], b: \"x, y\", c: &c 'z', d: *c, e: }\n", then: `{"flow":{"a":[1,2,3],"b":"x, y","c":"z","d":"z","e":null}}`},
+		{give: "---\na: 1\n---\n- b\n...\n--- text\n", then: `[{"a":1},["b"],"text"]`},
+		{give: "%YAML 1.2\n---\na: 1\n", then: `{"a":1}`},
+		{give: "a: 1\r\nb: 2\r\n", then: `{"a":1,"b":2}`},
+		{give: "a: [1, 2\n", err: "yaml: line 1: expected , or ] in flow sequence"},
+		{give: "a: 1\n  b: 2\n", err: "yaml: line 2: bad indentation of a mapping entry"},
+		{give: "a:\n    b: 1\n  c: 2\n", err: "yaml: line 3: bad indentation of a mapping entry"},
+		{give: "x: *nope\n", err: "yaml: line 1: unknown alias *nope"},
+		{give: "x: |x\n", err: `yaml: line 1: invalid block scalar header "|x"`},
+		{give: "x: \"\\q\"\n", err: "yaml: line 1: invalid quoted scalar"},
+		{give: "x: 1\n<<: 2\n", err: "yaml: line 2: merge key value must be a mapping"},
+		{give: "a: b: c\n", err: "yaml: line 1: mapping values are not allowed here"},
+		{give: "- a: b: c\n", err: "yaml: line 1: mapping values are not allowed here"},
+		{give: "a: 1\na: 2\n", err: "yaml: line 2: duplicate key a"},
+		{give: "a: {x: 1, x: 2}\n", err: "yaml: line 1: duplicate key x"},
+		{give: "b: &b {x: 1}\nc:\n  <<: *b\n  x: 2\n  x: 3\n", err: "yaml: line 5: duplicate key x"},
+	}
+	for _, tc := range tt {
+		j, err := FromYAML(strings.NewReader(tc.give))
+		if tc.err != "" {
+			assertEqual(t, tc.err, fmt.Sprint(err), tc.give)
+			continue
+		}
+		assertEqual(t, nil, err, tc.give)
+		assertEqual(t, tc.then, j.String(), tc.give)
+	}
+
+	// A few nested aliases can't expand to gigabytes.
+	lol := "a: &a [lol, lol, lol, lol, lol, lol, lol, lol, lol]\n"
+	for c := 'b'; c <= 'i'; c++ {
+		lol += fmt.Sprintf("%c: &%c [*%c, *%c, *%c, *%c, *%c, *%c, *%c, *%c, *%c]\n", c, c, c-1, c-1, c-1, c-1, c-1, c-1, c-1, c-1, c-1)
+	}
+	_, err := FromYAML(strings.NewReader(lol))
+	assertEqual(t, "yaml: line 6: aliases expand to more than 1048576 bytes", fmt.Sprint(err))
+}
+
+func TestJsonToYAML(t *testing.T) {
+	j := JSON(`{"a":1,"b":"two","c":{"d":[1,{"e":"f","g":[]}],"h":{}},"s":"multi\nline\n","q":"true","k: v":"a #b","n":null}`)
+	assertEqual(t, `a: 1
+b: two
+c:
+  d:
+    - 1
+    - e: f
+      g: []
+  h: {}
+s: |
+  multi
+  line
+q: "true"
+"k: v": "a #b"
+"n": null
+`, j.ToYAML(), "yaml")
+
+	// Round trips.
+	for _, give := range []string{
+		`{"y":"y","n":"N","yes":"Yes","no":"NO","on":"on","off":"Off"}`,
+		`{"s":"no trail\nx","s2":"trail\n\n","s3":"a\n  b","e":"","sp":" a","u":"é ✓","c":"a\u0001b","num":"007","dash":"- a","f":-1.5e3}`,
+		`[1,"a",{"x":[{"y":1}]},[[]]]`,
+		`"root"`,
+		`{}`,
+	} {
+		j, err := FromYAML(strings.NewReader(JSON(give).ToYAML()))
+		assertEqual(t, nil, err, give)
+		assertEqual(t, give, j.String(), give)
+	}
+
+	// Booleans of YAML 1.1 are quoted.
+	assertEqual(t, "- \"yes\"\n- \"Off\"\n- \"n\"\n- yess\n", JSON(`["yes","Off","n","yess"]`).ToYAML(), "yaml 1.1")
+}
+
+func TestFromTOML(t *testing.T) {
+
+	tt := []struct {
+		give string
+		then string
+		err  string
+	}{
+		{give: ``, then: `{}`},
+		{give: "title = \"TOML \\\"x\\\"\" # c\nz = 1\na = 2\n", then: `{"title":"TOML \"x\"","z":1,"a":2}`},
+		{give: "[owner]\nname = 'Tom'\ndob = 1979-05-27T07:32:00-08:00\n[db]\nports = [ 8000,\n  8001, # c\n]\ndata = [ [\"a\"], [3.14] ]\ntemp = { cpu = 79.5, case = 72.0 }\n", then: `{"owner":{"name":"Tom","dob":"1979-05-27T07:32:00-08:00"},"db":{"ports":[8000,8001],"data":[["a"],[3.14]],"temp":{"cpu":79.5,"case":72.0}}}`},
+		{give: "[[p]]\nname = \"H\"\n[[p]]\n[[p]]\nname = \"N\"\n[p.sub]\nx = 1\n", then: `{"p":[{"name":"H"},{},{"name":"N","sub":{"x":1}}]}`},
+		{give: "[a.b.c]\nx = 1\n[a]\ny = 2\nsite.\"google.com\" = true\n", then: `{"a":{"b":{"c":{"x":1}},"y":2,"site":{"google.com":true}}}`},
+		{give: "hex = 0xDEAD_BEEF\noct = 0o755\nbin = 0b1101\nbig = 1_000\nf = +6.626e-34\nn = -0.5\n", then: `{"hex":3735928559,"oct":493,"bin":13,"big":1000,"f":6.626e-34,"n":-0.5}`},
+		{give: "ld = 1979-05-27\nlt = 07:32:00.5\nldt = 1979-05-27 07:32:00\n", then: `{"ld":"1979-05-27","lt":"07:32:00.5","ldt":"1979-05-27T07:32:00"}`},
+		{give: "ml = \"\"\"\nRoses \\\n  are red\\u00e9\nV \"x\" \"\"\"\nlit = '''\nC:\\path'''\nq = \"\"\"a\"b\"\"\"\"\"\nl = 'C:\\x'\n", then: `{"ml":"Roses are redé\nV \"x\" ","lit":"C:\\path","q":"a\"b\"\"","l":"C:\\x"}`},
+		{give: "a = 1\na = 2\n", err: "toml: line 2: duplicate key a"},
+		{give: "[t]\n[t]\n", err: "toml: line 2: table t is already defined"},
+		{give: "a = {x = 1}\n[a]\n", err: "toml: line 2: table a is already defined"},
+		{give: "a = {x = 1}\na.y = 2\n", err: "toml: line 2: table a can't be extended"},
+		{give: "a = 1\n[a.b]\n", err: "toml: line 2: key a is not a table"},
+		{give: "a = inf\n", err: "toml: line 1: inf is not supported by JSON"},
+		{give: "a = 01\n", err: `toml: line 1: invalid value "01"`},
+		{give: "a = \"x\n", err: "toml: line 1: unterminated string"},
+		{give: "a = \"\\q\"\n", err: `toml: line 1: invalid escape \q`},
+		{give: "x = 1 y = 2\n", err: "toml: line 1: expected a new line"},
+		{give: "x\n", err: "toml: line 1: expected ="},
+	}
+	for _, tc := range tt {
+		j, err := FromTOML(strings.NewReader(tc.give))
+		if tc.err != "" {
+			assertEqual(t, tc.err, fmt.Sprint(err), tc.give)
+			continue
+		}
+		assertEqual(t, nil, err, tc.give)
+		assertEqual(t, tc.then, j.String(), tc.give)
+	}
+}
+
+func TestJsonToTOML(t *testing.T) {
+	j := JSON(`{"title":"x","owner":{"name":"Tom","tags":["a","b"]},"p":[{"n":"H"},{"n":"N"}],"mixed":[1,{"a":1}],"a.b":{"c":{"e":1}},"empty":{}}`)
+	s, err := j.ToTOML()
+	assertEqual(t, nil, err, "err")
+	assertEqual(t, `title = "x"
+mixed = [1, { a = 1 }]
+
+[owner]
+name = "Tom"
+tags = ["a", "b"]
+
+[[p]]
+n = "H"
+
+[[p]]
+n = "N"
+
+["a.b".c]
+e = 1
+
+[empty]
+`, s, "toml")
+
+	back, err := FromTOML(strings.NewReader(s))
+	assertEqual(t, nil, err, "round trip")
+	assertEqual(t, `{"title":"x","mixed":[1,{"a":1}],"owner":{"name":"Tom","tags":["a","b"]},"p":[{"n":"H"},{"n":"N"}],"a.b":{"c":{"e":1}},"empty":{}}`, back.String(), "round trip")
+
+	_, err = JSON(`{"a":[1,null]}`).ToTOML()
+	assertEqual(t, "toml: null value at a[1]", fmt.Sprint(err), "null")
+	_, err = JSON(`[1]`).ToTOML()
+	assertEqual(t, "toml: the document must be an object", fmt.Sprint(err), "array")
+}
+
+func TestFromXML(t *testing.T) {
+
+	soap := `<?xml version="1.0"?>
+<!-- feed -->
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Body>
+    <Order id="7">
+      <Item sku="A1">2</Item>
+      <Item sku="B2">1</Item>
+      <Note><![CDATA[a < b]]></Note>
+      <Empty/>
+    </Order>
+  </soap:Body>
+</soap:Envelope>`
+
+	tt := []struct {
+		give string
+		opts XMLOptions
+		then string
+		err  string
+	}{
+		{give: soap, then: `{"soap:Envelope":{"@xmlns:soap":"http://schemas.xmlsoap.org/soap/envelope/","soap:Body":{"Order":{"@id":"7","Item":[{"@sku":"A1","#text":"2"},{"@sku":"B2","#text":"1"}],"Note":"a < b","Empty":null}}}}`},
+		{give: soap, opts: XMLOptions{StripNS: true, Infer: true, Attr: "-", Text: "_"}, then: `{"Envelope":{"Body":{"Order":{"-id":7,"Item":[{"-sku":"A1","_":2},{"-sku":"B2","_":1}],"Note":"a < b","Empty":null}}}}`},
+		{give: `<a><b>1</b><c x="y"/></a>`, opts: XMLOptions{Arrays: []string{"b", "c"}}, then: `{"a":{"b":["1"],"c":[{"@x":"y"}]}}`},
+		{give: `<p>Hello <b>big</b> world &amp; <i/>you</p>`, then: `{"p":{"b":"big","i":null,"#text":"Hello world & you"}}`},
+		{give: `<a>true</a>`, opts: XMLOptions{Infer: true}, then: `{"a":true}`},
+		{give: `<a>  </a>`, then: `{"a":""}`},
+		{give: `<a></a>`, then: `{"a":""}`},
+		{give: `<a/>`, then: `{"a":null}`},
+		{give: "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><a>caf\xe9</a>", then: `{"a":"café"}`},
+		{give: ``, err: "xml: line 1: no root element"},
+		{give: `<a/><b/>`, err: "xml: line 1: more than one root element"},
+		{give: "<a>\n<b></a>", err: "xml: line 2: element <b> closed by </a>"},
+		{give: `<a>`, err: "xml: line 1: element <a> is not closed"},
+		{give: `x<a/>`, err: "xml: line 1: text outside the root element"},
+		{give: `<?xml version="1.0" encoding="EBCDIC"?><a/>`, err: `xml: opening charset "EBCDIC": unsupported charset`},
+	}
+	for _, tc := range tt {
+		j, err := FromXML(strings.NewReader(tc.give), tc.opts)
+		if tc.err != "" {
+			assertEqual(t, tc.err, fmt.Sprint(err), tc.give)
+			continue
+		}
+		assertEqual(t, nil, err, tc.give)
+		assertEqual(t, tc.then, j.String(), tc.give)
+	}
+}
+
+func TestJsonToXML(t *testing.T) {
+	j := JSON(`{"order":{"@id":7,"item":[{"@sku":"A\"1","#text":"2 < 3"},{"@sku":"B2"}],"note":"x & y","empty":null,"ok":true}}`)
+	s, err := j.ToXML(XMLOptions{})
+	assertEqual(t, nil, err, "err")
+	assertEqual(t, `<order id="7"><item sku="A&quot;1">2 &lt; 3</item><item sku="B2"/><note>x &amp; y</note><empty/><ok>true</ok></order>`, s, "xml")
+
+	back, err := FromXML(strings.NewReader(s), XMLOptions{Infer: true})
+	assertEqual(t, nil, err, "round trip")
+	assertEqual(t, j.String(), back.String(), "round trip")
+
+	s, err = JSON(`{"a":[1,2],"b":{"c":""}}`).ToXML(XMLOptions{Root: "r", Indent: "  "})
+	assertEqual(t, nil, err, "indent")
+	assertEqual(t, "<r>\n  <a>1</a>\n  <a>2</a>\n  <b>\n    <c></c>\n  </b>\n</r>", s, "indent")
+
+	for _, give := range []string{`{"a":""}`, `{"a":null}`, `{"a":{"b":"","c":null}}`} {
+		s, err = JSON(give).ToXML(XMLOptions{})
+		assertEqual(t, nil, err, give)
+		back, err = FromXML(strings.NewReader(s), XMLOptions{})
+		assertEqual(t, nil, err, give)
+		assertEqual(t, give, back.String(), give)
+	}
+
+	_, err = JSON(`{"a":1,"b":2}`).ToXML(XMLOptions{})
+	assertEqual(t, "xml: the document must be an object with a single key", fmt.Sprint(err), "keys")
+	_, err = JSON(`{"a":[1]}`).ToXML(XMLOptions{})
+	assertEqual(t, "xml: the root element can't be an array", fmt.Sprint(err), "array")
+	_, err = JSON(`{"a":{"b":[[1]]}}`).ToXML(XMLOptions{})
+	assertEqual(t, "xml: nested array at a.b[0]", fmt.Sprint(err), "nested")
+	_, err = JSON(`{"a":{"1b":1}}`).ToXML(XMLOptions{})
+	assertEqual(t, `xml: invalid name "1b" at a.1b`, fmt.Sprint(err), "name")
+	_, err = JSON(`{"a":{"@b":{}}}`).ToXML(XMLOptions{})
+	assertEqual(t, "xml: attribute b must be a scalar at a", fmt.Sprint(err), "attr")
+}
+
+func TestLenient(t *testing.T) {
+
+	tt := []struct {
+		give string
+		opts LenientOptions
+		then string
+		err  string
+	}{
+		{give: `{a: 1, 'b': 'it\'s', "c": [1, 2,],}`, then: `{"a": 1, "b": "it's", "c": [1, 2]}`},
+		{give: "{\n  // comment\n  \"a\": 1, // trailing\n  /* block */ \"b\": 2\n}", then: "{\n  \"a\": 1,\n \"b\": 2\n}"},
+		{give: "{\n  // comment\n  \"a\": 1, // trailing\n}", opts: LenientOptions{Comments: true}, then: "{\n  // comment\n  \"a\": 1 // trailing\n}"},
+		{give: `[0x1F, -0xff, +1, .5, 5., -.5e3, 1E+2, 0]`, then: `[31, -255, 1, 0.5, 5, -0.5e3, 1E+2, 0]`},
+		{give: `["é\/", 'a\x41\v\0"', "tab\	x", 'l\` + "\n" + `ine']`, then: `["é\/", "aA\u000b\u0000\"", "tab\tx", "line"]`},
+		{give: `{$id: 1, _x2: 2, café: 3}`, then: `{"$id": 1, "_x2": 2, "café": 3}`},
+		{give: "\ufeff\u00a0[true,false,null]\u2028", then: `[true,false,null]`},
+		{give: `{"a":1}`, then: `{"a":1}`},
+		{give: ``, err: "json5: line 1: unexpected end of input"},
+		{give: "{\na: Infinity}", err: "json5: line 2: Infinity is not supported by JSON"},
+		{give: `[-NaN]`, err: "json5: line 1: -NaN is not supported by JSON"},
+		{give: `[1,,2]`, err: `json5: line 1: unexpected ','`},
+		{give: `{,}`, err: `json5: line 1: expected a key, got ','`},
+		{give: `{a 1}`, err: `json5: line 1: expected :, got '1'`},
+		{give: `[1 2]`, err: `json5: line 1: expected , or ], got '2'`},
+		{give: `[01]`, err: `json5: line 1: invalid number "01"`},
+		{give: `[1e]`, err: `json5: line 1: invalid number "1e"`},
+		{give: `['a]`, err: "json5: line 1: unterminated string"},
+		{give: `["\1"]`, err: `json5: line 1: invalid escape \1`},
+		{give: `[1] /*`, err: "json5: line 1: unterminated comment"},
+		{give: `[1] 2`, err: `json5: line 1: unexpected '2'`},
+		{give: `[undefined]`, err: "json5: line 1: unexpected undefined"},
+	}
+	for _, tc := range tt {
+		j, err := Lenient(tc.give, tc.opts)
+		if tc.err != "" {
+			assertEqual(t, tc.err, fmt.Sprint(err), tc.give)
+			continue
+		}
+		assertEqual(t, nil, err, tc.give)
+		assertEqual(t, tc.then, j.String(), tc.give)
+		if !tc.opts.Comments {
+			assertEqual(t, true, j.Valid(), tc.give)
+		}
+	}
+}
+
 func TestValid(t *testing.T) {
 
 	tt := []struct {
@@ -814,6 +2210,11 @@ func TestValid(t *testing.T) {
 	}{
 		{give: `{"a":3}`, then: true},
 		{give: `{"a":3,}`, then: false},
+		{give: ` [1, "\u00e9\ud83d\ude00"] `, then: true},
+		{give: `"\q"`, then: false},
+		{give: "\"a\tb\"", then: false},
+		{give: `01`, then: false},
+		{give: `"\ud83d"`, then: false},
 	}
 	for _, tc := range tt {
 		ok := Valid(tc.give)
@@ -821,6 +2222,43 @@ func TestValid(t *testing.T) {
 	}
 }
 
+func TestValidate(t *testing.T) {
+
+	tt := []struct {
+		give string
+		then string
+	}{
+		{give: `{"a":1}`, then: `<nil>`},
+		{give: ``, then: `json: line 1, column 1: expected a value, found end of input near ""`},
+		{give: "{\n  \"a\": 1\n  \"b\": 2\n}", then: `json: line 3, column 3: expected , or }, found '"' near "{\n  \"a\": 1\n  \"b\": 2\n}"`},
+		{give: `{"a":3,}`, then: `json: line 1, column 8: expected a string key, found '}' near "{\"a\":3,}"`},
+		{give: `{"a" 3}`, then: `json: line 1, column 6: expected :, found '3' near "{\"a\" 3}"`},
+		{give: `[1 2]`, then: `json: line 1, column 4: expected , or ], found '2' near "[1 2]"`},
+		{give: `[1,]`, then: `json: line 1, column 4: expected a value, found ']' near "[1,]"`},
+		{give: `[1] x`, then: `json: line 1, column 5: expected end of input, found 'x' near "[1] x"`},
+		{give: `[tru]`, then: `json: line 1, column 2: expected a value, found 't' near "[tru]"`},
+		{give: `["a\qb"]`, then: `json: line 1, column 4: invalid escape \q near "[\"a\\qb\"]"`},
+		{give: `["\u12"]`, then: `json: line 1, column 3: invalid escape \u near "[\"\\u12\"]"`},
+		{give: "[\"a\nb\"]", then: `json: line 1, column 4: control character '\n' in string near "[\"a\nb\"]"`},
+		{give: `[01]`, then: `json: line 1, column 3: leading zero in number near "[01]"`},
+		{give: `[-]`, then: `json: line 1, column 3: expected a digit, found ']' near "[-]"`},
+		{give: `[1.]`, then: `json: line 1, column 4: expected a digit, found ']' near "[1.]"`},
+		{give: `[1e+]`, then: `json: line 1, column 5: expected a digit, found ']' near "[1e+]"`},
+		{give: `["\ud83d"]`, then: `json: line 1, column 3: lone surrogate \ud83d near "[\"\\ud83d\"]"`},
+		{give: `["\ud83d\u0041"]`, then: `json: line 1, column 3: lone surrogate \ud83d near "[\"\\ud83d\\u0041\"]"`},
+		{give: `["\ude00"]`, then: `json: line 1, column 3: lone surrogate \ude00 near "[\"\\ude00\"]"`},
+		{give: `["abc`, then: `json: line 1, column 6: expected ", found end of input near "[\"abc"`},
+		{give: `[1, 2, 3, 4, 5, 6, 7, 8, 9, 10, x, 11, 12, 13, 14, 15, 16]`, then: `json: line 1, column 33: expected a value, found 'x' near " 5, 6, 7, 8, 9, 10, x, 11, 12, 13, 14, 1"`},
+	}
+	for _, tc := range tt {
+		err := Check(tc.give)
+		assertEqual(t, tc.then, fmt.Sprint(err), tc.give)
+	}
+
+	err := JSON("{\n\"é\": x}").Validate().(*SyntaxError)
+	assertEqual(t, SyntaxError{Msg: "expected a value, found 'x'", Offset: 8, Line: 2, Column: 7, Expected: "a value", Snippet: "{\n\"é\": x}"}, *err, "fields")
+}
+
 func BenchmarkValid(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_ = Valid(TestData1)
@@ -908,6 +2346,29 @@ func TestJsonGet_Order(t *testing.T) {
 	assertEqual(t, "3", j.Get("0").String())
 }
 
+func TestJsonRenameKeys(t *testing.T) {
+	j := JSON(`{"user_id":1,"tags":["a_b"],"home":{"zip_code":"x","a\"b":2}}`)
+	r := j.RenameKeys(func(k string) string { return toCase(k, "camel") })
+	assertEqual(t, `{"userId":1,"tags":["a_b"],"home":{"zipCode":"x","aB":2}}`, r.String())
+}
+
+func TestWords(t *testing.T) {
+	tt := []struct {
+		give string
+		then []string
+	}{
+		{give: ``, then: nil},
+		{give: `userID`, then: []string{"user", "ID"}},
+		{give: `HTTPServer`, then: []string{"HTTP", "Server"}},
+		{give: `getHTTP2Response`, then: []string{"get", "HTTP2", "Response"}},
+		{give: `snake_case-kebab case`, then: []string{"snake", "case", "kebab", "case"}},
+		{give: `v2`, then: []string{"v2"}},
+	}
+	for _, tc := range tt {
+		assertEqual(t, tc.then, words(tc.give), tc.give)
+	}
+}
+
 func TestJsonForEachKeyVal(t *testing.T) {
 	tt := []struct {
 		give string
@@ -1035,6 +2496,126 @@ func TestJsonFloat(t *testing.T) {
 	}
 }
 
+func TestJsonCanonical(t *testing.T) {
+	tt := []struct {
+		give string
+		then string
+	}{
+		{give: ``, then: ``},
+		{give: `3`, then: `3`},
+		{give: `"\u0041\u00e9\n\u0001"`, then: `"Aé\n\u0001"`},
+		{give: `{ "b": { "d": 1, "c": [ 2, { "f": 3, "e": 4 } ] }, "a": null }`, then: `{"a":null,"b":{"c":[2,{"e":4,"f":3}],"d":1}}`},
+		{give: `{"\u0062":1,"a":2}`, then: `{"a":2,"b":1}`},
+		{give: `[ ]`, then: `[]`},
+		{give: `{"k":"a\/b"}`, then: `{"k":"a/b"}`},
+		{give: `{"a\/b":"\ud83d\ude00 \ud83d"}`, then: "{\"a/b\":\"\U0001f600 \ufffd\"}"},
+		{give: `"a\x"`, then: `"a\x"`},
+		{give: `[1, 1.0, 1e0, 10E-1, 0.1e1, -0, -0.0, 0e5]`, then: `[1,1,1,1,1,0,0,0]`},
+		{give: `[123.4500, 1e20, 1e21, 1.5e21, 0.000001, 1e-7, -12.5e-8]`, then: `[123.45,100000000000000000000,1e+21,1.5e+21,0.000001,1e-7,-1.25e-7]`},
+		{give: `[12345678901234567890123, 9007199254740993.000]`, then: `[1.2345678901234567890123e+22,9007199254740993]`},
+		{give: `{"a":2.50}`, then: `{"a":2.5}`},
+	}
+	for _, tc := range tt {
+		j := JSON(tc.give)
+		assertEqual(t, tc.then, j.Canonical().String(), tc.give)
+	}
+
+	x := Get(`{"n":1}`, `(sha256 -j)`)
+	y := Get(`{"n":1.0e0}`, `(sha256 -j)`)
+	assertEqual(t, x.String(), y.String(), "numbers")
+
+	a := Get(`{"k":"a\/b"}`, `(sha256 -j)`)
+	b := Get(`{"k":""}`, `(sha256 -j)`)
+	c := Get(`{"k":"a/b"}`, `(sha256 -j)`)
+	assertEqual(t, true, a.String() != b.String() && a.String() == c.String())
+}
+
+func TestJsonBigInt(t *testing.T) {
+	tt := []struct {
+		give string
+		then string
+	}{
+		{give: ``, then: `0`},
+		{give: `"1"`, then: `0`},
+		{give: `1.5`, then: `0`},
+		{give: `-12345678901234567890`, then: `-12345678901234567890`},
+		{give: `1.5e3`, then: `1500`},
+	}
+	for _, tc := range tt {
+		j := JSON(tc.give)
+		assertEqual(t, tc.then, j.BigInt().String(), tc.give)
+	}
+}
+
+func TestJsonBigFloat(t *testing.T) {
+	tt := []struct {
+		give string
+		then string
+	}{
+		{give: ``, then: `0`},
+		{give: `"1"`, then: `0`},
+		{give: `12345678901234567890.5`, then: `12345678901234567890.5`},
+		{give: `-2.5e-3`, then: `-0.0025`},
+	}
+	for _, tc := range tt {
+		j := JSON(tc.give)
+		assertEqual(t, tc.then, j.BigFloat().Text('f', -1), tc.give)
+	}
+}
+
+func TestJsonDecimal(t *testing.T) {
+	tt := []struct {
+		give string
+		then string
+	}{
+		{give: ``, then: `<nil>`},
+		{give: `"1"`, then: `<nil>`},
+		{give: `.5`, then: `<nil>`},
+		{give: `-.5`, then: `<nil>`},
+		{give: `1e99999`, then: `<nil>`},
+		{give: `0`, then: `0/1`},
+		{give: `-0.0`, then: `0/1`},
+		{give: `0.1`, then: `1/10`},
+		{give: `-2.50`, then: `-5/2`},
+		{give: `1.5E+2`, then: `150/1`},
+		{give: `25e-3`, then: `1/40`},
+	}
+	for _, tc := range tt {
+		j := JSON(tc.give)
+		r := j.Decimal()
+		if r == nil {
+			assertEqual(t, tc.then, `<nil>`, tc.give)
+			continue
+		}
+		assertEqual(t, tc.then, r.String(), tc.give)
+	}
+}
+
+func TestCmpNumber(t *testing.T) {
+	tt := []struct {
+		a, b string
+		then int
+	}{
+		{a: `9007199254740993`, b: `9007199254740992`, then: +1},
+		{a: `9007199254740992`, b: `9007199254740993`, then: -1},
+		{a: `18446744073709551615`, b: `18446744073709551615.0`, then: 0},
+		{a: `1e2`, b: `100`, then: 0},
+		{a: `0.1`, b: `1e-1`, then: 0},
+		{a: `-0`, b: `0`, then: 0},
+		{a: `0`, b: `-1`, then: +1},
+		{a: `0`, b: `0.001`, then: -1},
+		{a: `-2`, b: `-10`, then: +1},
+		{a: `-2.5`, b: `-2.25`, then: -1},
+		{a: `99`, b: `100`, then: -1},
+		{a: `1.10`, b: `1.1`, then: 0},
+	}
+	for _, tc := range tt {
+		assertEqual(t, tc.then, cmpNumber(JSON(tc.a), JSON(tc.b)), tc.a+" "+tc.b)
+	}
+	assertEqual(t, false, JSON(`9007199254740993`).EQ(JSON(`9007199254740992`)), "EQ")
+	assertEqual(t, true, JSON(`9007199254740993`).GT(JSON(`9007199254740992`)), "GT")
+}
+
 func TestJsonBool(t *testing.T) {
 	tt := []struct {
 		give string
@@ -0,0 +1,589 @@
+package jsqt
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FromTOML converts a TOML 1.0 document to a JSON object. Key order
+// is kept and dates and times are converted to strings. It fails
+// on inf and nan floats, since JSON doesn't have them.
+func FromTOML(r io.Reader) (Json, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return JSON(""), err
+	}
+	p := tomlParser{s: strings.TrimPrefix(string(b), "\ufeff"), root: &tomlTable{}}
+	if err := p.parse(); err != nil {
+		return JSON(""), err
+	}
+	var o strings.Builder
+	o.Grow(len(p.s))
+	p.root.json(&o)
+	return JSON(o.String()), nil
+}
+
+// tomlParser parses a TOML document into tables.
+type tomlParser struct {
+	s    string
+	i    int
+	root *tomlTable
+}
+
+// tomlTable is a table that keeps the order of its keys.
+// Values are JSON strings, *tomlTable or *tomlArray.
+type tomlTable struct {
+	keys   []string
+	vals   map[string]any
+	header bool // Defined by a [table] header.
+	dotted bool // Defined by dotted keys.
+	inline bool // Inline tables can't be extended.
+}
+
+type tomlArray struct {
+	items  []any
+	tables bool // Array of tables, that [[headers]] extend.
+}
+
+func (t *tomlTable) get(key string) (any, bool) {
+	v, ok := t.vals[key]
+	return v, ok
+}
+
+func (t *tomlTable) set(key string, v any) {
+	if t.vals == nil {
+		t.vals = map[string]any{}
+	}
+	t.keys = append(t.keys, key)
+	t.vals[key] = v
+}
+
+func (t *tomlTable) json(o *strings.Builder) {
+	o.WriteString("{")
+	for i, k := range t.keys {
+		if i > 0 {
+			o.WriteString(",")
+		}
+		o.WriteString(quoteJSON(k))
+		o.WriteString(":")
+		tomlJSON(o, t.vals[k])
+	}
+	o.WriteString("}")
+}
+
+func tomlJSON(o *strings.Builder, v any) {
+	switch v := v.(type) {
+	case *tomlTable:
+		v.json(o)
+	case *tomlArray:
+		o.WriteString("[")
+		for i, item := range v.items {
+			if i > 0 {
+				o.WriteString(",")
+			}
+			tomlJSON(o, item)
+		}
+		o.WriteString("]")
+	case string:
+		o.WriteString(v)
+	}
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	line := strings.Count(p.s[:min(p.i, len(p.s))], "\n") + 1
+	return fmt.Errorf("toml: line %d: "+format, append([]any{line}, args...)...)
+}
+
+func (p *tomlParser) parse() error {
+	cur := p.root
+	for {
+		p.skipSpace(true)
+		if p.i >= len(p.s) {
+			return nil
+		}
+		var err error
+		if strings.HasPrefix(p.s[p.i:], "[[") {
+			p.i += 2
+			cur, err = p.header(true)
+		} else if p.s[p.i] == '[' {
+			p.i++
+			cur, err = p.header(false)
+		} else {
+			err = p.keyVal(cur)
+		}
+		if err != nil {
+			return err
+		}
+		p.skipSpace(false)
+		if p.i < len(p.s) && p.s[p.i] != '\n' && !strings.HasPrefix(p.s[p.i:], "\r\n") {
+			return p.errorf("expected a new line")
+		}
+	}
+}
+
+// skipSpace skips spaces and comments, and new lines too when nl is true.
+func (p *tomlParser) skipSpace(nl bool) {
+	for p.i < len(p.s) {
+		switch c := p.s[p.i]; {
+		case c == ' ' || c == '\t':
+			p.i++
+		case c == '#':
+			for p.i < len(p.s) && p.s[p.i] != '\n' {
+				p.i++
+			}
+		case nl && (c == '\n' || c == '\r'):
+			p.i++
+		default:
+			return
+		}
+	}
+}
+
+// header parses a [table] or [[array of tables]] header
+// and returns the table that the next keys belong to.
+func (p *tomlParser) header(array bool) (*tomlTable, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+	if p.skipSpace(false); !strings.HasPrefix(p.s[p.i:], closing) {
+		return nil, p.errorf("expected %s", closing)
+	}
+	p.i += len(closing)
+	t, err := p.walk(p.root, keys[:len(keys)-1], false)
+	if err != nil {
+		return nil, err
+	}
+	key := keys[len(keys)-1]
+	v, ok := t.get(key)
+	if array {
+		if !ok {
+			v = &tomlArray{tables: true}
+			t.set(key, v)
+		}
+		a, isArr := v.(*tomlArray)
+		if !isArr || !a.tables {
+			return nil, p.errorf("key %s is not an array of tables", key)
+		}
+		n := &tomlTable{header: true}
+		a.items = append(a.items, n)
+		return n, nil
+	}
+	if !ok {
+		n := &tomlTable{header: true}
+		t.set(key, n)
+		return n, nil
+	}
+	n, isTable := v.(*tomlTable)
+	if !isTable || n.header || n.dotted || n.inline {
+		return nil, p.errorf("table %s is already defined", key)
+	}
+	n.header = true
+	return n, nil
+}
+
+// walk returns the table at keys, creating the missing ones.
+func (p *tomlParser) walk(t *tomlTable, keys []string, dotted bool) (*tomlTable, error) {
+	for _, k := range keys {
+		v, ok := t.get(k)
+		if !ok {
+			n := &tomlTable{dotted: dotted}
+			t.set(k, n)
+			t = n
+			continue
+		}
+		switch v := v.(type) {
+		case *tomlTable:
+			if v.inline || dotted && v.header {
+				return nil, p.errorf("table %s can't be extended", k)
+			}
+			t = v
+		case *tomlArray:
+			if !v.tables || dotted {
+				return nil, p.errorf("key %s is not a table", k)
+			}
+			t = v.items[len(v.items)-1].(*tomlTable)
+		default:
+			return nil, p.errorf("key %s is not a table", k)
+		}
+	}
+	return t, nil
+}
+
+// keyVal parses a key = value pair into t.
+func (p *tomlParser) keyVal(t *tomlTable) error {
+	keys, err := p.keys()
+	if err != nil {
+		return err
+	}
+	if p.skipSpace(false); p.i >= len(p.s) || p.s[p.i] != '=' {
+		return p.errorf("expected =")
+	}
+	p.i++
+	p.skipSpace(false)
+	v, err := p.value()
+	if err != nil {
+		return err
+	}
+	if t, err = p.walk(t, keys[:len(keys)-1], true); err != nil {
+		return err
+	}
+	key := keys[len(keys)-1]
+	if _, ok := t.get(key); ok {
+		return p.errorf("duplicate key %s", key)
+	}
+	t.set(key, v)
+	return nil
+}
+
+// keys parses a dotted key like a."b c".d.
+func (p *tomlParser) keys() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace(false)
+		if p.i >= len(p.s) {
+			return nil, p.errorf("expected a key")
+		}
+		switch c := p.s[p.i]; {
+		case c == '"' || c == '\'':
+			if strings.HasPrefix(p.s[p.i:], `"""`) || strings.HasPrefix(p.s[p.i:], "'''") {
+				return nil, p.errorf("multi-line strings can't be keys")
+			}
+			k, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		default:
+			j := p.i
+			for p.i < len(p.s) && isTOMLBareKey(p.s[p.i]) {
+				p.i++
+			}
+			if j == p.i {
+				return nil, p.errorf("expected a key")
+			}
+			keys = append(keys, p.s[j:p.i])
+		}
+		if p.skipSpace(false); p.i >= len(p.s) || p.s[p.i] != '.' {
+			return keys, nil
+		}
+		p.i++
+	}
+}
+
+func isTOMLBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) value() (any, error) {
+	if p.i >= len(p.s) {
+		return nil, p.errorf("expected a value")
+	}
+	switch c := p.s[p.i]; {
+	case c == '"' || c == '\'':
+		s, err := p.str()
+		return quoteJSON(s), err
+	case c == '[':
+		p.i++
+		a := &tomlArray{}
+		for {
+			p.skipSpace(true)
+			if p.i < len(p.s) && p.s[p.i] == ']' {
+				p.i++
+				return a, nil
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			a.items = append(a.items, v)
+			if p.skipSpace(true); p.i < len(p.s) && p.s[p.i] == ',' {
+				p.i++
+			} else if p.i >= len(p.s) || p.s[p.i] != ']' {
+				return nil, p.errorf("expected , or ] in array")
+			}
+		}
+	case c == '{':
+		p.i++
+		t := &tomlTable{}
+		for {
+			p.skipSpace(false)
+			if p.i < len(p.s) && p.s[p.i] == '}' && len(t.keys) == 0 {
+				p.i++
+				break
+			}
+			if err := p.keyVal(t); err != nil {
+				return nil, err
+			}
+			if p.skipSpace(false); p.i < len(p.s) && p.s[p.i] == ',' {
+				p.i++
+			} else if p.i < len(p.s) && p.s[p.i] == '}' {
+				p.i++
+				break
+			} else {
+				return nil, p.errorf("expected , or } in inline table")
+			}
+		}
+		t.inline = true
+		return t, nil
+	}
+	// Numbers, booleans and dates. A date and a time can be separated by a space.
+	j := p.i
+	for p.i < len(p.s) && (isTOMLBareKey(p.s[p.i]) || strings.IndexByte("+.:", p.s[p.i]) >= 0 ||
+		p.s[p.i] == ' ' && p.i-j == 10 && p.i+1 < len(p.s) && p.s[p.i+1] >= '0' && p.s[p.i+1] <= '9') {
+		p.i++
+	}
+	if v, ok := tomlScalar(p.s[j:p.i]); ok {
+		return v, nil
+	}
+	if v := strings.TrimLeft(p.s[j:p.i], "+-"); v == "inf" || v == "nan" {
+		return nil, p.errorf("%s is not supported by JSON", p.s[j:p.i])
+	}
+	return nil, p.errorf("invalid value %q", p.s[j:p.i])
+}
+
+var (
+	tomlDateRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}:\d{2}(\.\d+)?([Zz]|[+-]\d{2}:\d{2})?)?$`)
+	tomlTimeRe = regexp.MustCompile(`^\d{2}:\d{2}:\d{2}(\.\d+)?$`)
+	tomlIntRe  = regexp.MustCompile(`^[+-]?(0|[1-9](_?\d)*)$`)
+	tomlNumRe  = regexp.MustCompile(`^[+-]?(0|[1-9](_?\d)*)(\.\d(_?\d)*)?([eE][+-]?\d(_?\d)*)?$`)
+)
+
+// tomlScalar converts a number, a boolean or a date to JSON.
+func tomlScalar(s string) (string, bool) {
+	switch {
+	case s == "true" || s == "false":
+		return s, true
+	case tomlDateRe.MatchString(s):
+		return quoteJSON(strings.Replace(s, " ", "T", 1)), true
+	case tomlTimeRe.MatchString(s):
+		return quoteJSON(s), true
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0o") || strings.HasPrefix(s, "0b"):
+		base := map[byte]int{'x': 16, 'o': 8, 'b': 2}[s[1]]
+		d := s[2:]
+		if d == "" || d[0] == '_' || strings.HasSuffix(d, "_") || strings.Contains(d, "__") {
+			return "", false
+		}
+		v, ok := new(big.Int).SetString(strings.ReplaceAll(d, "_", ""), base)
+		if !ok || v.Sign() < 0 {
+			return "", false
+		}
+		return v.String(), true
+	case tomlIntRe.MatchString(s) || tomlNumRe.MatchString(s):
+		return strings.TrimPrefix(strings.ReplaceAll(s, "_", ""), "+"), true
+	}
+	return "", false
+}
+
+// str parses a basic, literal or multi-line string.
+func (p *tomlParser) str() (string, error) {
+	q := p.s[p.i]
+	multi := strings.HasPrefix(p.s[p.i:], strings.Repeat(string(q), 3))
+	if multi {
+		p.i += 3
+		// A new line right after the delimiter is trimmed.
+		if strings.HasPrefix(p.s[p.i:], "\n") {
+			p.i++
+		} else if strings.HasPrefix(p.s[p.i:], "\r\n") {
+			p.i += 2
+		}
+	} else {
+		p.i++
+	}
+	var o strings.Builder
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		if c == q {
+			if !multi {
+				p.i++
+				return o.String(), nil
+			}
+			if n := len(p.s[p.i:]) - len(strings.TrimLeft(p.s[p.i:], string(q))); n >= 3 {
+				// Up to two quotes can come before the delimiter.
+				o.WriteString(strings.Repeat(string(q), min(n-3, 2)))
+				p.i += min(n, 5)
+				return o.String(), nil
+			}
+		}
+		if c == '\n' && !multi {
+			break
+		}
+		if c != '\\' || q == '\'' {
+			o.WriteByte(c)
+			p.i++
+			continue
+		}
+		p.i++
+		if p.i >= len(p.s) {
+			break
+		}
+		n := 0
+		switch e := p.s[p.i]; e {
+		case 'b':
+			o.WriteByte('\b')
+		case 't':
+			o.WriteByte('\t')
+		case 'n':
+			o.WriteByte('\n')
+		case 'f':
+			o.WriteByte('\f')
+		case 'r':
+			o.WriteByte('\r')
+		case '"', '\\':
+			o.WriteByte(e)
+		case 'u':
+			n = 4
+		case 'U':
+			n = 8
+		default:
+			// A backslash at the end of a line trims the white spaces that follow.
+			if rest := strings.TrimLeft(p.s[p.i:], " \t"); multi && (strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n")) {
+				p.i = len(p.s) - len(strings.TrimLeft(rest, " \t\r\n"))
+				continue
+			}
+			return "", p.errorf("invalid escape \\%c", e)
+		}
+		if n > 0 {
+			r, err := strconv.ParseUint(p.s[min(p.i+1, len(p.s)):min(p.i+1+n, len(p.s))], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) || p.i+n >= len(p.s) {
+				return "", p.errorf("invalid unicode escape")
+			}
+			o.WriteRune(rune(r))
+			p.i += n
+		}
+		p.i++
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// ToTOML converts a JSON object to a TOML document. Objects become
+// tables and arrays of objects become arrays of tables. It fails
+// when the JSON isn't an object or has a null, that TOML doesn't have.
+func (j Json) ToTOML() (string, error) {
+	if !j.IsObject() {
+		return "", fmt.Errorf("toml: the document must be an object")
+	}
+	var o strings.Builder
+	o.Grow(len(j.s))
+	err := writeTOML(&o, j, "", false)
+	return o.String(), err
+}
+
+// writeTOML writes the key/value pairs of a table and then its tables.
+func writeTOML(o *strings.Builder, j Json, path string, array bool) error {
+	var err error
+	var pairs strings.Builder
+	var tables []Json // Keys and values.
+	j.ForEachKeyVal(func(k, v Json) bool {
+		key := tomlKey(k.Str())
+		if v.IsObject() || isTOMLTables(v) {
+			tables = append(tables, JSON(key), v)
+			return false
+		}
+		var s string
+		if s, err = tomlValue(v, joinTOMLPath(path, key)); err == nil {
+			pairs.WriteString(key + " = " + s + "\n")
+		}
+		return err != nil
+	})
+	// Tables with only tables don't need a header, like [a] in [a.b].
+	if array || path != "" && (pairs.Len() > 0 || len(tables) == 0) {
+		if o.Len() > 0 {
+			o.WriteString("\n")
+		}
+		if array {
+			o.WriteString("[[" + path + "]]\n")
+		} else {
+			o.WriteString("[" + path + "]\n")
+		}
+	}
+	o.WriteString(pairs.String())
+	for i := 0; i < len(tables) && err == nil; i += 2 {
+		sub, v := joinTOMLPath(path, tables[i].String()), tables[i+1]
+		if v.IsObject() {
+			err = writeTOML(o, v, sub, false)
+			continue
+		}
+		v.ForEach(func(i, v Json) bool {
+			err = writeTOML(o, v, sub, true)
+			return err != nil
+		})
+	}
+	return err
+}
+
+// isTOMLTables reports if a value is written as an array of tables.
+func isTOMLTables(j Json) bool {
+	if !j.IsArray() || j.IsEmptyArray() {
+		return false
+	}
+	all := true
+	j.ForEach(func(i, v Json) bool {
+		all = v.IsObject()
+		return !all
+	})
+	return all
+}
+
+func joinTOMLPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func tomlKey(k string) string {
+	if k != "" && strings.IndexFunc(k, func(r rune) bool { return r > 127 || !isTOMLBareKey(byte(r)) }) < 0 {
+		return k
+	}
+	return tomlQuote(k)
+}
+
+// tomlQuote quotes a basic string. It is like JSON, but DEL must be escaped too.
+func tomlQuote(s string) string {
+	return strings.ReplaceAll(quoteJSON(s), "\x7f", `\u007f`)
+}
+
+// tomlValue writes an inline value.
+func tomlValue(j Json, path string) (string, error) {
+	switch {
+	case j.IsNull():
+		return "", fmt.Errorf("toml: null value at %s", path)
+	case j.IsString():
+		return tomlQuote(j.Str()), nil
+	case j.IsArray():
+		var items []string
+		var err error
+		j.ForEach(func(i, v Json) bool {
+			var s string
+			s, err = tomlValue(v, path+"["+i.String()+"]")
+			items = append(items, s)
+			return err != nil
+		})
+		return "[" + strings.Join(items, ", ") + "]", err
+	case j.IsObject():
+		var items []string
+		var err error
+		j.ForEachKeyVal(func(k, v Json) bool {
+			var s string
+			key := tomlKey(k.Str())
+			s, err = tomlValue(v, joinTOMLPath(path, key))
+			items = append(items, key+" = "+s)
+			return err != nil
+		})
+		if len(items) == 0 {
+			return "{}", err
+		}
+		return "{ " + strings.Join(items, ", ") + " }", err
+	}
+	return j.String(), nil
+}
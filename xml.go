@@ -0,0 +1,318 @@
+package jsqt
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// XMLOptions configures FromXML and Json.ToXML.
+type XMLOptions struct {
+	Attr    string   // Prefix of attribute keys. Defaults to "@".
+	Text    string   // Key of the text of elements with attributes or children. Defaults to "#text".
+	Arrays  []string // Elements that are always arrays, even when they appear once.
+	StripNS bool     // Removes namespace prefixes from names and drops xmlns attributes.
+	Infer   bool     // Converts numbers and booleans. Otherwise every value is a string.
+	Root    string   // ToXML only. Wraps the JSON in this element.
+	Indent  string   // ToXML only. Indents the elements with this string.
+}
+
+func (o XMLOptions) defaults() XMLOptions {
+	if o.Attr == "" {
+		o.Attr = "@"
+	}
+	if o.Text == "" {
+		o.Text = "#text"
+	}
+	return o
+}
+
+// FromXML converts an XML document to a JSON object with the root
+// element as its single key. Attributes become keys with the Attr
+// prefix; the text of elements without attributes and children is
+// their value, otherwise it goes in the Text key; repeated elements
+// become arrays, self-closing elements like <a/> become null and other
+// empty elements like <a></a> become empty strings. Text is trimmed;
+// comments and processing instructions are ignored. Qualified names
+// are kept as written, like "soap:Body", unless StripNS is set.
+func FromXML(r io.Reader, opts XMLOptions) (Json, error) {
+	opts = opts.defaults()
+	d := xml.NewDecoder(r)
+	d.CharsetReader = xmlCharset
+	var stack []*xmlElem
+	var root string
+	errorf := func(format string, args ...any) error {
+		line, _ := d.InputPos()
+		return fmt.Errorf("xml: line %d: "+format, append([]any{line}, args...)...)
+	}
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return JSON(""), err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 && root != "" {
+				return JSON(""), errorf("more than one root element")
+			}
+			e := &xmlElem{name: xmlName(t.Name, opts), vals: map[string][]string{}}
+			for _, a := range t.Attr {
+				if opts.StripNS && (a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns") {
+					continue
+				}
+				e.add(opts.Attr+xmlName(a.Name, opts), xmlScalar(a.Value, opts))
+			}
+			if len(stack) > 0 {
+				stack[len(stack)-1].flush()
+			}
+			e.end = d.InputOffset()
+			stack = append(stack, e)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return JSON(""), errorf("unexpected </%s>", xmlName(t.Name, opts))
+			}
+			e := stack[len(stack)-1]
+			if n := xmlName(t.Name, opts); n != e.name {
+				return JSON(""), errorf("element <%s> closed by </%s>", e.name, n)
+			}
+			stack = stack[:len(stack)-1]
+			// The decoder reads nothing for the end of a self-closing element.
+			e.selfClosing = d.InputOffset() == e.end
+			v := e.json(opts)
+			if len(stack) == 0 {
+				root = "{" + quoteJSON(e.name) + ":" + v + "}"
+			} else {
+				stack[len(stack)-1].add(e.name, v)
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return JSON(""), errorf("text outside the root element")
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return JSON(""), errorf("element <%s> is not closed", stack[len(stack)-1].name)
+	}
+	if root == "" {
+		return JSON(""), errorf("no root element")
+	}
+	return JSON(root), nil
+}
+
+// xmlElem collects the attributes, children and text of an element.
+type xmlElem struct {
+	name        string
+	keys        []string
+	vals        map[string][]string
+	text        strings.Builder // Current text.
+	texts       []string        // Text between children.
+	end         int64           // Input offset of the end of the start tag.
+	selfClosing bool
+}
+
+func (e *xmlElem) add(k, v string) {
+	if _, ok := e.vals[k]; !ok {
+		e.keys = append(e.keys, k)
+	}
+	e.vals[k] = append(e.vals[k], v)
+}
+
+func (e *xmlElem) flush() {
+	if s := strings.TrimSpace(e.text.String()); s != "" {
+		e.texts = append(e.texts, s)
+	}
+	e.text.Reset()
+}
+
+func (e *xmlElem) json(opts XMLOptions) string {
+	e.flush()
+	text := strings.Join(e.texts, " ")
+	if len(e.keys) == 0 {
+		if text == "" && e.selfClosing {
+			return "null"
+		}
+		return xmlScalar(text, opts)
+	}
+	if text != "" {
+		e.add(opts.Text, xmlScalar(text, opts))
+	}
+	var o strings.Builder
+	o.WriteString("{")
+	for _, k := range e.keys {
+		if o.Len() > 1 {
+			o.WriteString(",")
+		}
+		o.WriteString(quoteJSON(k) + ":")
+		if v := e.vals[k]; len(v) > 1 || slices.Contains(opts.Arrays, k) {
+			o.WriteString("[" + strings.Join(v, ",") + "]")
+		} else {
+			o.WriteString(v[0])
+		}
+	}
+	o.WriteString("}")
+	return o.String()
+}
+
+func xmlName(n xml.Name, opts XMLOptions) string {
+	if n.Space == "" || opts.StripNS {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+func xmlScalar(s string, opts XMLOptions) string {
+	if opts.Infer && (s == "true" || s == "false" || isNumber(s)) {
+		return s
+	}
+	return quoteJSON(s)
+}
+
+// xmlCharset decodes the single byte charsets
+// that are common in older documents.
+func xmlCharset(label string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(label) {
+	case "iso-8859-1", "latin1", "us-ascii":
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		s := make([]rune, len(b))
+		for i, c := range b {
+			s[i] = rune(c)
+		}
+		return strings.NewReader(string(s)), nil
+	}
+	return nil, fmt.Errorf("unsupported charset")
+}
+
+// ToXML converts JSON to XML with the mapping of FromXML.
+// The JSON must be an object with a single key, the root
+// element, unless the Root option is set. Arrays become
+// repeated elements, null becomes a self-closing element
+// and an empty string an empty element.
+func (j Json) ToXML(opts XMLOptions) (string, error) {
+	opts = opts.defaults()
+	var o strings.Builder
+	o.Grow(len(j.s) * 2)
+	name, v := opts.Root, j
+	if name == "" {
+		var keys, vals []Json
+		j.ForEachKeyVal(func(k, v Json) bool {
+			keys, vals = append(keys, k), append(vals, v)
+			return false
+		})
+		if !j.IsObject() || len(keys) != 1 {
+			return "", fmt.Errorf("xml: the document must be an object with a single key")
+		}
+		name, v = keys[0].Str(), vals[0]
+	}
+	if v.IsArray() {
+		return "", fmt.Errorf("xml: the root element can't be an array")
+	}
+	err := writeXML(&o, name, v, opts, "", name)
+	return o.String(), err
+}
+
+// writeXML writes the element name with the value j.
+func writeXML(o *strings.Builder, name string, j Json, opts XMLOptions, ind, path string) error {
+	if j.IsArray() {
+		var err error
+		j.ForEach(func(i, v Json) bool {
+			p := path + "[" + i.String() + "]"
+			if v.IsArray() {
+				err = fmt.Errorf("xml: nested array at %s", p)
+			} else {
+				if i.String() != "0" && opts.Indent != "" {
+					o.WriteString("\n" + ind)
+				}
+				err = writeXML(o, name, v, opts, ind, p)
+			}
+			return err != nil
+		})
+		return err
+	}
+	if !isXMLName(name) {
+		return fmt.Errorf("xml: invalid name %q at %s", name, path)
+	}
+	o.WriteString("<" + name)
+	var err error
+	var text string
+	var children []Json // Keys and values.
+	if j.IsObject() {
+		j.ForEachKeyVal(func(k, v Json) bool {
+			key := k.Str()
+			switch {
+			case key == opts.Text:
+				text = xmlText(v)
+			case strings.HasPrefix(key, opts.Attr):
+				attr := key[len(opts.Attr):]
+				if !isXMLName(attr) {
+					err = fmt.Errorf("xml: invalid name %q at %s", attr, path+"."+key)
+				} else if v.IsObject() || v.IsArray() {
+					err = fmt.Errorf("xml: attribute %s must be a scalar at %s", attr, path)
+				} else {
+					o.WriteString(" " + attr + `="` + xmlAttrEscaper.Replace(xmlText(v)) + `"`)
+				}
+			default:
+				children = append(children, k, v)
+			}
+			return err != nil
+		})
+	} else {
+		text = xmlText(j)
+	}
+	if err != nil {
+		return err
+	}
+	if text == "" && len(children) == 0 && !j.IsString() {
+		o.WriteString("/>")
+		return nil
+	}
+	o.WriteString(">" + xmlTextEscaper.Replace(text))
+	for i := 0; i < len(children) && err == nil; i += 2 {
+		k := children[i].Str()
+		if opts.Indent != "" {
+			o.WriteString("\n" + ind + opts.Indent)
+		}
+		err = writeXML(o, k, children[i+1], opts, ind+opts.Indent, path+"."+k)
+	}
+	if len(children) > 0 && opts.Indent != "" {
+		o.WriteString("\n" + ind)
+	}
+	o.WriteString("</" + name + ">")
+	return err
+}
+
+// xmlText returns the text of a scalar.
+func xmlText(j Json) string {
+	switch {
+	case j.IsString():
+		return j.Str()
+	case j.IsNull():
+		return ""
+	}
+	return j.String()
+}
+
+var xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+var xmlAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+// isXMLName reports if s is a valid element or attribute name.
+func isXMLName(s string) bool {
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && r != ':' && (i == 0 || !unicode.IsDigit(r) && r != '-' && r != '.') {
+			return false
+		}
+	}
+	return s != ""
+}
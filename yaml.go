@@ -0,0 +1,919 @@
+package jsqt
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FromYAML converts a YAML stream to JSON. Key order is kept, aliases
+// are replaced by their anchored values, merge keys (<<) are merged
+// and a stream with many documents becomes an array of documents.
+// Aliases can expand to at most 1 MB, or the size of the stream.
+// It supports the block and flow styles of YAML 1.2 with the core
+// schema, but not complex keys (? key) nor tags other than !!str.
+// Duplicate keys in a mapping are an error.
+func FromYAML(r io.Reader) (Json, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return JSON(""), err
+	}
+	text := strings.TrimPrefix(string(b), "\ufeff")
+	p := yamlParser{lines: strings.Split(text, "\n"), anchors: map[string]string{}, maxAlias: max(len(text), yamlMaxAlias)}
+	for i, l := range p.lines {
+		p.lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	var docs []string
+	for {
+		for p.n < len(p.lines) && (isBlank(p.lines[p.n]) || strings.HasPrefix(p.lines[p.n], "%")) {
+			p.n++ // Skips directives too.
+		}
+		if p.n >= len(p.lines) {
+			break
+		}
+		if l := p.lines[p.n]; l == "..." || strings.HasPrefix(l, "... ") {
+			p.n++
+			continue
+		}
+		if l := p.lines[p.n]; isDocStart(l) {
+			// Keeps the content after the marker, like in "--- |".
+			p.lines[p.n] = "   " + l[3:]
+		}
+		v, err := p.parseNode(-1)
+		if err != nil {
+			return JSON(""), err
+		}
+		docs = append(docs, v)
+		if p.more() {
+			return JSON(""), p.errorf("unexpected content")
+		}
+	}
+	switch len(docs) {
+	case 0:
+		return JSON("null"), nil
+	case 1:
+		return JSON(docs[0]), nil
+	}
+	return JSON("[" + strings.Join(docs, ",") + "]"), nil
+}
+
+// yamlParser parses YAML block nodes line by line
+// and converts them to JSON as soon as they end.
+type yamlParser struct {
+	lines    []string
+	n        int               // Current line.
+	anchors  map[string]string // Anchored values as JSON.
+	aliased  int               // Bytes of the aliases replaced so far.
+	maxAlias int               // Maximum of aliased.
+}
+
+// yamlMaxAlias is the minimum size in bytes the aliases of a
+// document can expand to. Otherwise a few nested aliases could
+// expand a small document to gigabytes. The limit is the size of
+// the document when it is larger.
+const yamlMaxAlias = 1 << 20
+
+// alias returns the value of the anchor name.
+func (p *yamlParser) alias(line int, name string) (string, error) {
+	v, ok := p.anchors[name]
+	if !ok {
+		return "", p.errorAt(line, "unknown alias *%s", name)
+	}
+	if p.aliased += len(v); p.aliased > p.maxAlias {
+		return "", p.errorAt(line, "aliases expand to more than %d bytes", p.maxAlias)
+	}
+	return v, nil
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	return p.errorAt(p.n, format, args...)
+}
+
+func (p *yamlParser) errorAt(line int, format string, args ...any) error {
+	return fmt.Errorf("yaml: line %d: "+format, append([]any{line + 1}, args...)...)
+}
+
+// more skips blank lines and reports if there is more
+// content in the current document.
+func (p *yamlParser) more() bool {
+	for p.n < len(p.lines) && isBlank(p.lines[p.n]) {
+		p.n++
+	}
+	if p.n >= len(p.lines) {
+		return false
+	}
+	l := p.lines[p.n]
+	return !isDocStart(l) && l != "..." && !strings.HasPrefix(l, "... ")
+}
+
+// line returns the indentation and the text of the
+// current line, without comments and trailing spaces.
+func (p *yamlParser) line() (int, string) {
+	l := p.lines[p.n]
+	i := len(l) - len(strings.TrimLeft(l, " "))
+	return i, strings.TrimRight(yamlStripComment(l[i:]), " \t")
+}
+
+func isBlank(line string) bool {
+	t := strings.TrimSpace(line)
+	return t == "" || t[0] == '#'
+}
+
+func isDocStart(line string) bool {
+	return line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "---\t")
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ") || strings.HasPrefix(text, "-\t")
+}
+
+// parseNode parses a node indented more than parent.
+func (p *yamlParser) parseNode(parent int) (string, error) {
+	if !p.more() {
+		return "null", nil
+	}
+	ind, text := p.line()
+	if ind <= parent {
+		return "null", nil
+	}
+	if isSeqItem(text) {
+		return p.parseSeq(ind)
+	}
+	if _, _, ok := yamlSplitKey(text); ok {
+		return p.parseMap(ind)
+	}
+	p.n++
+	return p.parseValue(text, parent, false)
+}
+
+func (p *yamlParser) parseSeq(ind int) (string, error) {
+	var o strings.Builder
+	o.WriteString("[")
+	for p.more() {
+		i, text := p.line()
+		if i != ind || !isSeqItem(text) {
+			break
+		}
+		// Replaces the dash with a space, so the item is
+		// a node indented past the dash, like "- a: 1".
+		l := p.lines[p.n]
+		p.lines[p.n] = l[:i] + " " + l[i+1:]
+		v, err := p.parseNode(ind)
+		if err != nil {
+			return "", err
+		}
+		if o.Len() > 1 {
+			o.WriteString(",")
+		}
+		o.WriteString(v)
+	}
+	if p.more() {
+		if i, _ := p.line(); i > ind {
+			return "", p.errorf("bad indentation of a sequence entry")
+		}
+	}
+	o.WriteString("]")
+	return o.String(), nil
+}
+
+func (p *yamlParser) parseMap(ind int) (string, error) {
+	var m yamlMap
+	for p.more() {
+		i, text := p.line()
+		if i != ind {
+			if i > ind {
+				return "", p.errorf("bad indentation of a mapping entry")
+			}
+			break
+		}
+		key, rest, ok := yamlSplitKey(text)
+		if !ok {
+			return "", p.errorf("expected a mapping key")
+		}
+		line := p.n
+		p.n++
+		v, err := p.parseValue(rest, ind, true)
+		if err != nil {
+			return "", err
+		}
+		if key == "<<" && !strings.HasPrefix(text, `"`) && !strings.HasPrefix(text, "'") {
+			if err := m.merge(JSON(v)); err != nil {
+				return "", p.errorAt(line, "%v", err)
+			}
+			continue
+		}
+		if !m.set(key, v, true) {
+			return "", p.errorAt(line, "duplicate key %s", key)
+		}
+	}
+	return m.json(), nil
+}
+
+// parseValue parses the value after a key or a dash.
+// When the value is on the next lines, it must be indented
+// more than parent, or be a sequence at the same indentation
+// of a mapping key when inMap is true.
+func (p *yamlParser) parseValue(text string, parent int, inMap bool) (string, error) {
+	line := p.n - 1 // The line of text, that was already consumed.
+	anchor, tag, text := yamlProps(text)
+	var v string
+	var err error
+	switch {
+	case text == "":
+		v = "null"
+		if p.more() {
+			if i, t := p.line(); i > parent || inMap && i == parent && isSeqItem(t) {
+				if i == parent {
+					v, err = p.parseSeq(i)
+				} else {
+					v, err = p.parseNode(parent)
+				}
+			}
+		}
+	case text[0] == '*':
+		v, err = p.alias(line, text[1:])
+	case text[0] == '|' || text[0] == '>':
+		v, err = p.parseBlockScalar(text, parent)
+	case text[0] == '[' || text[0] == '{':
+		for yamlUnclosed(text) && p.more() {
+			_, t := p.line()
+			text += " " + t
+			p.n++
+		}
+		f := yamlFlow{s: text, p: p, line: line}
+		if v, err = f.value(); err == nil {
+			if f.skipWS(); f.i < len(f.s) {
+				err = p.errorAt(line, "unexpected %q after flow collection", f.s[f.i:])
+			}
+		}
+	case text[0] == '"' || text[0] == '\'':
+		// Folds the lines of a multi-line quoted scalar.
+		for yamlUnclosed(text) && p.n < len(p.lines) {
+			if t := strings.TrimSpace(p.lines[p.n]); t == "" {
+				text += "\n"
+			} else if strings.HasSuffix(text, "\n") {
+				text += t
+			} else {
+				text += " " + t
+			}
+			p.n++
+		}
+		s, rest, ok := yamlQuoted(text)
+		if !ok || strings.TrimSpace(rest) != "" {
+			return "", p.errorAt(line, "invalid quoted scalar")
+		}
+		v = quoteJSON(s)
+	default:
+		if _, _, ok := yamlSplitKey(text); ok {
+			return "", p.errorAt(line, "mapping values are not allowed here")
+		}
+		// Folds the continuation lines of a plain scalar.
+		for p.more() {
+			i, t := p.line()
+			if i <= parent || inMap && isSeqItem(t) {
+				break
+			}
+			if _, _, ok := yamlSplitKey(t); ok {
+				return "", p.errorf("bad indentation of a mapping entry")
+			}
+			text += " " + t
+			p.n++
+		}
+		v = yamlPlain(text)
+		if tag == "!!str" {
+			v = quoteJSON(text)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if anchor != "" {
+		p.anchors[anchor] = v
+	}
+	return v, nil
+}
+
+// parseBlockScalar parses a literal (|) or folded (>)
+// block scalar with its chomping and indentation indicators.
+func (p *yamlParser) parseBlockScalar(header string, parent int) (string, error) {
+	chomp, ind := byte(0), -1
+	for _, c := range []byte(header[1:]) {
+		switch {
+		case c == '-' || c == '+':
+			chomp = c
+		case c >= '1' && c <= '9':
+			ind = max(parent, 0) + int(c-'0')
+		default:
+			return "", p.errorAt(p.n-1, "invalid block scalar header %q", header)
+		}
+	}
+	var lines []string
+	for ; p.n < len(p.lines); p.n++ {
+		l := p.lines[p.n]
+		if strings.TrimSpace(l) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		i := len(l) - len(strings.TrimLeft(l, " "))
+		if ind < 0 {
+			if i <= parent {
+				break
+			}
+			ind = i
+		}
+		if i < ind {
+			break
+		}
+		lines = append(lines, l[ind:])
+	}
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	moreInd := func(s string) bool { return s != "" && (s[0] == ' ' || s[0] == '\t') }
+	var o strings.Builder
+	for k, l := range lines {
+		if k > 0 {
+			prev := lines[k-1]
+			switch {
+			case header[0] == '|' || prev == "" || moreInd(prev) || moreInd(l):
+				o.WriteString("\n")
+			case l == "":
+			default:
+				o.WriteString(" ")
+			}
+		}
+		o.WriteString(l)
+	}
+	if len(lines) > 0 && chomp != '-' {
+		o.WriteString("\n")
+	}
+	if chomp == '+' {
+		o.WriteString(strings.Repeat("\n", trailing))
+	}
+	return quoteJSON(o.String()), nil
+}
+
+// yamlMap is a mapping that keeps the order of its keys.
+type yamlMap struct {
+	keys   []string
+	vals   map[string]string
+	merged map[string]bool
+}
+
+// set sets a key. Keys set by a merge don't replace other keys.
+// It returns false when an explicit key is set twice.
+func (m *yamlMap) set(key, val string, explicit bool) bool {
+	if m.vals == nil {
+		m.vals, m.merged = map[string]string{}, map[string]bool{}
+	}
+	if _, ok := m.vals[key]; ok {
+		if !explicit {
+			return true
+		}
+		if !m.merged[key] {
+			return false
+		}
+		m.vals[key], m.merged[key] = val, false
+		return true
+	}
+	m.keys = append(m.keys, key)
+	m.vals[key], m.merged[key] = val, !explicit
+	return true
+}
+
+// merge merges an object or an array of objects
+// as the merge key (<<) does. The first ones win.
+func (m *yamlMap) merge(v Json) error {
+	if v.IsArray() {
+		var err error
+		v.ForEach(func(i, v Json) bool {
+			err = m.merge(v)
+			return err != nil
+		})
+		return err
+	}
+	if !v.IsObject() {
+		return fmt.Errorf("merge key value must be a mapping")
+	}
+	v.ForEachKeyVal(func(k, v Json) bool {
+		m.set(k.Str(), v.String(), false)
+		return false
+	})
+	return nil
+}
+
+func (m *yamlMap) json() string {
+	var o strings.Builder
+	o.WriteString("{")
+	for i, k := range m.keys {
+		if i > 0 {
+			o.WriteString(",")
+		}
+		o.WriteString(quoteJSON(k))
+		o.WriteString(":")
+		o.WriteString(m.vals[k])
+	}
+	o.WriteString("}")
+	return o.String()
+}
+
+// yamlFlow parses a flow collection like [a, {b: c}].
+type yamlFlow struct {
+	s    string
+	i    int
+	p    *yamlParser
+	line int
+}
+
+func (f *yamlFlow) skipWS() {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t') {
+		f.i++
+	}
+}
+
+func (f *yamlFlow) value() (string, error) {
+	f.skipWS()
+	anchor, tag := "", ""
+	for f.i < len(f.s) && (f.s[f.i] == '&' || f.s[f.i] == '!') {
+		j := f.i
+		for f.i < len(f.s) && !strings.ContainsRune(" \t,]}", rune(f.s[f.i])) {
+			f.i++
+		}
+		if f.s[j] == '&' {
+			anchor = f.s[j+1 : f.i]
+		} else {
+			tag = f.s[j:f.i]
+		}
+		f.skipWS()
+	}
+	var v string
+	c := byte(0)
+	if f.i < len(f.s) {
+		c = f.s[f.i]
+	}
+	switch {
+	case c == 0 || c == ',' || c == ']' || c == '}':
+		v = "null"
+	case c == '[':
+		f.i++
+		var items []string
+		for {
+			if f.skipWS(); f.i < len(f.s) && f.s[f.i] == ']' {
+				f.i++
+				break
+			}
+			item, err := f.value()
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+			if !f.next(']') {
+				return "", f.p.errorAt(f.line, "expected , or ] in flow sequence")
+			}
+		}
+		v = "[" + strings.Join(items, ",") + "]"
+	case c == '{':
+		f.i++
+		var m yamlMap
+		for {
+			if f.skipWS(); f.i < len(f.s) && f.s[f.i] == '}' {
+				f.i++
+				break
+			}
+			key, err := f.key()
+			if err != nil {
+				return "", err
+			}
+			val := "null"
+			if f.skipWS(); f.i < len(f.s) && f.s[f.i] == ':' {
+				f.i++
+				if val, err = f.value(); err != nil {
+					return "", err
+				}
+			}
+			if !m.set(key, val, true) {
+				return "", f.p.errorAt(f.line, "duplicate key %s", key)
+			}
+			if !f.next('}') {
+				return "", f.p.errorAt(f.line, "expected , or } in flow mapping")
+			}
+		}
+		v = m.json()
+	case c == '*':
+		j := f.i
+		f.i = f.plainEnd()
+		var err error
+		if v, err = f.p.alias(f.line, f.s[j+1:f.i]); err != nil {
+			return "", err
+		}
+	case c == '"' || c == '\'':
+		s, rest, ok := yamlQuoted(f.s[f.i:])
+		if !ok {
+			return "", f.p.errorAt(f.line, "invalid quoted scalar")
+		}
+		f.i = len(f.s) - len(rest)
+		v = quoteJSON(s)
+	default:
+		j := f.i
+		f.i = f.plainEnd()
+		text := strings.TrimSpace(f.s[j:f.i])
+		v = yamlPlain(text)
+		if tag == "!!str" {
+			v = quoteJSON(text)
+		}
+	}
+	if anchor != "" {
+		f.p.anchors[anchor] = v
+	}
+	return v, nil
+}
+
+// key parses the key of a flow mapping entry.
+func (f *yamlFlow) key() (string, error) {
+	if c := f.s[f.i]; c == '"' || c == '\'' {
+		s, rest, ok := yamlQuoted(f.s[f.i:])
+		if !ok {
+			return "", f.p.errorAt(f.line, "invalid quoted key")
+		}
+		f.i = len(f.s) - len(rest)
+		return s, nil
+	}
+	j := f.i
+	f.i = f.plainEnd()
+	return strings.TrimSpace(f.s[j:f.i]), nil
+}
+
+// plainEnd returns the end of a plain scalar in a flow collection.
+func (f *yamlFlow) plainEnd() int {
+	i := f.i
+	for ; i < len(f.s); i++ {
+		c := f.s[i]
+		if c == ',' || c == ']' || c == '}' {
+			break
+		}
+		if c == ':' && (i+1 == len(f.s) || strings.IndexByte(" \t,]}", f.s[i+1]) >= 0) {
+			break
+		}
+	}
+	return i
+}
+
+// next skips the comma after an entry and reports if the
+// entry is followed by a comma or by the closing character.
+func (f *yamlFlow) next(closing byte) bool {
+	f.skipWS()
+	if f.i < len(f.s) && f.s[f.i] == ',' {
+		f.i++
+		return true
+	}
+	return f.i < len(f.s) && f.s[f.i] == closing
+}
+
+// yamlProps splits the anchor and tag properties from a node.
+func yamlProps(text string) (anchor, tag, rest string) {
+	for text != "" && (text[0] == '&' || text[0] == '!') {
+		prop, after, _ := strings.Cut(text, " ")
+		if prop[0] == '&' {
+			anchor = prop[1:]
+		} else {
+			tag = prop
+		}
+		text = strings.TrimLeft(after, " \t")
+	}
+	return anchor, tag, text
+}
+
+// yamlSplitKey splits a "key: value" line.
+func yamlSplitKey(text string) (key, rest string, ok bool) {
+	if text == "" || strings.IndexByte("[{#&*!|>%@`", text[0]) >= 0 || isSeqItem(text) {
+		return "", "", false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		s, after, valid := yamlQuoted(text)
+		after = strings.TrimLeft(after, " \t")
+		if !valid || !strings.HasPrefix(after, ":") || len(after) > 1 && after[1] != ' ' && after[1] != '\t' {
+			return "", "", false
+		}
+		return s, strings.TrimSpace(after[1:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ' || text[i+1] == '\t') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// yamlStripComment removes a comment from a line.
+func yamlStripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.IndexByte(" \t[{,:", s[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '#':
+			if i == 0 || s[i-1] == ' ' || s[i-1] == '\t' {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+// yamlUnclosed reports if a flow collection or
+// a quoted scalar doesn't end in the text.
+func yamlUnclosed(text string) bool {
+	if text[0] == '"' || text[0] == '\'' {
+		_, _, ok := yamlQuoted(text)
+		return !ok
+	}
+	depth := 0
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.IndexByte(" \t[{,:", text[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+// yamlQuoted decodes the quoted scalar at the start of text
+// and returns the text after it.
+func yamlQuoted(text string) (string, string, bool) {
+	var o strings.Builder
+	if text[0] == '\'' {
+		for i := 1; i < len(text); i++ {
+			if text[i] == '\'' {
+				if i+1 < len(text) && text[i+1] == '\'' {
+					o.WriteByte('\'')
+					i++
+					continue
+				}
+				return o.String(), text[i+1:], true
+			}
+			o.WriteByte(text[i])
+		}
+		return "", "", false
+	}
+	for i := 1; i < len(text); i++ {
+		c := text[i]
+		if c == '"' {
+			return o.String(), text[i+1:], true
+		}
+		if c != '\\' {
+			o.WriteByte(c)
+			continue
+		}
+		if i++; i >= len(text) {
+			break
+		}
+		n := 0
+		switch text[i] {
+		case '0':
+			o.WriteByte(0)
+		case 'a':
+			o.WriteByte('\a')
+		case 'b':
+			o.WriteByte('\b')
+		case 't', '\t':
+			o.WriteByte('\t')
+		case 'n':
+			o.WriteByte('\n')
+		case 'v':
+			o.WriteByte('\v')
+		case 'f':
+			o.WriteByte('\f')
+		case 'r':
+			o.WriteByte('\r')
+		case 'e':
+			o.WriteByte(0x1b)
+		case ' ', '"', '/', '\\':
+			o.WriteByte(text[i])
+		case 'N':
+			o.WriteString("\u0085")
+		case '_':
+			o.WriteString("\u00a0")
+		case 'L':
+			o.WriteString("\u2028")
+		case 'P':
+			o.WriteString("\u2029")
+		case 'x':
+			n = 2
+		case 'u':
+			n = 4
+		case 'U':
+			n = 8
+		default:
+			return "", "", false
+		}
+		if n > 0 {
+			if i+n >= len(text) {
+				return "", "", false
+			}
+			r, err := strconv.ParseUint(text[i+1:i+1+n], 16, 32)
+			if err != nil {
+				return "", "", false
+			}
+			o.WriteRune(rune(r))
+			i += n
+		}
+	}
+	return "", "", false
+}
+
+// yamlPlain resolves a plain scalar with the YAML 1.2 core schema.
+func yamlPlain(s string) string {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return "null"
+	case "true", "True", "TRUE":
+		return "true"
+	case "false", "False", "FALSE":
+		return "false"
+	}
+	n := strings.TrimPrefix(s, "+")
+	if isNumber(n) {
+		return n
+	}
+	if v, ok := yamlInt(n); ok {
+		return v
+	}
+	if f, err := strconv.ParseFloat(n, 64); err == nil && yamlFloatRe.MatchString(n) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return quoteJSON(s)
+}
+
+// yamlInt parses the integers of the core schema that aren't
+// JSON numbers, like 0o17, 0x1F and 007, to decimal.
+func yamlInt(s string) (string, bool) {
+	base, digits := 10, s
+	if strings.HasPrefix(s, "0o") {
+		base, digits = 8, s[2:]
+	} else if strings.HasPrefix(s, "0x") {
+		base, digits = 16, s[2:]
+	}
+	if digits == "" || digits[0] == '+' || digits[0] == '-' && base != 10 {
+		return "", false
+	}
+	v, ok := new(big.Int).SetString(digits, base)
+	if !ok {
+		return "", false
+	}
+	return v.String(), true
+}
+
+var yamlFloatRe = regexp.MustCompile(`^-?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+
+// ToYAML converts the JSON to a YAML document in block style.
+// Strings that YAML 1.2 or 1.1 would read as other values, like
+// "true" or "yes", are quoted.
+func (j Json) ToYAML() string {
+	var o strings.Builder
+	o.Grow(len(j.s) + len(j.s)/2)
+	writeYAML(&o, j, "")
+	return o.String()
+}
+
+func writeYAML(o *strings.Builder, j Json, ind string) {
+	switch {
+	case j.IsObject() && !j.IsEmptyObject():
+		j.ForEachKeyVal(func(k, v Json) bool {
+			o.WriteString(ind)
+			o.WriteString(yamlKey(k.Str()))
+			o.WriteString(":")
+			if isYAMLBlock(v) {
+				o.WriteString("\n")
+				writeYAML(o, v, ind+"  ")
+			} else {
+				o.WriteString(" ")
+				o.WriteString(yamlScalar(v, ind))
+				o.WriteString("\n")
+			}
+			return false
+		})
+	case j.IsArray() && !j.IsEmptyArray():
+		j.ForEach(func(i, v Json) bool {
+			if isYAMLBlock(v) {
+				// Writes the first line of the item after the dash.
+				var b strings.Builder
+				writeYAML(&b, v, ind+"  ")
+				o.WriteString(ind)
+				o.WriteString("- ")
+				o.WriteString(b.String()[len(ind)+2:])
+			} else {
+				o.WriteString(ind)
+				o.WriteString("- ")
+				o.WriteString(yamlScalar(v, ind))
+				o.WriteString("\n")
+			}
+			return false
+		})
+	default:
+		o.WriteString(ind)
+		o.WriteString(yamlScalar(j, ind))
+		o.WriteString("\n")
+	}
+}
+
+func isYAMLBlock(j Json) bool {
+	return j.IsObject() && !j.IsEmptyObject() || j.IsArray() && !j.IsEmptyArray()
+}
+
+func yamlKey(s string) string {
+	if yamlIsPlain(s) {
+		return s
+	}
+	return quoteJSON(s)
+}
+
+// yamlScalar writes a scalar. Multi-line strings become literal
+// block scalars, indented past ind; unsafe strings are quoted.
+func yamlScalar(j Json, ind string) string {
+	if !j.IsString() {
+		return j.String()
+	}
+	s := j.Str()
+	if yamlIsPlain(s) {
+		return s
+	}
+	if strings.Contains(s, "\n") && strings.TrimLeft(s, "\n") != "" && s[0] != ' ' && s[0] != '\n' && !strings.ContainsFunc(s, func(r rune) bool {
+		return r != '\n' && (unicode.IsControl(r) || r == '\ufeff')
+	}) {
+		body := strings.TrimRight(s, "\n")
+		header := "|-"
+		if n := len(s) - len(body); n == 1 {
+			header = "|"
+		} else if n > 1 {
+			header = "|+"
+		}
+		var o strings.Builder
+		o.WriteString(header)
+		for _, l := range strings.Split(body, "\n") {
+			o.WriteString("\n")
+			if l != "" {
+				o.WriteString(ind + "  " + l)
+			}
+		}
+		o.WriteString(strings.Repeat("\n", max(0, len(s)-len(body)-1)))
+		return o.String()
+	}
+	return quoteJSON(s)
+}
+
+// yamlIsPlain reports if a string can be written as a plain
+// scalar, that is read back as the same string.
+func yamlIsPlain(s string) bool {
+	if s == "" || s != strings.TrimSpace(s) || strings.IndexByte("-?:,[]{}#&*!|>'\"%@`.", s[0]) >= 0 {
+		return false
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return false
+	}
+	if strings.ContainsFunc(s, func(r rune) bool { return unicode.IsControl(r) || r == '\ufeff' }) {
+		return false
+	}
+	if yamlBool11(s) {
+		return false
+	}
+	return yamlPlain(s) == quoteJSON(s)
+}
+
+// yamlBool11 reports if s is a boolean of YAML 1.1, like yes or Off,
+// which YAML 1.1 parsers would not read back as a string.
+func yamlBool11(s string) bool {
+	switch strings.ToLower(s) {
+	case "y", "n", "yes", "no", "on", "off":
+		return true
+	}
+	return false
+}